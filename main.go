@@ -8,6 +8,8 @@ import (
 
 func main() {
 	chain, _ := blockchain.NewBadgerChain("/tmp/blockchain")
+	defer chain.Close()
+
 	chain.AddBlock([]byte("first block after genesis"))
 	chain.AddBlock([]byte("second block after genesis"))
 	chain.AddBlock([]byte("third block after genesis"))
@@ -15,10 +17,8 @@ func main() {
 	fmt.Printf("Chain has %d blocks.\n", chain.Length())
 
 	iterator, _ := chain.NewIterator()
-	index := uint64(1)
 	for iterator.HasNext() {
 		block, _ := iterator.Next()
-		fmt.Printf("Block %d is: \n%s\n", chain.Length()-index, block)
-		index++
+		fmt.Printf("Block %d is: \n%s\n", block.Height, block)
 	}
 }
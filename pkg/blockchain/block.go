@@ -1,65 +1,164 @@
 package blockchain
 
 import (
-	"bytes"
-	"crypto/sha256"
-	"encoding/gob"
+	"context"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"time"
 
 	"github.com/samuelvl/blockchain-lab/pkg/pow"
 )
 
-// Difficulty of the hashcash algorithm to compute the nonce. The closer to 256,
-// the harder to find a nonce.
-const Difficulty uint = 16
+// DefaultDifficulty of the hashcash algorithm to compute the nonce when the
+// chain does not set one. The closer to 256, the harder to find a nonce.
+const DefaultDifficulty uint = 16
 
-// Block represents the simplest element of the chain. It stores some data,
-// its corresponding hash and the hash from the previous block.
+// MaxDifficulty is the highest difficulty accepted by the hashcash algorithm.
+// Higher values would make the target unreachable.
+const MaxDifficulty uint = pow.MaxDifficulty
+
+// newMiner returns the hashcash miner of the blocks with the given number of
+// workers, one per CPU if it is not positive, and hash algorithm. It always
+// returns the lowest nonce, so blocks are mined as with a single worker.
+func newMiner(workers int, algorithm pow.Algorithm) *pow.Miner {
+	return pow.NewMiner(workers, true).WithAlgorithm(algorithm)
+}
+
+// ErrInvalidHash error when the block's hash does not match its content.
+var ErrInvalidHash = errors.New("blockchain: invalid block hash")
+
+// ErrInvalidDifficulty error when the block's difficulty is out of range or
+// does not match the chain's difficulty.
+var ErrInvalidDifficulty = errors.New("blockchain: invalid difficulty")
+
+// ErrInvalidNonce error when the block's nonce does not satisfy the hashcash
+// algorithm.
+var ErrInvalidNonce = errors.New("blockchain: invalid block nonce")
+
+// ErrInvalidHeight error when the block's height is not the next one to its
+// previous block's height.
+var ErrInvalidHeight = errors.New("blockchain: invalid block height")
+
+// ErrInvalidTimestamp error when the block's timestamp is not later than its
+// previous block's timestamp or it is too far in the future.
+var ErrInvalidTimestamp = errors.New("blockchain: invalid block timestamp")
+
+// MaxTimeDrift is how far in the future the timestamp of a block may be, to
+// tolerate clocks which are not synchronized.
+const MaxTimeDrift = 2 * time.Hour
+
+// Block represents the simplest element of the chain. It stores a header with
+// the block's metadata, its corresponding hash and an ordered list of records.
+// The hash is the result of mining the header.
 // The previous hash will be empty if it is the first block of the chain.
 type Block struct {
-	Data     []byte `json:"data"`
-	Hash     string `json:"hash"`
-	PrevHash string `json:"prevHash"`
-	Nonce    int32  `json:"nonce"`
+	BlockHeader `json:"header"`
+	Hash        string   `json:"hash"`
+	Records     [][]byte `json:"records"`
+}
+
+// NewBlock returns a block following the parent block with its corresponding
+// hash. The parent block is nil for the Genesis block.
+func NewBlock(records [][]byte, parent *Block, difficulty uint) *Block {
+	block, _ := NewBlockContext(context.Background(), records, parent, difficulty)
+	return block
+}
+
+// NewBlockContext returns a block following the parent block with its
+// corresponding hash. The parent block is nil for the Genesis block. Mining is
+// aborted with pow.ErrMiningCanceled when the context is done.
+func NewBlockContext(ctx context.Context, records [][]byte, parent *Block, difficulty uint) (*Block, error) {
+	return NewBlockWith(ctx, pow.SHA256, records, parent, difficulty)
+}
+
+// NewBlockWith returns a block following the parent block, hashed and mined
+// with the given hash algorithm instead of sha256.
+func NewBlockWith(ctx context.Context, algorithm pow.Algorithm, records [][]byte, parent *Block, difficulty uint) (*Block, error) {
+	return NewBlockWithProof(ctx, algorithm, newMiner(0, algorithm),
+		records, parent, difficulty)
 }
 
-// NewBlock returns a block with its corresponding hash.
-func NewBlock(data []byte, prevHash string) *Block {
+// NewBlockWithProof returns a block following the parent block, hashed with
+// the given hash algorithm and mined with the given Proof of Work instead of
+// hashcash.
+func NewBlockWithProof(ctx context.Context, algorithm pow.Algorithm, proof pow.ProofOfWork, records [][]byte, parent *Block, difficulty uint) (*Block, error) {
 	block := Block{
-		Data:     data,
-		Hash:     "",
-		PrevHash: prevHash,
-		Nonce:    0,
+		BlockHeader: BlockHeader{
+			Version:    BlockVersion,
+			Height:     0,
+			Timestamp:  time.Now().UnixNano(),
+			PrevHash:   "",
+			MerkleRoot: MerkleRootWith(algorithm, records),
+			Difficulty: difficulty,
+			Nonce:      0,
+		},
+		Hash:    "",
+		Records: records,
 	}
-	block.ComputeHash()
-	block.Mine()
-	return &block
+	if parent != nil {
+		block.PrevHash = parent.Hash
+		block.Height = parent.Height + 1
+		// A clock moving backwards must not make the block invalid
+		if block.Timestamp <= parent.Timestamp {
+			block.Timestamp = parent.Timestamp + 1
+		}
+	}
+	block.ComputeHashWith(algorithm)
+	err := block.MineWithProof(ctx, proof)
+	if err != nil {
+		return nil, err
+	}
+	return &block, nil
 }
 
 // FirstBlock returns the first block of the chain from the "Genesis" string.
-func FirstBlock() *Block {
-	return NewBlock([]byte("Genesis"), "")
+func FirstBlock(difficulty uint) *Block {
+	return NewBlock([][]byte{[]byte("Genesis")}, nil, difficulty)
 }
 
-// ComputeHash computes block's hash using the sha256 algorithm:
-// https://datatracker.ietf.org/doc/html/rfc6234
+// ComputeHash computes block's hash from its header using the sha256
+// algorithm: https://datatracker.ietf.org/doc/html/rfc6234
 func (b *Block) ComputeHash() {
-	// The payload is the concatenation of the block's data and the previous
-	// hash, this is join[data, padding, prevHash]. No padding is added between
-	// the data and the previous hash.
-	padding := []byte{}
-	payload := bytes.Join([][]byte{b.Data, []byte(b.PrevHash)}, padding)
+	b.ComputeHashWith(pow.SHA256)
+}
 
-	// Set the hash value as the sha256 of the payload
-	hash := sha256.Sum256(payload)
-	b.Hash = hex.EncodeToString(hash[:])
+// ComputeHashWith computes block's hash from its header using the given hash
+// algorithm.
+func (b *Block) ComputeHashWith(algorithm pow.Algorithm) {
+	b.Hash = b.BlockHeader.hash(algorithm)
 }
 
 // Mine will recompute the block's hash using the Proof of Work "hashcat"
 // algorithm.
 func (b *Block) Mine() error {
-	nonce, err := pow.FindNonce([]byte(b.Hash), Difficulty)
+	return b.MineContext(context.Background())
+}
+
+// MineContext will recompute the block's hash using the Proof of Work
+// "hashcat" algorithm. Mining is aborted with pow.ErrMiningCanceled when the
+// context is done, leaving the block unchanged.
+func (b *Block) MineContext(ctx context.Context) error {
+	return b.MineWith(ctx, pow.SHA256)
+}
+
+// MineWith will recompute the block's hash using the Proof of Work "hashcat"
+// algorithm with the given hash algorithm. The hash must have been computed
+// with the same algorithm.
+func (b *Block) MineWith(ctx context.Context, algorithm pow.Algorithm) error {
+	return b.MineWithProof(ctx, newMiner(0, algorithm))
+}
+
+// MineWithProof will recompute the block's hash using the given Proof of Work
+// instead of hashcash. Mining is aborted with pow.ErrMiningCanceled when the
+// context is done, leaving the block unchanged.
+func (b *Block) MineWithProof(ctx context.Context, proof pow.ProofOfWork) error {
+	// The difficulty must be in the range of the hashcash algorithm
+	if b.Difficulty == 0 || b.Difficulty > MaxDifficulty {
+		return ErrInvalidDifficulty
+	}
+
+	nonce, err := proof.Solve(ctx, []byte(b.Hash), b.Difficulty)
 	if err != nil {
 		return err
 	}
@@ -69,27 +168,108 @@ func (b *Block) Mine() error {
 	return nil
 }
 
-// Serialize converts a block in an slice of bytes. Implemented using the gob
-// library.
+// VerifyProofOfWork checks that the block's nonce satisfies the hashcash
+// algorithm for the block's difficulty and that its hash is the resulting
+// payload. The nonce is not searched again.
+func (b *Block) VerifyProofOfWork() error {
+	return b.VerifyProofOfWorkWith(pow.SHA256)
+}
+
+// VerifyProofOfWorkWith checks the block's nonce and hash as
+// VerifyProofOfWork, for a block mined with the given hash algorithm.
+func (b *Block) VerifyProofOfWorkWith(algorithm pow.Algorithm) error {
+	return b.verifyProofOfWork(algorithm, newMiner(0, algorithm))
+}
+
+// verifyProofOfWork checks the block's nonce and hash with the given Proof of
+// Work, the header being hashed with the given hash algorithm.
+func (b *Block) verifyProofOfWork(algorithm pow.Algorithm, proof pow.ProofOfWork) error {
+	// The difficulty must be in the range of the hashcash algorithm
+	if b.Difficulty == 0 || b.Difficulty > MaxDifficulty {
+		return ErrInvalidDifficulty
+	}
+
+	// Recompute the hash from the block's header
+	headerHash := b.BlockHeader.hash(algorithm)
+
+	// The block's hash is the payload of the nonce, in lowercase hexadecimal
+	// so every block has a single valid hash
+	payload, err := hex.DecodeString(b.Hash)
+	if err != nil || hex.EncodeToString(payload) != b.Hash {
+		return ErrInvalidHash
+	}
+	nonce := pow.Nonce{
+		Value:   b.Nonce,
+		Payload: payload,
+	}
+
+	// Verify the nonce against the recomputed hash
+	err = proof.Verify([]byte(headerHash), &nonce, b.Difficulty)
+	switch err {
+	case pow.ErrInvalidNonce:
+		return ErrInvalidNonce
+	case pow.ErrPayloadMismatch:
+		return ErrInvalidHash
+	}
+
+	return err
+}
+
+// Verify checks that the block's version is supported, that its merkle root
+// matches its records and that its hash and nonce match its header.
+func (b *Block) Verify() error {
+	return b.VerifyWith(pow.SHA256)
+}
+
+// VerifyWith checks the block as Verify, for a block mined with the given hash
+// algorithm.
+func (b *Block) VerifyWith(algorithm pow.Algorithm) error {
+	return b.VerifyWithProof(algorithm, newMiner(0, algorithm))
+}
+
+// VerifyWithProof checks the block as Verify, for a block hashed with the given
+// hash algorithm and mined with the given Proof of Work.
+func (b *Block) VerifyWithProof(algorithm pow.Algorithm, proof pow.ProofOfWork) error {
+	if b.Version != BlockVersion {
+		return ErrUnsupportedVersion
+	}
+	if b.MerkleRoot != MerkleRootWith(algorithm, b.Records) {
+		return ErrInvalidMerkleRoot
+	}
+	return b.verifyProofOfWork(algorithm, proof)
+}
+
+// Serialize converts a block in an slice of bytes using the canonical binary
+// encoding. ErrInvalidEncoding is returned if a field is too large for it.
 func (b *Block) Serialize() ([]byte, error) {
-	buffer := new(bytes.Buffer)
-	serializer := gob.NewEncoder(buffer)
-	err := serializer.Encode(b)
+	return encodeBlock(b)
+}
+
+// Deserialize converts an slice of bytes in a block. Both the canonical binary
+// encoding and the legacy gob encoding are supported, except for the blocks of
+// the first version, which return ErrLegacyBlock.
+func (b *Block) Deserialize(data []byte) error {
+	block, err := decodeBlock(data)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return buffer.Bytes(), nil
+	*b = *block
+	return nil
 }
 
-// Deserialize converts an slice of bytes in a block. Implemented using the gob
-// library.
-func (b *Block) Deserialize(data []byte) error {
-	buffer := bytes.NewBuffer(data)
-	serializer := gob.NewDecoder(buffer)
-	err := serializer.Decode(b)
+// SerializeWith converts a block in an slice of bytes using the given codec,
+// for instance ProtoCodec instead of the canonical binary encoding.
+func (b *Block) SerializeWith(codec Codec) ([]byte, error) {
+	return codec.Encode(b)
+}
+
+// DeserializeWith converts an slice of bytes in a block using the given codec.
+func (b *Block) DeserializeWith(codec Codec, data []byte) error {
+	block, err := codec.Decode(data)
 	if err != nil {
 		return err
 	}
+	*b = *block
 	return nil
 }
 
@@ -2,10 +2,36 @@ package blockchain
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
 
+// genesisHeader returns the header of a Genesis block created at a fixed time.
+func genesisHeader() BlockHeader {
+	return BlockHeader{
+		Version:    BlockVersion,
+		Height:     0,
+		Timestamp:  1641168000000000000,
+		PrevHash:   "",
+		MerkleRoot: "97d4f9be38d0355651dbce267f9d8c023b02106db22f9e8c9302ada10aa1b9f2",
+		Difficulty: 16,
+	}
+}
+
+// testingHeader returns the header of a block following the Genesis block
+// created at a fixed time.
+func testingHeader() BlockHeader {
+	return BlockHeader{
+		Version:    BlockVersion,
+		Height:     1,
+		Timestamp:  1641168060000000000,
+		PrevHash:   "00005985b00e566bd5679ee10741ffa3c4cd50cbad545cb8d00c90537bc8498c",
+		MerkleRoot: "a2ba99ab120e5f1a08f243d8b4f568bd0a27c6ba2520a2bd239040be9722826c",
+		Difficulty: 16,
+	}
+}
+
 // TestComputeHash tests the resulting hash for a single block.
 func TestComputeHash(t *testing.T) {
 	var tests = []struct {
@@ -14,17 +40,17 @@ func TestComputeHash(t *testing.T) {
 	}{
 		{
 			block: Block{
-				Data:     []byte("Genesis"),
-				PrevHash: "",
+				BlockHeader: genesisHeader(),
+				Records:     [][]byte{[]byte("Genesis")},
 			},
-			hash: "81ddc8d248b2dccdd3fdd5e84f0cad62b08f2d10b57f9a831c13451e5c5c80a5",
+			hash: "9c4ef6547b1d42883e954be60cebfc7417c120080f697f763a806ce8c6c48170",
 		},
 		{
 			block: Block{
-				Data:     []byte("this is a testing block"),
-				PrevHash: "81ddc8d248b2dccdd3fdd5e84f0cad62b08f2d10b57f9a831c13451e5c5c80a5",
+				BlockHeader: testingHeader(),
+				Records:     [][]byte{[]byte("this is a testing block")},
 			},
-			hash: "5546e8962b45ef7d89ec93e54162bca55129914c1766d2fb0c74492f1f9ec776",
+			hash: "444f2bc31f8b481c257f8105f81b39871498d9421c37d6c29832c3a6c5b0ee86",
 		},
 	}
 
@@ -34,32 +60,181 @@ func TestComputeHash(t *testing.T) {
 	}
 }
 
+// TestMine tests the nonce and the hash of a mined block.
+func TestMine(t *testing.T) {
+	var tests = []struct {
+		block Block
+		hash  string
+		nonce int32
+	}{
+		{
+			block: Block{
+				BlockHeader: genesisHeader(),
+				Records:     [][]byte{[]byte("Genesis")},
+			},
+			hash:  "00005985b00e566bd5679ee10741ffa3c4cd50cbad545cb8d00c90537bc8498c",
+			nonce: 202126,
+		},
+		{
+			block: Block{
+				BlockHeader: testingHeader(),
+				Records:     [][]byte{[]byte("this is a testing block")},
+			},
+			hash:  "00000f1abeed85431450843b901702ab28a10fa212110b54c688a7a9a9160bfb",
+			nonce: 11432,
+		},
+	}
+
+	for _, test := range tests {
+		test.block.ComputeHash()
+		err := test.block.Mine()
+		require.NoError(t, err)
+		require.Equal(t, test.hash, test.block.Hash)
+		require.Equal(t, test.nonce, test.block.Nonce)
+	}
+}
+
 // TestNewBlock tests the creation of a new block.
 func TestNewBlock(t *testing.T) {
+	before := time.Now().UnixNano()
+	records := [][]byte{[]byte("this is a testing block")}
+	genesis := NewBlock([][]byte{[]byte("Genesis")}, nil, 16)
+	block := NewBlock(records, genesis, 16)
+	sameBlock := NewBlock(records, genesis, 16)
+
+	// The header is filled from the data and the parent block
+	require.Equal(t, BlockVersion, block.Version)
+	require.Equal(t, uint64(1), block.Height)
+	require.GreaterOrEqual(t, block.Timestamp, before)
+	require.Equal(t, genesis.Hash, block.PrevHash)
+	require.Equal(t, testingHeader().MerkleRoot, block.MerkleRoot)
+	require.Equal(t, uint(16), block.Difficulty)
+	require.NoError(t, block.Verify())
+
+	// Blocks created at different times have different hashes
+	require.NotEqual(t, block.Timestamp, sameBlock.Timestamp)
+	require.NotEqual(t, block.Hash, sameBlock.Hash)
+}
+
+// TestVerifyProofOfWork tests the verification of the nonce and hash of a block.
+func TestVerifyProofOfWork(t *testing.T) {
+	// withHeader returns the testing header modified by the given function.
+	withHeader := func(modify func(header *BlockHeader)) BlockHeader {
+		header := testingHeader()
+		modify(&header)
+		return header
+	}
+
 	var tests = []struct {
 		block Block
+		err   error
 	}{
 		{
 			block: Block{
-				Data:     []byte("Genesis"),
-				Hash:     "0000f5adf42baf5174fc801e930ab3d020b5d00218657e66df8f23419da9c3c1",
-				PrevHash: "",
-				Nonce:    205317,
+				BlockHeader: withHeader(func(header *BlockHeader) {
+					header.Nonce = 11432
+				}),
+				Hash: "00000f1abeed85431450843b901702ab28a10fa212110b54c688a7a9a9160bfb",
 			},
+			err: nil,
 		},
 		{
 			block: Block{
-				Data:     []byte("this is a testing block"),
-				Hash:     "00005bfbe5cfb03a5d9e729d884700ebaa1cf825d9be9790636d991d03b51e18",
-				PrevHash: "0000f5adf42baf5174fc801e930ab3d020b5d00218657e66df8f23419da9c3c1",
-				Nonce:    107902,
+				BlockHeader: withHeader(func(header *BlockHeader) {
+					header.Nonce = 11433
+				}),
+				Hash: "00000f1abeed85431450843b901702ab28a10fa212110b54c688a7a9a9160bfb",
+			},
+			err: ErrInvalidNonce,
+		},
+		{
+			block: Block{
+				BlockHeader: withHeader(func(header *BlockHeader) {
+					header.Nonce = 11432
+					header.Timestamp++
+				}),
+				Hash: "00000f1abeed85431450843b901702ab28a10fa212110b54c688a7a9a9160bfb",
+			},
+			err: ErrInvalidNonce,
+		},
+		{
+			block: Block{
+				BlockHeader: withHeader(func(header *BlockHeader) {
+					header.Nonce = 11432
+				}),
+				Hash: "00000f1abeed85431450843b901702ab28a10fa212110b54c688a7a9a9160bfc",
+			},
+			err: ErrInvalidHash,
+		},
+		{
+			block: Block{
+				BlockHeader: withHeader(func(header *BlockHeader) {
+					header.Nonce = 11432
+				}),
+				Hash: "not an hexadecimal hash",
+			},
+			err: ErrInvalidHash,
+		},
+		{
+			block: Block{
+				BlockHeader: withHeader(func(header *BlockHeader) {
+					header.Nonce = 11432
+				}),
+				Hash: "00000F1ABEED85431450843B901702AB28A10FA212110B54C688A7A9A9160BFB",
+			},
+			err: ErrInvalidHash,
+		},
+		{
+			block: Block{
+				BlockHeader: withHeader(func(header *BlockHeader) {
+					header.Nonce = 11432
+					header.Difficulty = 0
+				}),
+				Hash: "00000f1abeed85431450843b901702ab28a10fa212110b54c688a7a9a9160bfb",
+			},
+			err: ErrInvalidDifficulty,
+		},
+	}
+
+	for _, test := range tests {
+		err := test.block.VerifyProofOfWork()
+		require.Equal(t, test.err, err)
+	}
+}
+
+// TestVerify tests the verification of the version and records of a block.
+func TestVerify(t *testing.T) {
+	var tests = []struct {
+		modify func(block *Block)
+		err    error
+	}{
+		{
+			modify: func(block *Block) {},
+			err:    nil,
+		},
+		{
+			modify: func(block *Block) {
+				block.Version = BlockVersion + 1
+			},
+			err: ErrUnsupportedVersion,
+		},
+		{
+			modify: func(block *Block) {
+				block.Records[0] = []byte("this is a tampered block")
 			},
+			err: ErrInvalidMerkleRoot,
 		},
 	}
 
 	for _, test := range tests {
-		block := NewBlock(test.block.Data, test.block.PrevHash)
-		require.Equal(t, test.block, *block)
+		block := Block{
+			BlockHeader: testingHeader(),
+			Hash:        "00000f1abeed85431450843b901702ab28a10fa212110b54c688a7a9a9160bfb",
+			Records:     [][]byte{[]byte("this is a testing block")},
+		}
+		block.Nonce = 11432
+		test.modify(&block)
+		require.Equal(t, test.err, block.Verify())
 	}
 }
 
@@ -70,10 +245,9 @@ func TestBlockSerialization(t *testing.T) {
 	}{
 		{
 			block: Block{
-				Data:     []byte("Genesis"),
-				Hash:     "81ddc8d248b2dccdd3fdd5e84f0cad62b08f2d10b57f9a831c13451e5c5c80a5",
-				PrevHash: "",
-				Nonce:    668,
+				BlockHeader: genesisHeader(),
+				Hash:        "00005985b00e566bd5679ee10741ffa3c4cd50cbad545cb8d00c90537bc8498c",
+				Records:     [][]byte{[]byte("Genesis")},
 			},
 		},
 	}
@@ -1,25 +1,62 @@
 package blockchain
 
 import (
-	"bytes"
+	"context"
+	"encoding/binary"
 	"errors"
+	"math/big"
 	"os"
+	"strconv"
 	"sync"
 
 	badger "github.com/dgraph-io/badger/v3"
+	"github.com/dgraph-io/badger/v3/options"
+	"github.com/samuelvl/blockchain-lab/pkg/pow"
 )
 
 // ErrBlockNotFound error when a block is not found.
 var ErrBlockNotFound = errors.New("blockchain: block not found")
 
+// ErrInvalidCodec error when the codec of a chain does not match the one used
+// to store its blocks.
+var ErrInvalidCodec = errors.New("blockchain: codec does not match the stored one")
+
+// ErrInvalidHashAlgorithm error when the hash algorithm of a chain does not
+// match the one used to mine its blocks.
+var ErrInvalidHashAlgorithm = errors.New("blockchain: hash algorithm does not match the stored one")
+
+// ErrProofOfWorkMismatch error when the Proof of Work of a chain does not match
+// the one used to mine its blocks.
+var ErrProofOfWorkMismatch = errors.New("blockchain: proof of work does not match the stored one")
+
+// ErrRetargetMismatch error when the retarget algorithm of a chain does not
+// match the one used to adjust the difficulty of its blocks.
+var ErrRetargetMismatch = errors.New("blockchain: retarget does not match the stored one")
+
+// ErrChainClosed error when a chain is used after it has been closed.
+var ErrChainClosed = errors.New("blockchain: chain is closed")
+
+// ErrInvalidBadgerOptions error when the options of a Badger database cannot be
+// used together.
+var ErrInvalidBadgerOptions = errors.New("blockchain: invalid badger options")
+
 // Chain is the interface to be implemented by a blockchain backend.
 type Chain interface {
-	AddBlock(data []byte) (*Block, error)
+	AddBlock(records ...[]byte) (*Block, error)
+	AddBlockContext(ctx context.Context, records ...[]byte) (*Block, error)
 	GetBlock(hash string) (*Block, error)
+	GetBlockByHeight(height uint64) (*Block, error)
 	GetLastBlock() (*Block, error)
+	GetWork(hash string) (*big.Int, error)
+	HashAlgorithm() pow.Algorithm
+	ImportBlock(block *Block) (*Reorg, error)
+	ProofOfWork() pow.ProofOfWork
+	RollbackTo(height uint64) ([]*Block, error)
+	Close() error
 	Destroy() error
 	Length() uint64
 	NewIterator() (*ChainIterator, error)
+	Verify() error
 }
 
 // ChainIterator can be used to iterate through the blockchain using the Next()
@@ -30,28 +67,65 @@ type ChainIterator struct {
 }
 
 // SliceChain will use an slice of blocks as the blockchain backend.
+//
+// The slice only stores the canonical chain, the blocks of the competing
+// branches are kept by their hash in the branches map. The cumulative work of
+// every block is cached in the work map.
 type SliceChain struct {
-	Blocks []*Block
+	Blocks   []*Block
+	branches map[string]*Block
+	work     map[string]*big.Int
+	config   *chainConfig
+	closed   bool
 	sync.Mutex
 }
 
 // NewSliceChain initializes a blockchain to store blocks in an slice of blocks.
 // It will add the Genesis block as the first block of the chain.
-func NewSliceChain() (*SliceChain, error) {
+func NewSliceChain(opts ...ChainOption) (*SliceChain, error) {
+	// Apply the chain options
+	config, err := newChainConfig(opts...)
+	if err != nil {
+		return nil, err
+	}
+
 	chain := SliceChain{
-		Blocks: []*Block{FirstBlock()},
+		Blocks:   []*Block{config.firstBlock()},
+		branches: map[string]*Block{},
+		work:     map[string]*big.Int{},
+		config:   config,
 	}
 	return &chain, nil
 }
 
-// AddBlock adds a new block to the chain from the input data.
-func (chain *SliceChain) AddBlock(data []byte) (*Block, error) {
+// AddBlock adds a new block to the chain from the input records.
+func (chain *SliceChain) AddBlock(records ...[]byte) (*Block, error) {
+	return chain.AddBlockContext(context.Background(), records...)
+}
+
+// AddBlockContext adds a new block to the chain from the input records. If the
+// context is done before the block is mined, pow.ErrMiningCanceled is returned
+// and the chain is left unchanged.
+func (chain *SliceChain) AddBlockContext(ctx context.Context, records ...[]byte) (*Block, error) {
 	// Avoid race conditions while adding new blocks
 	chain.Lock()
 	defer chain.Unlock()
+	if chain.closed {
+		return nil, ErrChainClosed
+	}
 
+	// Compute the difficulty of the new block from its ancestors
 	prevBlock := chain.Blocks[len(chain.Blocks)-1]
-	newBlock := NewBlock(data, prevBlock.Hash)
+	difficulty, err := chain.config.nextDifficulty(prevBlock, chain.getBlock)
+	if err != nil {
+		return nil, err
+	}
+
+	newBlock, err := NewBlockWithProof(ctx, chain.config.algorithm,
+		chain.config.proof, records, prevBlock, difficulty)
+	if err != nil {
+		return nil, err
+	}
 	chain.Blocks = append(chain.Blocks, newBlock)
 
 	return newBlock, nil
@@ -63,7 +137,16 @@ func (chain *SliceChain) GetBlock(hash string) (*Block, error) {
 	// Avoid race conditions while iterating blocks
 	chain.Lock()
 	defer chain.Unlock()
+	if chain.closed {
+		return nil, ErrChainClosed
+	}
+
+	return chain.getBlock(hash)
+}
 
+// getBlock finds and returns a block from its hash without locking the chain.
+// The block may be part of the canonical chain or of a competing branch.
+func (chain *SliceChain) getBlock(hash string) (*Block, error) {
 	// Iterate the slice of blocks and return the block matching the hash
 	for _, block := range chain.Blocks {
 		if hash == block.Hash {
@@ -71,14 +154,41 @@ func (chain *SliceChain) GetBlock(hash string) (*Block, error) {
 		}
 	}
 
+	// Look for the block in the competing branches
+	block, ok := chain.branches[hash]
+	if ok {
+		return block, nil
+	}
+
 	return nil, ErrBlockNotFound
 }
 
+// GetBlockByHeight finds and returns a block from its height. If block is not
+// found, ErrBlockNotFound is returned.
+func (chain *SliceChain) GetBlockByHeight(height uint64) (*Block, error) {
+	// Avoid race conditions while iterating blocks
+	chain.Lock()
+	defer chain.Unlock()
+	if chain.closed {
+		return nil, ErrChainClosed
+	}
+
+	// The height of a block is its position in the slice
+	if height >= uint64(len(chain.Blocks)) {
+		return nil, ErrBlockNotFound
+	}
+
+	return chain.Blocks[height], nil
+}
+
 // GetLastBlock returns the last block of the chain.
 func (chain *SliceChain) GetLastBlock() (*Block, error) {
 	// Avoid race conditions while iterating blocks
 	chain.Lock()
 	defer chain.Unlock()
+	if chain.closed {
+		return nil, ErrChainClosed
+	}
 
 	// The last block is in the last position of the slice
 	lastBlock := chain.Blocks[len(chain.Blocks)-1]
@@ -86,6 +196,191 @@ func (chain *SliceChain) GetLastBlock() (*Block, error) {
 	return lastBlock, nil
 }
 
+// GetWork returns the cumulative work of the chain ending in the block with
+// the given hash. If block is not found, ErrBlockNotFound is returned.
+func (chain *SliceChain) GetWork(hash string) (*big.Int, error) {
+	// Avoid race conditions while iterating blocks
+	chain.Lock()
+	defer chain.Unlock()
+	if chain.closed {
+		return nil, ErrChainClosed
+	}
+
+	work, err := chain.getWork(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	return new(big.Int).Set(work), nil
+}
+
+// getWork returns the cumulative work of a block without locking the chain.
+// The work is computed from the block's ancestors the first time and cached.
+func (chain *SliceChain) getWork(hash string) (*big.Int, error) {
+	work, ok := chain.work[hash]
+	if ok {
+		return work, nil
+	}
+
+	block, err := chain.getBlock(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	// Add the work of the block to the work of its parent
+	work = blockWork(block.Difficulty)
+	if block.PrevHash != "" {
+		parentWork, err := chain.getWork(block.PrevHash)
+		if err != nil {
+			return nil, err
+		}
+		work.Add(work, parentWork)
+	}
+	chain.work[hash] = work
+
+	return work, nil
+}
+
+// ImportBlock adds a block mined outside the chain on top of any known block.
+// If the branch of the new block has more cumulative work than the canonical
+// chain, it becomes the canonical chain and the reorganization is returned.
+//
+// The block is validated before storing it. ErrDuplicateBlock is returned if
+// the block is already in the chain, ErrUnknownParent if its parent is not,
+// and ErrInvalidProofOfWork if its hash or nonce are not valid.
+func (chain *SliceChain) ImportBlock(block *Block) (*Reorg, error) {
+	// Avoid race conditions while adding new blocks
+	chain.Lock()
+	defer chain.Unlock()
+	if chain.closed {
+		return nil, ErrChainClosed
+	}
+
+	_, err := chain.getBlock(block.Hash)
+	if err == nil {
+		return nil, ErrDuplicateBlock
+	}
+
+	// The block must be a valid child of a known block
+	parent, err := chain.getBlock(block.PrevHash)
+	if err != nil {
+		return nil, ErrUnknownParent
+	}
+	err = checkImport(block, parent, chain.config, chain.getBlock)
+	if err != nil {
+		return nil, err
+	}
+	chain.branches[block.Hash] = block
+
+	// Keep the canonical chain unless the new branch is heavier
+	work, err := chain.getWork(block.Hash)
+	if err != nil {
+		return nil, err
+	}
+	oldTip := chain.Blocks[len(chain.Blocks)-1]
+	tipWork, err := chain.getWork(oldTip.Hash)
+	if err != nil {
+		return nil, err
+	}
+	if work.Cmp(tipWork) <= 0 {
+		return nil, nil
+	}
+
+	// Walk back the new branch until the canonical chain is reached
+	added := []*Block{}
+	fork := block
+	for fork.Height >= uint64(len(chain.Blocks)) ||
+		chain.Blocks[fork.Height].Hash != fork.Hash {
+		added = append([]*Block{fork}, added...)
+		fork, err = chain.getBlock(fork.PrevHash)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Move the blocks above the fork to the branches and replace them
+	removed := append([]*Block{}, chain.Blocks[fork.Height+1:]...)
+	for _, removedBlock := range removed {
+		chain.branches[removedBlock.Hash] = removedBlock
+	}
+	for _, addedBlock := range added {
+		delete(chain.branches, addedBlock.Hash)
+	}
+	chain.Blocks = append(chain.Blocks[:fork.Height+1], added...)
+
+	// Extending the canonical chain is not a reorganization
+	if len(removed) == 0 {
+		return nil, nil
+	}
+
+	reorg := Reorg{
+		Fork:    fork,
+		OldTip:  oldTip,
+		NewTip:  block,
+		Removed: removed,
+		Added:   added,
+	}
+	return &reorg, nil
+}
+
+// RollbackTo removes the blocks above the given height, so the block at that
+// height becomes the last block. The removed blocks of the canonical chain are
+// returned sorted by height. The blocks of the competing branches above the
+// height are discarded too.
+func (chain *SliceChain) RollbackTo(height uint64) ([]*Block, error) {
+	return chain.rollbackTo(height, "")
+}
+
+// rollbackTo removes the blocks above the height as RollbackTo. If the hash is
+// not empty, it must be the hash of the canonical block at that height when
+// the chain is locked, otherwise ErrBlockNotFound is returned.
+func (chain *SliceChain) rollbackTo(height uint64, hash string) ([]*Block, error) {
+	// Avoid race conditions while removing blocks
+	chain.Lock()
+	defer chain.Unlock()
+	if chain.closed {
+		return nil, ErrChainClosed
+	}
+
+	// The block must be the canonical one at the height
+	if hash != "" && (height >= uint64(len(chain.Blocks)) ||
+		chain.Blocks[height].Hash != hash) {
+		return nil, ErrBlockNotFound
+	}
+
+	// Nothing to remove above the last block
+	if height >= uint64(len(chain.Blocks)) {
+		return []*Block{}, nil
+	}
+
+	removed := append([]*Block{}, chain.Blocks[height+1:]...)
+	chain.Blocks = chain.Blocks[:height+1]
+	for _, block := range removed {
+		delete(chain.work, block.Hash)
+	}
+	for hash, block := range chain.branches {
+		if block.Height > height {
+			delete(chain.branches, hash)
+			delete(chain.work, hash)
+		}
+	}
+
+	return removed, nil
+}
+
+// Close closes the chain without removing its blocks. There are no resources to
+// release, but the chain can no longer be used and ErrChainClosed is returned
+// by its methods. Blocks being added finish before the chain is closed.
+func (chain *SliceChain) Close() error {
+	// Wait for the blocks being added
+	chain.Lock()
+	defer chain.Unlock()
+
+	chain.closed = true
+
+	return nil
+}
+
 // Destroy removes all the blocks from the chain.
 func (chain *SliceChain) Destroy() error {
 	// Avoid race conditions while iterating blocks
@@ -94,15 +389,32 @@ func (chain *SliceChain) Destroy() error {
 
 	// The last block is in the last position of the slice
 	chain.Blocks = []*Block{}
+	chain.branches = map[string]*Block{}
+	chain.work = map[string]*big.Int{}
 
 	return nil
 }
 
-// Length returns the total size of the blockchain.
+// HashAlgorithm returns the hash algorithm used to mine the blocks of the
+// chain.
+func (chain *SliceChain) HashAlgorithm() pow.Algorithm {
+	return chain.config.algorithm
+}
+
+// ProofOfWork returns the Proof of Work used to mine the blocks of the chain.
+func (chain *SliceChain) ProofOfWork() pow.ProofOfWork {
+	return chain.config.proof
+}
+
+// Length returns the total size of the blockchain. It is 0 once the chain is
+// closed.
 func (chain *SliceChain) Length() uint64 {
 	// Avoid race conditions while iterating blocks
 	chain.Lock()
 	defer chain.Unlock()
+	if chain.closed {
+		return 0
+	}
 
 	// Count the number of elements
 	size := uint64(len(chain.Blocks))
@@ -123,19 +435,102 @@ func (chain *SliceChain) NewIterator() (*ChainIterator, error) {
 	return &iterator, nil
 }
 
+// Verify checks the integrity of the whole chain, from the last block to the
+// Genesis block. It returns a VerificationError with every invalid block found.
+func (chain *SliceChain) Verify() error {
+	return verifyChain(chain, chain.config)
+}
+
 // BadgerChain will use a Badger database as the blockchain backend. Badger
 // documentation: https://dgraph.io/docs/badger
+//
+// Blocks are stored by their hash. The height index maps the height of every
+// block to its hash, using the height prefix followed by the height in
+// big-endian order as the key. The number of blocks is stored in the length
+// key, so it does not have to be counted.
+//
+// Only the blocks of the canonical chain are indexed by height, the blocks of
+// the competing branches are only stored by their hash. The cumulative work of
+// every block is stored using the work prefix followed by the block's hash as
+// the key. Every block, canonical or not, is also listed by its height using
+// the block prefix followed by the height in big-endian order and the hash as
+// the key, so the blocks above a height are found without reading them all.
 type BadgerChain struct {
-	db           *badger.DB
-	lastBlockKey []byte
+	db            *badger.DB
+	config        *chainConfig
+	lastBlockKey  []byte
+	difficultyKey []byte
+	codecKey      []byte
+	algorithmKey  []byte
+	proofKey      []byte
+	retargetKey   []byte
+	lengthKey     []byte
+	heightPrefix  []byte
+	workPrefix    []byte
+	blockPrefix   []byte
+
+	// Background garbage collection of the value log
+	gcMutex   sync.Mutex
+	gcStats   GCStats
+	gcStop    chan struct{}
+	gcDone    chan struct{}
+	gcStopped sync.Once
+
+	// The blocks are written one at a time, so the transactions never conflict
+	writeMutex sync.Mutex
+
+	// The database is closed once it is no longer used. The blocks being mined
+	// are canceled when the chain is closing.
+	closeMutex sync.RWMutex
+	closed     bool
+	closing    chan struct{}
+	closeOnce  sync.Once
 }
 
 // NewBadgerChain initializes a blockchain to store blocks in a Badger database.
-// It will add the Genesis block as the first block of the chain.
-func NewBadgerChain(dir string) (*BadgerChain, error) {
+// It will add the Genesis block as the first block of the chain. If the
+// database is already initialized, its difficulty must match the configured
+// one or ErrInvalidDifficulty is returned, its codec must match the configured
+// one or ErrInvalidCodec is returned, its hash algorithm must match the
+// configured one or ErrInvalidHashAlgorithm is returned, its Proof of Work must
+// match the configured one or ErrProofOfWorkMismatch is returned, and its
+// retarget algorithm must match the configured one or ErrRetargetMismatch is
+// returned.
+//
+// The database uses the default Badger options with the logger disabled. They
+// can be tuned with WithInMemory, WithSyncWrites, WithValueLogFileSize,
+// WithValueThreshold, WithCompression, WithEncryptionKey, WithCacheSizes and
+// WithLogger. The database is garbage collected in the background as set by
+// WithGCInterval and WithGCDiscardRatio.
+func NewBadgerChain(dir string, opts ...ChainOption) (*BadgerChain, error) {
+	// Apply the chain options
+	chainConfig, err := newChainConfig(opts...)
+	if err != nil {
+		return nil, err
+	}
+
 	// Create a new badger instance
 	config := badger.DefaultOptions(dir)
 	config.Logger = nil
+	for _, change := range chainConfig.badgerOptions {
+		config = change(config)
+	}
+
+	// Badger panics if compression or encryption are used without cache
+	encrypted := len(config.EncryptionKey) > 0
+	if (config.Compression != options.None || encrypted) &&
+		config.BlockCacheSize == 0 {
+		return nil, ErrInvalidBadgerOptions
+	}
+	if encrypted && config.IndexCacheSize == 0 {
+		return nil, ErrInvalidBadgerOptions
+	}
+
+	// Badger only rewrites value log files with a discard ratio in (0, 1)
+	if chainConfig.gcDiscardRatio <= 0 || chainConfig.gcDiscardRatio >= 1 {
+		return nil, ErrInvalidBadgerOptions
+	}
+
 	database, err := badger.Open(config)
 	if err != nil {
 		return nil, err
@@ -143,183 +538,1256 @@ func NewBadgerChain(dir string) (*BadgerChain, error) {
 
 	// Configure the Badger database as the blockchain backend
 	chain := BadgerChain{
-		db:           database,
-		lastBlockKey: []byte("lastBlock"),
+		db:            database,
+		config:        chainConfig,
+		lastBlockKey:  []byte("lastBlock"),
+		difficultyKey: []byte("difficulty"),
+		codecKey:      []byte("codec"),
+		algorithmKey:  []byte("hashAlgorithm"),
+		proofKey:      []byte("proofOfWork"),
+		retargetKey:   []byte("retarget"),
+		lengthKey:     []byte("length"),
+		heightPrefix:  []byte("height-"),
+		workPrefix:    []byte("work-"),
+		blockPrefix:   []byte("block-"),
+		closing:       make(chan struct{}),
+	}
+
+	// Initialize the database and release it if it cannot be used
+	err = chain.init()
+	if err != nil {
+		database.Close()
+		return nil, err
 	}
+	chain.startGC()
 
-	// If the database is not initialized yet, create the Genesis block as the
-	// first block
+	return &chain, nil
+}
+
+// init creates the Genesis block as the first block if the database is not
+// initialized yet. Otherwise, it checks that the stored difficulty, codec and
+// Genesis block match the chain's ones and that the height index, the length
+// and the work exist.
+func (chain *BadgerChain) init() error {
 	txn := chain.db.NewTransaction(true)
 	defer txn.Discard()
 
-	_, err = txn.Get(chain.lastBlockKey)
-	if err == badger.ErrKeyNotFound {
-		// Create the Genesis block
-		firstBlock := FirstBlock()
-		firstBlockBytes, err := firstBlock.Serialize()
+	_, err := txn.Get(chain.lastBlockKey)
+	if err == nil {
+		err = chain.checkDifficulty(txn)
 		if err != nil {
-			return nil, err
+			return err
 		}
-
-		// Add the Genesis block to the chain
-		err = txn.SetEntry(
-			badger.NewEntry([]byte(firstBlock.Hash), firstBlockBytes))
+		err = chain.checkCodec(txn)
 		if err != nil {
-			return nil, err
+			return err
 		}
-
-		// Update the last block key with the Genesis block
-		err = txn.SetEntry(
-			badger.NewEntry(chain.lastBlockKey, firstBlockBytes))
+		err = chain.checkAlgorithm(txn)
 		if err != nil {
-			return nil, err
+			return err
+		}
+		err = chain.checkProofOfWork(txn)
+		if err != nil {
+			return err
+		}
+		err = chain.checkRetarget(txn)
+		if err != nil {
+			return err
 		}
-
-		// Commit the transaction and check for error
 		err = txn.Commit()
 		if err != nil {
-			return nil, err
+			return err
+		}
+		err = chain.indexHeights()
+		if err != nil {
+			return err
+		}
+		err = chain.repairLength()
+		if err != nil {
+			return err
+		}
+		err = chain.indexWork()
+		if err != nil {
+			return err
+		}
+		err = chain.indexBlocks()
+		if err != nil {
+			return err
 		}
+		return chain.checkGenesis()
 	}
-
-	return &chain, nil
-}
-
-// AddBlock adds a new block to the chain from the input data.
-func (chain *BadgerChain) AddBlock(data []byte) (*Block, error) {
-	// Create a new read-write badger transaction
-	txn := chain.db.NewTransaction(true)
-	defer txn.Discard()
-
-	// Get the previous block from the last block key
-	var prevBlock Block
-	prevBlockBytes, err := txn.Get(chain.lastBlockKey)
-	if err != nil {
-		return nil, err
+	if err != badger.ErrKeyNotFound {
+		return err
 	}
 
-	prevBlockRaw, err := prevBlockBytes.ValueCopy(nil)
+	// Create the Genesis block
+	firstBlock := chain.config.firstBlock()
+	firstBlockBytes, err := chain.config.codec.Encode(firstBlock)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	err = prevBlock.Deserialize(prevBlockRaw)
+	// Add the Genesis block to the chain
+	err = txn.SetEntry(
+		badger.NewEntry([]byte(firstBlock.Hash), firstBlockBytes))
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	// Create the new block from the previous block hash
-	var block *Block
-	block = NewBlock(data, prevBlock.Hash)
-	blockBytes, err := block.Serialize()
+	// Update the last block key with the Genesis block
+	err = txn.SetEntry(
+		badger.NewEntry(chain.lastBlockKey, firstBlockBytes))
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	// Add the new block to the database
-	err = txn.SetEntry(badger.NewEntry([]byte(block.Hash), blockBytes))
+	// Index the Genesis block by its height
+	err = txn.SetEntry(badger.NewEntry(
+		chain.heightKey(firstBlock.Height), []byte(firstBlock.Hash)))
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	// Update the last block key
-	err = txn.SetEntry(badger.NewEntry(chain.lastBlockKey, blockBytes))
+	// Store the difficulty used to mine the blocks of the chain
+	difficulty := strconv.FormatUint(uint64(chain.config.difficulty), 10)
+	err = txn.SetEntry(
+		badger.NewEntry(chain.difficultyKey, []byte(difficulty)))
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	// Commit the transaction and check for error
-	err = txn.Commit()
+	// Store the codec used to encode the blocks
+	err = txn.SetEntry(badger.NewEntry(
+		chain.codecKey, []byte(chain.config.codec.Name())))
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return block, nil
-}
-
-// GetBlock finds and returns a block from its hash. If block is not found,
-// ErrBlockNotFound is returned.
-func (chain *BadgerChain) GetBlock(hash string) (*Block, error) {
-	// Create a new read-only badger transaction
-	txn := chain.db.NewTransaction(false)
-	defer txn.Discard()
-
-	// Find the block in the database
-	var block Block
-	blockBytes, err := txn.Get([]byte(hash))
+	// Store the hash algorithm used to mine the blocks
+	err = txn.SetEntry(badger.NewEntry(
+		chain.algorithmKey, []byte(chain.config.algorithm.String())))
 	if err != nil {
-		return nil, ErrBlockNotFound
+		return err
 	}
 
-	blockRaw, err := blockBytes.ValueCopy(nil)
+	// Store the Proof of Work used to mine the blocks
+	err = txn.SetEntry(badger.NewEntry(
+		chain.proofKey, []byte(chain.config.proof.Name())))
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	err = block.Deserialize(blockRaw)
+	// Store the retarget algorithm used to adjust the difficulty
+	err = txn.SetEntry(badger.NewEntry(
+		chain.retargetKey, []byte(chain.config.retargetName())))
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return &block, nil
-}
-
-// GetLastBlock returns the last block of the chain.
-func (chain *BadgerChain) GetLastBlock() (*Block, error) {
-	lastBlock, err := chain.GetBlock(string(chain.lastBlockKey))
+	// The chain only has the Genesis block
+	err = chain.setLength(txn, 1)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return lastBlock, nil
-}
-
-// Destroy removes all the blocks from the chain.
-func (chain *BadgerChain) Destroy() error {
-	err := chain.db.DropAll()
+	err = chain.setWork(txn, firstBlock.Hash, blockWork(firstBlock.Difficulty))
 	if err != nil {
 		return err
 	}
-	err = chain.db.Close()
+	err = chain.indexBlock(txn, firstBlock)
 	if err != nil {
 		return err
 	}
-	err = os.RemoveAll(chain.db.Opts().Dir)
-	return err
+
+	// Commit the transaction and check for error
+	return txn.Commit()
 }
 
-// NewIterator initializes the blockchain iterator from the last block.
-func (chain *BadgerChain) NewIterator() (*ChainIterator, error) {
-	lastBlock, err := chain.GetLastBlock()
-	if err != nil {
-		return nil, err
+// checkDifficulty compares the difficulty stored in the database with the
+// chain's difficulty. Databases created before the difficulty was stored were
+// mined with the default difficulty.
+func (chain *BadgerChain) checkDifficulty(txn *badger.Txn) error {
+	difficulty := uint64(DefaultDifficulty)
+	difficultyItem, err := txn.Get(chain.difficultyKey)
+	switch err {
+	case nil:
+		difficultyRaw, err := difficultyItem.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		difficulty, err = strconv.ParseUint(string(difficultyRaw), 10, 0)
+		if err != nil {
+			return err
+		}
+	case badger.ErrKeyNotFound:
+	default:
+		return err
 	}
-	iterator := ChainIterator{
-		currentHash: lastBlock.Hash,
-		chain:       chain,
+
+	if uint(difficulty) != chain.config.difficulty {
+		return ErrInvalidDifficulty
 	}
-	return &iterator, nil
+
+	return nil
 }
 
-// Length returns the total size of the blockchain.
-func (chain *BadgerChain) Length() uint64 {
-	// Create a new read-only badger transaction
-	txn := chain.db.NewTransaction(false)
-	defer txn.Discard()
+// checkCodec compares the codec stored in the database with the chain's codec.
+// Databases created before the codec was stored use the binary codec, which
+// decodes the legacy gob encoding too; the codec is stored for them.
+func (chain *BadgerChain) checkCodec(txn *badger.Txn) error {
+	return chain.checkMetadata(txn, chain.codecKey,
+		chain.config.codec.Name(), (BinaryCodec{}).Name(), ErrInvalidCodec)
+}
 
-	// Use the Badger iterator to count the number of keys in the database
-	var size uint64
-	opts := badger.DefaultIteratorOptions
-	opts.PrefetchValues = false
-	iterator := txn.NewIterator(opts)
-	defer iterator.Close()
-	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
-		// Do not count the last block key
-		if bytes.Compare(iterator.Item().Key(), chain.lastBlockKey) != 0 {
-			size++
+// checkAlgorithm compares the hash algorithm stored in the database with the
+// chain's one. Databases created before the algorithm was stored were mined
+// with sha256; the algorithm is stored for them.
+func (chain *BadgerChain) checkAlgorithm(txn *badger.Txn) error {
+	return chain.checkMetadata(txn, chain.algorithmKey,
+		chain.config.algorithm.String(), pow.SHA256.String(),
+		ErrInvalidHashAlgorithm)
+}
+
+// checkProofOfWork compares the Proof of Work stored in the database with the
+// chain's one. Databases created before the Proof of Work was stored were mined
+// with hashcash; the Proof of Work is stored for them.
+func (chain *BadgerChain) checkProofOfWork(txn *badger.Txn) error {
+	return chain.checkMetadata(txn, chain.proofKey, chain.config.proof.Name(),
+		newMiner(0, chain.config.algorithm).Name(),
+		ErrProofOfWorkMismatch)
+}
+
+// checkRetarget compares the retarget algorithm stored in the database with the
+// chain's one. Databases created before the retarget was stored were mined with
+// a fixed difficulty; the retarget is stored for them.
+func (chain *BadgerChain) checkRetarget(txn *badger.Txn) error {
+	return chain.checkMetadata(txn, chain.retargetKey,
+		chain.config.retargetName(), "none", ErrRetargetMismatch)
+}
+
+// checkMetadata compares the value stored in the key with the chain's value,
+// returning the mismatch error if they differ. If the key is missing, the
+// legacy value is expected and the chain's value is stored in the key.
+func (chain *BadgerChain) checkMetadata(txn *badger.Txn, key []byte, value, legacy string, mismatch error) error {
+	item, err := txn.Get(key)
+	if err == badger.ErrKeyNotFound {
+		if value != legacy {
+			return mismatch
+		}
+		return txn.SetEntry(badger.NewEntry(key, []byte(value)))
+	}
+	if err != nil {
+		return err
+	}
+
+	stored, err := item.ValueCopy(nil)
+	if err != nil {
+		return err
+	}
+	if string(stored) != value {
+		return mismatch
+	}
+
+	return nil
+}
+
+// checkGenesis compares the stored Genesis block with the one given with
+// WithGenesis, if any.
+func (chain *BadgerChain) checkGenesis() error {
+	if chain.config.genesis == nil {
+		return nil
+	}
+
+	genesis, err := chain.GetBlockByHeight(0)
+	if err != nil {
+		return err
+	}
+	if genesis.Hash != chain.config.genesis.Hash {
+		return ErrInvalidGenesis
+	}
+
+	return nil
+}
+
+// indexHeights builds the height index walking the chain from the last block
+// to the Genesis block. It does nothing if the last block is already indexed,
+// so it only builds the index of databases created before it existed.
+func (chain *BadgerChain) indexHeights() error {
+	lastBlock, err := chain.GetLastBlock()
+	if err != nil {
+		return err
+	}
+
+	// Check if the last block is already indexed
+	txn := chain.db.NewTransaction(false)
+	_, err = txn.Get(chain.heightKey(lastBlock.Height))
+	txn.Discard()
+	if err != badger.ErrKeyNotFound {
+		return err
+	}
+
+	// Use a write batch, the index may not fit in a single transaction
+	batch := chain.db.NewWriteBatch()
+	defer batch.Cancel()
+
+	block := lastBlock
+	for {
+		err = batch.Set(chain.heightKey(block.Height), []byte(block.Hash))
+		if err != nil {
+			return err
+		}
+		if block.PrevHash == "" {
+			break
+		}
+		block, err = chain.GetBlock(block.PrevHash)
+		if err != nil {
+			return err
+		}
+	}
+
+	return batch.Flush()
+}
+
+// repairLength stores the length of the chain if it is missing, counting the
+// blocks from the last block to the Genesis block. Databases created before
+// the length was stored do not have it.
+func (chain *BadgerChain) repairLength() error {
+	txn := chain.db.NewTransaction(true)
+	defer txn.Discard()
+
+	_, err := chain.getLength(txn)
+	if err != badger.ErrKeyNotFound {
+		return err
+	}
+
+	length, err := chain.countBlocks(txn)
+	if err != nil {
+		return err
+	}
+	err = chain.setLength(txn, length)
+	if err != nil {
+		return err
+	}
+
+	return txn.Commit()
+}
+
+// countBlocks walks the chain from the last block to the Genesis block and
+// returns the number of blocks found.
+func (chain *BadgerChain) countBlocks(txn *badger.Txn) (uint64, error) {
+	block, err := chain.getBlock(txn, string(chain.lastBlockKey))
+	if err != nil {
+		return 0, err
+	}
+
+	length := uint64(1)
+	for block.PrevHash != "" {
+		block, err = chain.getBlock(txn, block.PrevHash)
+		if err != nil {
+			return 0, err
+		}
+		length++
+	}
+
+	return length, nil
+}
+
+// getLength reads the length of the chain from the length key. If the key
+// does not exist, badger.ErrKeyNotFound is returned.
+func (chain *BadgerChain) getLength(txn *badger.Txn) (uint64, error) {
+	lengthItem, err := txn.Get(chain.lengthKey)
+	if err != nil {
+		return 0, err
+	}
+	lengthRaw, err := lengthItem.ValueCopy(nil)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(string(lengthRaw), 10, 64)
+}
+
+// setLength writes the length of the chain in the length key.
+func (chain *BadgerChain) setLength(txn *badger.Txn, length uint64) error {
+	return txn.SetEntry(badger.NewEntry(
+		chain.lengthKey, []byte(strconv.FormatUint(length, 10))))
+}
+
+// indexWork stores the cumulative work of the canonical chain walking it from
+// the Genesis block to the last block. It does nothing if the work of the last
+// block is already stored, so it only computes the work of databases created
+// before it was stored.
+func (chain *BadgerChain) indexWork() error {
+	lastBlock, err := chain.GetLastBlock()
+	if err != nil {
+		return err
+	}
+
+	// Check if the work of the last block is already stored
+	txn := chain.db.NewTransaction(false)
+	_, err = chain.getWork(txn, lastBlock.Hash)
+	txn.Discard()
+	if err != badger.ErrKeyNotFound {
+		return err
+	}
+
+	// Use a write batch, the work may not fit in a single transaction
+	batch := chain.db.NewWriteBatch()
+	defer batch.Cancel()
+
+	work := new(big.Int)
+	for height := uint64(0); height <= lastBlock.Height; height++ {
+		block, err := chain.GetBlockByHeight(height)
+		if err != nil {
+			return err
+		}
+		work.Add(work, blockWork(block.Difficulty))
+		err = batch.Set(chain.workKey(block.Hash), work.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+
+	return batch.Flush()
+}
+
+// getWork reads the cumulative work of a block. If the work is not stored,
+// badger.ErrKeyNotFound is returned.
+func (chain *BadgerChain) getWork(txn *badger.Txn, hash string) (*big.Int, error) {
+	workItem, err := txn.Get(chain.workKey(hash))
+	if err != nil {
+		return nil, err
+	}
+	workRaw, err := workItem.ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(workRaw), nil
+}
+
+// setWork writes the cumulative work of a block.
+func (chain *BadgerChain) setWork(txn *badger.Txn, hash string, work *big.Int) error {
+	return txn.SetEntry(badger.NewEntry(chain.workKey(hash), work.Bytes()))
+}
+
+// workKey returns the key of the cumulative work of the given block.
+func (chain *BadgerChain) workKey(hash string) []byte {
+	return append(append([]byte{}, chain.workPrefix...), hash...)
+}
+
+// heightKey returns the key of the height index for the given height.
+func (chain *BadgerChain) heightKey(height uint64) []byte {
+	key := make([]byte, len(chain.heightPrefix)+8)
+	copy(key, chain.heightPrefix)
+	binary.BigEndian.PutUint64(key[len(chain.heightPrefix):], height)
+	return key
+}
+
+// blockKey returns the key listing the given block by its height.
+func (chain *BadgerChain) blockKey(height uint64, hash string) []byte {
+	key := make([]byte, len(chain.blockPrefix)+8, len(chain.blockPrefix)+8+len(hash))
+	copy(key, chain.blockPrefix)
+	binary.BigEndian.PutUint64(key[len(chain.blockPrefix):], height)
+	return append(key, hash...)
+}
+
+// indexBlock lists a block by its height.
+func (chain *BadgerChain) indexBlock(txn *badger.Txn, block *Block) error {
+	return txn.SetEntry(badger.NewEntry(chain.blockKey(block.Height, block.Hash), nil))
+}
+
+// indexBlocks lists every stored block by its height. It does nothing if the
+// last block is already listed, so it only lists the blocks of databases
+// created before they were listed.
+func (chain *BadgerChain) indexBlocks() error {
+	lastBlock, err := chain.GetLastBlock()
+	if err != nil {
+		return err
+	}
+
+	txn := chain.db.NewTransaction(false)
+	defer txn.Discard()
+
+	// Check if the last block is already listed
+	_, err = txn.Get(chain.blockKey(lastBlock.Height, lastBlock.Hash))
+	if err != badger.ErrKeyNotFound {
+		return err
+	}
+
+	// Use a write batch, the keys may not fit in a single transaction
+	batch := chain.db.NewWriteBatch()
+	defer batch.Cancel()
+
+	// Every stored block has its work, so the blocks are found from the work
+	// keys
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Prefix = chain.workPrefix
+	iterator := txn.NewIterator(opts)
+	defer iterator.Close()
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		hash := iterator.Item().Key()[len(chain.workPrefix):]
+		block, err := chain.getBlock(txn, string(hash))
+		if err != nil {
+			return err
+		}
+		err = batch.Set(chain.blockKey(block.Height, block.Hash), nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	return batch.Flush()
+}
+
+// AddBlock adds a new block to the chain from the input records.
+func (chain *BadgerChain) AddBlock(records ...[]byte) (*Block, error) {
+	return chain.AddBlockContext(context.Background(), records...)
+}
+
+// AddBlockContext adds a new block to the chain from the input records. If the
+// context is done before the block is mined, pow.ErrMiningCanceled is returned
+// and the chain is left unchanged. The block is mined outside of any
+// transaction, while the other blocks wait to be written. If the chain is
+// closed while the block is mined, the mining is canceled and ErrChainClosed
+// is returned.
+func (chain *BadgerChain) AddBlockContext(ctx context.Context, records ...[]byte) (*Block, error) {
+	// Keep the database open while it is used
+	err := chain.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer chain.release()
+
+	// Avoid race conditions while adding new blocks
+	chain.writeMutex.Lock()
+	defer chain.writeMutex.Unlock()
+
+	// Get the previous block and the difficulty of the new block from its
+	// ancestors
+	var prevBlock *Block
+	var difficulty uint
+	err = chain.db.View(func(txn *badger.Txn) error {
+		prevBlock, err = chain.getBlock(txn, string(chain.lastBlockKey))
+		if err != nil {
+			return err
+		}
+		difficulty, err = chain.config.nextDifficulty(prevBlock,
+			func(hash string) (*Block, error) {
+				return chain.getBlock(txn, hash)
+			})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Create the new block from the previous block, until the chain is closing
+	miningCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-chain.closing:
+			cancel()
+		case <-miningCtx.Done():
+		}
+	}()
+	block, err := NewBlockWithProof(miningCtx, chain.config.algorithm,
+		chain.config.proof, records, prevBlock, difficulty)
+	if errors.Is(err, pow.ErrMiningCanceled) && ctx.Err() == nil {
+		return nil, ErrChainClosed
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Create a new read-write badger transaction
+	txn := chain.db.NewTransaction(true)
+	defer txn.Discard()
+
+	blockBytes, err := chain.config.codec.Encode(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// Add the new block to the database
+	err = txn.SetEntry(badger.NewEntry([]byte(block.Hash), blockBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	// Update the last block key
+	err = txn.SetEntry(badger.NewEntry(chain.lastBlockKey, blockBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	// Index the new block by its height
+	err = txn.SetEntry(
+		badger.NewEntry(chain.heightKey(block.Height), []byte(block.Hash)))
+	if err != nil {
+		return nil, err
+	}
+
+	// The new block is on top of the previous one
+	err = chain.setLength(txn, block.Height+1)
+	if err != nil {
+		return nil, err
+	}
+	prevWork, err := chain.getWork(txn, prevBlock.Hash)
+	if err != nil {
+		return nil, err
+	}
+	err = chain.setWork(txn, block.Hash,
+		prevWork.Add(prevWork, blockWork(block.Difficulty)))
+	if err != nil {
+		return nil, err
+	}
+	err = chain.indexBlock(txn, block)
+	if err != nil {
+		return nil, err
+	}
+
+	// Commit the transaction and check for error
+	err = txn.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return block, nil
+}
+
+// GetBlock finds and returns a block from its hash. If block is not found,
+// ErrBlockNotFound is returned.
+func (chain *BadgerChain) GetBlock(hash string) (*Block, error) {
+	// Keep the database open while it is used
+	err := chain.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer chain.release()
+
+	// Create a new read-only badger transaction
+	txn := chain.db.NewTransaction(false)
+	defer txn.Discard()
+
+	return chain.getBlock(txn, hash)
+}
+
+// getBlock finds and returns a block from its hash within a transaction.
+func (chain *BadgerChain) getBlock(txn *badger.Txn, hash string) (*Block, error) {
+	// Find the block in the database
+	blockBytes, err := txn.Get([]byte(hash))
+	if err != nil {
+		return nil, ErrBlockNotFound
+	}
+
+	blockRaw, err := blockBytes.ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return chain.config.codec.Decode(blockRaw)
+}
+
+// GetBlockByHeight finds and returns a block from its height using the height
+// index. If block is not found, ErrBlockNotFound is returned.
+func (chain *BadgerChain) GetBlockByHeight(height uint64) (*Block, error) {
+	// Keep the database open while it is used
+	err := chain.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer chain.release()
+
+	// Create a new read-only badger transaction
+	txn := chain.db.NewTransaction(false)
+	defer txn.Discard()
+
+	return chain.getBlockByHeight(txn, height)
+}
+
+// getBlockByHeight reads a block from its height using the height index in the
+// given transaction. If block is not found, ErrBlockNotFound is returned.
+func (chain *BadgerChain) getBlockByHeight(txn *badger.Txn, height uint64) (*Block, error) {
+	// Find the block's hash in the height index
+	hashItem, err := txn.Get(chain.heightKey(height))
+	if err == badger.ErrKeyNotFound {
+		return nil, ErrBlockNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := hashItem.ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return chain.getBlock(txn, string(hash))
+}
+
+// GetLastBlock returns the last block of the chain.
+func (chain *BadgerChain) GetLastBlock() (*Block, error) {
+	lastBlock, err := chain.GetBlock(string(chain.lastBlockKey))
+	if err != nil {
+		return nil, err
+	}
+	return lastBlock, nil
+}
+
+// GetWork returns the cumulative work of the chain ending in the block with
+// the given hash. If block is not found, ErrBlockNotFound is returned.
+func (chain *BadgerChain) GetWork(hash string) (*big.Int, error) {
+	// Keep the database open while it is used
+	err := chain.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer chain.release()
+
+	// Create a new read-only badger transaction
+	txn := chain.db.NewTransaction(false)
+	defer txn.Discard()
+
+	work, err := chain.getWork(txn, hash)
+	if err == badger.ErrKeyNotFound {
+		return nil, ErrBlockNotFound
+	}
+
+	return work, err
+}
+
+// ImportBlock adds a block mined outside the chain on top of any known block.
+// If the branch of the new block has more cumulative work than the canonical
+// chain, it becomes the canonical chain and the reorganization is returned.
+//
+// The block is validated before storing it. ErrDuplicateBlock is returned if
+// the block is already in the chain, ErrUnknownParent if its parent is not,
+// and ErrInvalidProofOfWork if its hash or nonce are not valid.
+func (chain *BadgerChain) ImportBlock(block *Block) (*Reorg, error) {
+	// Keep the database open while it is used
+	err := chain.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer chain.release()
+
+	// Avoid race conditions while adding new blocks
+	chain.writeMutex.Lock()
+	defer chain.writeMutex.Unlock()
+
+	// Create a new read-write badger transaction
+	txn := chain.db.NewTransaction(true)
+	defer txn.Discard()
+
+	_, err = chain.getBlock(txn, block.Hash)
+	if err == nil {
+		return nil, ErrDuplicateBlock
+	}
+	if err != ErrBlockNotFound {
+		return nil, err
+	}
+
+	// The block must be a valid child of a known block
+	parent, err := chain.getBlock(txn, block.PrevHash)
+	if err == ErrBlockNotFound {
+		return nil, ErrUnknownParent
+	}
+	if err != nil {
+		return nil, err
+	}
+	getBlock := func(hash string) (*Block, error) {
+		return chain.getBlock(txn, hash)
+	}
+	err = checkImport(block, parent, chain.config, getBlock)
+	if err != nil {
+		return nil, err
+	}
+
+	// Store the new block along with its cumulative work
+	blockBytes, err := chain.config.codec.Encode(block)
+	if err != nil {
+		return nil, err
+	}
+	err = txn.SetEntry(badger.NewEntry([]byte(block.Hash), blockBytes))
+	if err != nil {
+		return nil, err
+	}
+	work, err := chain.getWork(txn, parent.Hash)
+	if err != nil {
+		return nil, err
+	}
+	work.Add(work, blockWork(block.Difficulty))
+	err = chain.setWork(txn, block.Hash, work)
+	if err != nil {
+		return nil, err
+	}
+	err = chain.indexBlock(txn, block)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep the canonical chain unless the new branch is heavier
+	oldTip, err := chain.getBlock(txn, string(chain.lastBlockKey))
+	if err != nil {
+		return nil, err
+	}
+	tipWork, err := chain.getWork(txn, oldTip.Hash)
+	if err != nil {
+		return nil, err
+	}
+	if work.Cmp(tipWork) <= 0 {
+		return nil, txn.Commit()
+	}
+
+	reorg, err := chain.reorganize(txn, block, oldTip)
+	if err != nil {
+		return nil, err
+	}
+
+	// Commit the transaction and check for error
+	err = txn.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	// Extending the canonical chain is not a reorganization
+	if len(reorg.Removed) == 0 {
+		return nil, nil
+	}
+	return reorg, nil
+}
+
+// reorganize makes the branch ending in the new tip the canonical chain,
+// updating the height index, the last block and the length.
+func (chain *BadgerChain) reorganize(txn *badger.Txn, newTip, oldTip *Block) (*Reorg, error) {
+	// Walk back the new branch until the canonical chain is reached
+	added := []*Block{}
+	fork := newTip
+	for {
+		hashItem, err := txn.Get(chain.heightKey(fork.Height))
+		if err != nil && err != badger.ErrKeyNotFound {
+			return nil, err
+		}
+		if err == nil {
+			hash, err := hashItem.ValueCopy(nil)
+			if err != nil {
+				return nil, err
+			}
+			if string(hash) == fork.Hash {
+				break
+			}
+		}
+		added = append([]*Block{fork}, added...)
+		fork, err = chain.getBlock(txn, fork.PrevHash)
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	return size
+	// Collect the canonical blocks above the fork and drop the index of the
+	// heights above the new tip
+	removed := []*Block{}
+	for height := fork.Height + 1; height <= oldTip.Height; height++ {
+		hashItem, err := txn.Get(chain.heightKey(height))
+		if err != nil {
+			return nil, err
+		}
+		hash, err := hashItem.ValueCopy(nil)
+		if err != nil {
+			return nil, err
+		}
+		block, err := chain.getBlock(txn, string(hash))
+		if err != nil {
+			return nil, err
+		}
+		removed = append(removed, block)
+		if height > newTip.Height {
+			err = txn.Delete(chain.heightKey(height))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Index the blocks of the new branch
+	for _, block := range added {
+		err := txn.SetEntry(badger.NewEntry(
+			chain.heightKey(block.Height), []byte(block.Hash)))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Update the last block key and the length
+	newTipBytes, err := chain.config.codec.Encode(newTip)
+	if err != nil {
+		return nil, err
+	}
+	err = txn.SetEntry(badger.NewEntry(chain.lastBlockKey, newTipBytes))
+	if err != nil {
+		return nil, err
+	}
+	err = chain.setLength(txn, newTip.Height+1)
+	if err != nil {
+		return nil, err
+	}
+
+	reorg := Reorg{
+		Fork:    fork,
+		OldTip:  oldTip,
+		NewTip:  newTip,
+		Removed: removed,
+		Added:   added,
+	}
+	return &reorg, nil
+}
+
+// RollbackTo removes the blocks above the given height in a single
+// transaction, so the block at that height becomes the last block. The height
+// index and the length are updated accordingly. The removed blocks of the
+// canonical chain are returned sorted by height. The blocks of the competing
+// branches above the height are discarded too.
+func (chain *BadgerChain) RollbackTo(height uint64) ([]*Block, error) {
+	return chain.rollbackTo(height, "")
+}
+
+// rollbackTo removes the blocks above the height as RollbackTo. If the hash is
+// not empty, it must be the hash of the canonical block at that height when
+// the chain is locked, otherwise ErrBlockNotFound is returned.
+func (chain *BadgerChain) rollbackTo(height uint64, hash string) ([]*Block, error) {
+	// Keep the database open while it is used
+	err := chain.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer chain.release()
+
+	// Avoid race conditions while removing blocks
+	chain.writeMutex.Lock()
+	defer chain.writeMutex.Unlock()
+
+	// Create a new read-write badger transaction
+	txn := chain.db.NewTransaction(true)
+	defer txn.Discard()
+
+	// The block must be the canonical one at the height
+	if hash != "" {
+		canonical, err := chain.getBlockByHeight(txn, height)
+		if err != nil {
+			return nil, err
+		}
+		if canonical.Hash != hash {
+			return nil, ErrBlockNotFound
+		}
+	}
+
+	lastBlock, err := chain.getBlock(txn, string(chain.lastBlockKey))
+	if err != nil {
+		return nil, err
+	}
+
+	// Nothing to remove above the last block
+	if height >= lastBlock.Height {
+		return []*Block{}, nil
+	}
+
+	// Remove the canonical blocks along with their index and work, walking
+	// back from the last block
+	removed := make([]*Block, lastBlock.Height-height)
+	for h := lastBlock.Height; h > height; h-- {
+		block, err := chain.getBlockByHeight(txn, h)
+		if err != nil {
+			return nil, err
+		}
+		removed[h-height-1] = block
+		err = chain.deleteBlock(txn, block)
+		if err != nil {
+			return nil, err
+		}
+		err = txn.Delete(chain.heightKey(h))
+		if err != nil {
+			return nil, err
+		}
+	}
+	newTip, err := chain.getBlockByHeight(txn, height)
+	if err != nil {
+		return nil, err
+	}
+
+	// Remove the blocks of the competing branches above the height, found
+	// from the keys listing the blocks by height
+	branches := [][]byte{}
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Prefix = chain.blockPrefix
+	iterator := txn.NewIterator(opts)
+	for iterator.Seek(chain.blockKey(height+1, "")); iterator.Valid(); iterator.Next() {
+		branches = append(branches, iterator.Item().KeyCopy(nil))
+	}
+	iterator.Close()
+	for _, key := range branches {
+		hash := string(key[len(chain.blockPrefix)+8:])
+		err = txn.Delete([]byte(hash))
+		if err != nil {
+			return nil, err
+		}
+		err = txn.Delete(chain.workKey(hash))
+		if err != nil {
+			return nil, err
+		}
+		err = txn.Delete(key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Update the last block key and the length
+	newTipBytes, err := chain.config.codec.Encode(newTip)
+	if err != nil {
+		return nil, err
+	}
+	err = txn.SetEntry(badger.NewEntry(chain.lastBlockKey, newTipBytes))
+	if err != nil {
+		return nil, err
+	}
+	err = chain.setLength(txn, height+1)
+	if err != nil {
+		return nil, err
+	}
+
+	// Commit the transaction and check for error
+	err = txn.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return removed, nil
+}
+
+// deleteBlock removes a block, its work and its key listing it by height from
+// the database.
+func (chain *BadgerChain) deleteBlock(txn *badger.Txn, block *Block) error {
+	err := txn.Delete([]byte(block.Hash))
+	if err != nil {
+		return err
+	}
+	err = txn.Delete(chain.workKey(block.Hash))
+	if err != nil {
+		return err
+	}
+	return txn.Delete(chain.blockKey(block.Height, block.Hash))
+}
+
+// Migrate rewrites the blocks stored with the legacy gob encoding using the
+// canonical binary encoding, returning the number of rewritten entries. Legacy
+// blocks can be read without migrating them, but tools outside this package
+// only understand the canonical encoding. Databases written by older versions
+// have no codec stored, so they are opened with the binary codec; the other
+// codecs have nothing to migrate.
+//
+// Every legacy block is converted before any of them is rewritten, so nothing
+// is rewritten if a block cannot be converted without losing data: the blocks
+// of the first version return ErrLegacyBlock and the blocks with a field too
+// large for the binary encoding return ErrInvalidEncoding.
+func (chain *BadgerChain) Migrate() (int, error) {
+	if chain.config.codec.Name() != (BinaryCodec{}).Name() {
+		return 0, nil
+	}
+
+	// Keep the database open while it is used
+	err := chain.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer chain.release()
+
+	// Avoid race conditions while rewriting blocks
+	chain.writeMutex.Lock()
+	defer chain.writeMutex.Unlock()
+
+	// Create a new read-only badger transaction
+	txn := chain.db.NewTransaction(false)
+	defer txn.Discard()
+
+	// Every stored block has its work, so the blocks are found from the work
+	// keys. The last block key stores a copy of the last block.
+	keys := [][]byte{chain.lastBlockKey}
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Prefix = chain.workPrefix
+	iterator := txn.NewIterator(opts)
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		keys = append(keys, iterator.Item().KeyCopy(nil)[len(chain.workPrefix):])
+	}
+	iterator.Close()
+
+	// Convert the legacy blocks
+	entries := map[string][]byte{}
+	for _, key := range keys {
+		item, err := txn.Get(key)
+		if err != nil {
+			return 0, err
+		}
+		blockRaw, err := item.ValueCopy(nil)
+		if err != nil {
+			return 0, err
+		}
+		if len(blockRaw) > 0 && blockRaw[0] == EncodingMagic {
+			continue
+		}
+
+		block, err := decodeGobBlock(blockRaw)
+		if err != nil {
+			return 0, err
+		}
+		entries[string(key)], err = encodeBlock(block)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// Use a write batch, the blocks may not fit in a single transaction
+	batch := chain.db.NewWriteBatch()
+	defer batch.Cancel()
+
+	for key, blockBytes := range entries {
+		err = batch.Set([]byte(key), blockBytes)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err = batch.Flush()
+	if err != nil {
+		return 0, err
+	}
+	return len(entries), nil
+}
+
+// Close stops the garbage collection and closes the database, flushing the
+// pending writes to the disk. The blocks are kept, so the chain can be opened
+// again with NewBadgerChain. The blocks being mined are canceled, the blocks
+// being written finish before the database is closed, and the methods called
+// after Close return ErrChainClosed.
+func (chain *BadgerChain) Close() error {
+	chain.stopGC()
+	chain.cancelMining()
+
+	// Wait until the database is no longer used
+	chain.closeMutex.Lock()
+	defer chain.closeMutex.Unlock()
+
+	if chain.closed {
+		return nil
+	}
+	chain.closed = true
+
+	return chain.db.Close()
+}
+
+// cancelMining cancels the blocks being mined, so the chain can be closed
+// without waiting for them. It can be called more than once.
+func (chain *BadgerChain) cancelMining() {
+	chain.closeOnce.Do(func() {
+		close(chain.closing)
+	})
+}
+
+// acquire keeps the database open until release is called. ErrChainClosed is
+// returned if the chain is already closed.
+func (chain *BadgerChain) acquire() error {
+	chain.closeMutex.RLock()
+	if chain.closed {
+		chain.closeMutex.RUnlock()
+		return ErrChainClosed
+	}
+	return nil
+}
+
+// release allows the database acquired by acquire to be closed.
+func (chain *BadgerChain) release() {
+	chain.closeMutex.RUnlock()
+}
+
+// Destroy removes all the blocks from the chain. The blocks of a closed chain
+// are removed from the disk.
+func (chain *BadgerChain) Destroy() error {
+	chain.stopGC()
+	chain.cancelMining()
+
+	// Wait until the database is no longer used
+	chain.closeMutex.Lock()
+	defer chain.closeMutex.Unlock()
+
+	if !chain.closed {
+		err := chain.db.DropAll()
+		if err != nil {
+			return err
+		}
+		err = chain.db.Close()
+		if err != nil {
+			return err
+		}
+		chain.closed = true
+	}
+
+	// In-memory databases have no directory
+	if chain.db.Opts().InMemory {
+		return nil
+	}
+	return os.RemoveAll(chain.db.Opts().Dir)
+}
+
+// NewIterator initializes the blockchain iterator from the last block.
+func (chain *BadgerChain) NewIterator() (*ChainIterator, error) {
+	lastBlock, err := chain.GetLastBlock()
+	if err != nil {
+		return nil, err
+	}
+	iterator := ChainIterator{
+		currentHash: lastBlock.Hash,
+		chain:       chain,
+	}
+	return &iterator, nil
+}
+
+// HashAlgorithm returns the hash algorithm used to mine the blocks of the
+// chain.
+func (chain *BadgerChain) HashAlgorithm() pow.Algorithm {
+	return chain.config.algorithm
+}
+
+// ProofOfWork returns the Proof of Work used to mine the blocks of the chain.
+func (chain *BadgerChain) ProofOfWork() pow.ProofOfWork {
+	return chain.config.proof
+}
+
+// Length returns the total size of the blockchain. It is read from the length
+// key, which is updated along with every new block. If it cannot be read, the
+// blocks are counted instead. It is 0 once the chain is closed.
+func (chain *BadgerChain) Length() uint64 {
+	// Keep the database open while it is used
+	if chain.acquire() != nil {
+		return 0
+	}
+	defer chain.release()
+
+	// Create a new read-only badger transaction
+	txn := chain.db.NewTransaction(false)
+	defer txn.Discard()
+
+	length, err := chain.getLength(txn)
+	if err != nil {
+		length, _ = chain.countBlocks(txn)
+	}
+
+	return length
+}
+
+// Verify checks the integrity of the whole chain, from the last block to the
+// Genesis block. It returns a VerificationError with every invalid block found.
+func (chain *BadgerChain) Verify() error {
+	return verifyChain(chain, chain.config)
 }
 
 // Next returns the next block in the blockchain until the Genesis block is
@@ -1,8 +1,19 @@
 package blockchain
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	badger "github.com/dgraph-io/badger/v3"
+	"github.com/dgraph-io/badger/v3/options"
+	"github.com/samuelvl/blockchain-lab/pkg/pow"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 )
@@ -10,20 +21,19 @@ import (
 // ChainTestSuite stores the parameters to fully test blockchain operations.
 type ChainTestSuite struct {
 	chain        Chain
+	reopen       func() (Chain, error)
 	numOfBlocks  uint64
 	genesisBlock Block
 	suite.Suite
 }
 
-// SetupSuite initializes the test suite paremeters.
+// SetupSuite initializes the test suite paremeters. The Genesis block is the
+// only block of the chain when the suite starts.
 func (suite *ChainTestSuite) SetupSuite() {
 	suite.numOfBlocks = 10
-	suite.genesisBlock = Block{
-		Data:     []byte("Genesis"),
-		Hash:     "0000f5adf42baf5174fc801e930ab3d020b5d00218657e66df8f23419da9c3c1",
-		PrevHash: "",
-		Nonce:    205317,
-	}
+	genesisBlock, err := suite.chain.GetLastBlock()
+	require.NoError(suite.T(), err)
+	suite.genesisBlock = *genesisBlock
 }
 
 // TearDownSuite deletes the backend instance.
@@ -37,12 +47,17 @@ func (suite *ChainTestSuite) TestAddBlock() {
 	// Checks if the first block of the chain is the Genesis block.
 	firstBlock, err := suite.chain.GetLastBlock()
 	require.NoError(suite.T(), err)
-	require.Equal(suite.T(), suite.genesisBlock, *firstBlock)
+	require.Equal(suite.T(), [][]byte{[]byte("Genesis")}, firstBlock.Records)
+	require.Equal(suite.T(), "", firstBlock.PrevHash)
+	require.Equal(suite.T(), uint64(0), firstBlock.Height)
+	require.Equal(suite.T(), DefaultDifficulty, firstBlock.Difficulty)
+	require.NoError(suite.T(), firstBlock.Verify())
 
 	// Add blocks to the blockchain
 	for i := uint64(0); i < suite.numOfBlocks; i++ {
 		// Add the block to the database
-		newBlock, err := suite.chain.AddBlock([]byte("this is a testing block"))
+		newBlock, err := suite.chain.AddBlock([]byte("this is a testing block"),
+			[]byte("this is another testing record"))
 		require.NoError(suite.T(), err)
 
 		// Retrieve the block from the database
@@ -54,6 +69,25 @@ func (suite *ChainTestSuite) TestAddBlock() {
 	}
 }
 
+// TestAddBlockContext checks that a canceled block addition does not modify the
+// blockchain.
+func (suite *ChainTestSuite) TestAddBlockContext() {
+	lastBlock, err := suite.chain.GetLastBlock()
+	require.NoError(suite.T(), err)
+
+	// Add a block with an already canceled context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	newBlock, err := suite.chain.AddBlockContext(ctx, []byte("this is a canceled block"))
+	require.Nil(suite.T(), newBlock)
+	require.True(suite.T(), errors.Is(err, pow.ErrMiningCanceled))
+
+	// Check that the last block has not changed
+	currentBlock, err := suite.chain.GetLastBlock()
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), lastBlock, currentBlock)
+}
+
 // TestErrBlockNotFound checks the error returned when a block is not found.
 func (suite *ChainTestSuite) TestErrBlockNotFound() {
 	// Find a non-existent block in the blockchain
@@ -62,6 +96,32 @@ func (suite *ChainTestSuite) TestErrBlockNotFound() {
 	require.Equal(suite.T(), ErrBlockNotFound, err)
 }
 
+// TestGetBlockByHeight finds every block of the chain from its height.
+func (suite *ChainTestSuite) TestGetBlockByHeight() {
+	length := suite.chain.Length()
+	for height := uint64(0); height < length; height++ {
+		block, err := suite.chain.GetBlockByHeight(height)
+		require.NoError(suite.T(), err)
+		require.Equal(suite.T(), height, block.Height)
+	}
+
+	// The first block is the Genesis block
+	block, err := suite.chain.GetBlockByHeight(0)
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), suite.genesisBlock, *block)
+
+	// The highest block is the last block
+	block, err = suite.chain.GetBlockByHeight(length - 1)
+	require.NoError(suite.T(), err)
+	lastBlock, err := suite.chain.GetLastBlock()
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), lastBlock, block)
+
+	// There are no blocks above the last block
+	_, err = suite.chain.GetBlockByHeight(length)
+	require.Equal(suite.T(), ErrBlockNotFound, err)
+}
+
 // TestChainLength checks if the size of the blockchain is correct.
 func (suite *ChainTestSuite) TestChainLength() {
 	// Check if the the number of elements in the chain matches the length
@@ -91,6 +151,619 @@ func (suite *ChainTestSuite) TestChainIterator() {
 	require.Equal(suite.T(), suite.numOfBlocks+1, chainLength)
 }
 
+// TestReopen closes the chain and checks that the same blocks are found once
+// it is opened again. It is skipped by the backends that cannot be reopened.
+func (suite *ChainTestSuite) TestReopen() {
+	if suite.reopen == nil {
+		suite.T().Skip("the backend cannot be reopened")
+	}
+	lastBlock, err := suite.chain.GetLastBlock()
+	require.NoError(suite.T(), err)
+	length := suite.chain.Length()
+
+	// The chain cannot be used once it is closed
+	require.NoError(suite.T(), suite.chain.Close())
+	require.NoError(suite.T(), suite.chain.Close())
+	_, err = suite.chain.AddBlock([]byte("this is a closed block"))
+	require.Equal(suite.T(), ErrChainClosed, err)
+	_, err = suite.chain.GetLastBlock()
+	require.Equal(suite.T(), ErrChainClosed, err)
+	require.Equal(suite.T(), uint64(0), suite.chain.Length())
+
+	// The blocks are kept after closing the chain
+	suite.chain, err = suite.reopen()
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), length, suite.chain.Length())
+	reopenedBlock, err := suite.chain.GetLastBlock()
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), lastBlock, reopenedBlock)
+}
+
+// TestVerify checks that a chain built with AddBlock passes the integrity
+// verification.
+func (suite *ChainTestSuite) TestVerify() {
+	err := suite.chain.Verify()
+	require.NoError(suite.T(), err)
+}
+
+// TestChainClose closes the chains while blocks are being added. Every block
+// addition must either finish, so the block is found once the chain is opened
+// again, or fail with ErrChainClosed.
+func TestChainClose(t *testing.T) {
+	var tests = []struct {
+		name string
+		open func() (Chain, error)
+	}{
+		{
+			name: "slice",
+			open: func() (Chain, error) {
+				return NewSliceChain(WithDifficulty(4))
+			},
+		},
+		{
+			name: "badger",
+			open: func() (Chain, error) {
+				return NewBadgerChain("../../test/blockchain/badger-close",
+					WithDifficulty(4))
+			},
+		},
+		{
+			name: "file",
+			open: func() (Chain, error) {
+				return NewFileChain("../../test/blockchain/file-close",
+					WithDifficulty(4))
+			},
+		},
+		{
+			name: "sqlite",
+			open: func() (Chain, error) {
+				return NewSQLiteChain("../../test/blockchain/sqlite-close.db",
+					WithDifficulty(4))
+			},
+		},
+	}
+
+	for _, test := range tests {
+		chain, err := test.open()
+		require.NoError(t, err, test.name)
+
+		// Add blocks from several goroutines until the chain is closed
+		var added int64
+		errs := make(chan error, 4)
+		for i := 0; i < cap(errs); i++ {
+			go func() {
+				for {
+					_, err := chain.AddBlock([]byte("this is a testing block"))
+					if err != nil {
+						errs <- err
+						return
+					}
+					atomic.AddInt64(&added, 1)
+				}
+			}()
+		}
+		require.Eventually(t, func() bool {
+			return atomic.LoadInt64(&added) >= 4
+		}, 10*time.Second, time.Millisecond, test.name)
+		require.NoError(t, chain.Close(), test.name)
+		for i := 0; i < cap(errs); i++ {
+			require.Equal(t, ErrChainClosed, <-errs, test.name)
+		}
+
+		// The slice of blocks is lost once it is closed
+		if test.name == "slice" {
+			require.NoError(t, chain.Destroy(), test.name)
+			continue
+		}
+
+		chain, err = test.open()
+		require.NoError(t, err, test.name)
+		require.Equal(t, uint64(atomic.LoadInt64(&added)+1), chain.Length(), test.name)
+		require.NoError(t, chain.Verify(), test.name)
+		require.NoError(t, chain.Destroy(), test.name)
+	}
+}
+
+// TestChainDifficulty checks that blocks are mined with the chain's difficulty.
+func TestChainDifficulty(t *testing.T) {
+	// Out of range difficulties are rejected
+	_, err := NewSliceChain(WithDifficulty(0))
+	require.Equal(t, ErrInvalidDifficulty, err)
+	_, err = NewSliceChain(WithDifficulty(MaxDifficulty + 1))
+	require.Equal(t, ErrInvalidDifficulty, err)
+
+	// Every block is mined with the chain's difficulty
+	chain, err := NewSliceChain(WithDifficulty(4))
+	require.NoError(t, err)
+	newBlock, err := chain.AddBlock([]byte("this is a testing block"))
+	require.NoError(t, err)
+	require.Equal(t, uint(4), chain.Blocks[0].Difficulty)
+	require.Equal(t, uint(4), newBlock.Difficulty)
+	require.NoError(t, chain.Verify())
+
+	// Blocks mined with a different difficulty are reported
+	newBlock.Difficulty = 8
+	newBlock.ComputeHash()
+	require.NoError(t, newBlock.Mine())
+	err = chain.Verify()
+	require.True(t, errors.Is(err, ErrInvalidDifficulty))
+}
+
+// TestBadgerChainDifficulty checks that a Badger database cannot be opened with
+// a difficulty different from the one used to create it.
+func TestBadgerChainDifficulty(t *testing.T) {
+	dir := "../../test/blockchain/badger-difficulty"
+	chain, err := NewBadgerChain(dir, WithDifficulty(4))
+	require.NoError(t, err)
+	require.NoError(t, chain.Close())
+
+	// Open the database with a different difficulty
+	_, err = NewBadgerChain(dir, WithDifficulty(8))
+	require.Equal(t, ErrInvalidDifficulty, err)
+
+	// Open the database with the same difficulty
+	chain, err = NewBadgerChain(dir, WithDifficulty(4))
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), chain.Length())
+	require.NoError(t, chain.Destroy())
+}
+
+// TestChainHashAlgorithm checks that blocks are hashed, mined and verified with
+// the chain's hash algorithm.
+func TestChainHashAlgorithm(t *testing.T) {
+	_, err := NewSliceChain(WithHashAlgorithm(pow.Algorithm(42)))
+	require.Equal(t, pow.ErrUnknownAlgorithm, err)
+
+	algorithms := []pow.Algorithm{pow.SHA256, pow.DoubleSHA256, pow.SHA3_256,
+		pow.BLAKE2b_256}
+	for _, algorithm := range algorithms {
+		chain, err := NewSliceChain(WithDifficulty(4),
+			WithHashAlgorithm(algorithm))
+		require.NoError(t, err, algorithm.String())
+		require.Equal(t, algorithm, chain.HashAlgorithm())
+		newBlock, err := chain.AddBlock([]byte("this is a testing block"))
+		require.NoError(t, err, algorithm.String())
+		require.NoError(t, chain.Verify(), algorithm.String())
+
+		// The blocks are only valid for the chain's algorithm
+		require.NoError(t, newBlock.VerifyWith(algorithm), algorithm.String())
+		require.Equal(t, newBlock.MerkleRoot,
+			MerkleRootWith(algorithm, newBlock.Records), algorithm.String())
+		if algorithm != pow.SHA256 {
+			require.Error(t, newBlock.Verify(), algorithm.String())
+		}
+
+		// Blocks mined by other nodes are imported with the chain's algorithm
+		genesis, err := chain.GetBlockByHeight(0)
+		require.NoError(t, err, algorithm.String())
+		replica, err := NewSliceChain(WithDifficulty(4),
+			WithHashAlgorithm(algorithm), WithGenesis(genesis))
+		require.NoError(t, err, algorithm.String())
+		_, err = replica.ImportBlock(newBlock)
+		require.NoError(t, err, algorithm.String())
+	}
+}
+
+// TestBadgerChainHashAlgorithm checks that a Badger database can only be
+// opened with the hash algorithm used to create it.
+func TestBadgerChainHashAlgorithm(t *testing.T) {
+	dir := "../../test/blockchain/badger-algorithm"
+	chain, err := NewBadgerChain(dir, WithDifficulty(4),
+		WithHashAlgorithm(pow.BLAKE2b_256))
+	require.NoError(t, err)
+	_, err = chain.AddBlock([]byte("this is a testing block"))
+	require.NoError(t, err)
+	require.NoError(t, chain.Close())
+
+	// Open the database with a different hash algorithm
+	_, err = NewBadgerChain(dir, WithDifficulty(4))
+	require.Equal(t, ErrInvalidHashAlgorithm, err)
+
+	// Open the database with the same hash algorithm
+	chain, err = NewBadgerChain(dir, WithDifficulty(4),
+		WithHashAlgorithm(pow.BLAKE2b_256))
+	require.NoError(t, err)
+	require.NoError(t, chain.Verify())
+	require.NoError(t, chain.Destroy())
+
+	// Databases without hash algorithm were mined with sha256
+	chain, err = NewBadgerChain(dir, WithDifficulty(4))
+	require.NoError(t, err)
+	err = chain.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(chain.algorithmKey)
+	})
+	require.NoError(t, err)
+	require.NoError(t, chain.Close())
+
+	_, err = NewBadgerChain(dir, WithDifficulty(4),
+		WithHashAlgorithm(pow.SHA3_256))
+	require.Equal(t, ErrInvalidHashAlgorithm, err)
+	chain, err = NewBadgerChain(dir, WithDifficulty(4))
+	require.NoError(t, err)
+	err = chain.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(chain.algorithmKey)
+		return err
+	})
+	require.NoError(t, err)
+	require.NoError(t, chain.Destroy())
+}
+
+// TestChainProofOfWork checks that blocks are mined and verified with the
+// chain's Proof of Work.
+func TestChainProofOfWork(t *testing.T) {
+	proof := pow.NewMemoryHard(1024, pow.SHA256)
+	chain, err := NewSliceChain(WithDifficulty(4), WithProofOfWork(proof))
+	require.NoError(t, err)
+	require.Equal(t, proof, chain.ProofOfWork())
+	newBlock, err := chain.AddBlock([]byte("this is a testing block"))
+	require.NoError(t, err)
+	require.NoError(t, chain.Verify())
+	require.NoError(t, newBlock.VerifyWithProof(pow.SHA256, proof))
+
+	// The records can be proved with the chain's Proof of Work
+	merkleProof, err := newBlock.MerkleProof(0)
+	require.NoError(t, err)
+	require.NoError(t, merkleProof.VerifyWithProof(newBlock.Records[0],
+		pow.SHA256, proof))
+	require.NoError(t, VerifyMerkleProof(chain, merkleProof, newBlock.Records[0]))
+
+	// Blocks mined with hashcash are not valid
+	genesis, err := chain.GetBlockByHeight(0)
+	require.NoError(t, err)
+	hashcashBlock := NewBlock([][]byte{[]byte("this is a hashcash block")},
+		genesis, 4)
+	_, err = chain.ImportBlock(hashcashBlock)
+	require.True(t, errors.Is(err, ErrInvalidProofOfWork))
+}
+
+// TestChainWorkers checks that the blocks of a chain are mined with the
+// configured number of workers.
+func TestChainWorkers(t *testing.T) {
+	chain, err := NewSliceChain(WithDifficulty(8), WithWorkers(3))
+	require.NoError(t, err)
+	require.Equal(t, pow.NewMiner(3, true).WithAlgorithm(pow.SHA256),
+		chain.ProofOfWork())
+	newBlock, err := chain.AddBlock([]byte("this is a testing block"))
+	require.NoError(t, err)
+	require.NoError(t, chain.Verify())
+
+	// The nonce does not depend on the number of workers
+	remined := *newBlock
+	remined.Hash = remined.BlockHeader.hash(pow.SHA256)
+	err = remined.MineWithProof(context.Background(), pow.NewMiner(1, true))
+	require.NoError(t, err)
+	require.Equal(t, newBlock.Nonce, remined.Nonce)
+	require.Equal(t, newBlock.Hash, remined.Hash)
+}
+
+// fixedRetarget is a retarget algorithm which always returns the same
+// difficulty.
+type fixedRetarget uint
+
+// NextDifficulty returns the fixed difficulty.
+func (retarget fixedRetarget) NextDifficulty(parent *Block, getBlock BlockGetter) (uint, error) {
+	return uint(retarget), nil
+}
+
+// Name returns "fixed/<difficulty>".
+func (retarget fixedRetarget) Name() string {
+	return "fixed/" + strconv.Itoa(int(retarget))
+}
+
+// TestBadgerChainCloseMining checks that closing a Badger database cancels the
+// blocks being mined instead of waiting for them.
+func TestBadgerChainCloseMining(t *testing.T) {
+	dir := "../../test/blockchain/badger-close-mining"
+	opts := []ChainOption{WithDifficulty(4),
+		WithRetarget(fixedRetarget(MaxDifficulty))}
+	chain, err := NewBadgerChain(dir, opts...)
+	require.NoError(t, err)
+
+	// The block cannot be mined before the chain is closed
+	errs := make(chan error)
+	go func() {
+		_, err := chain.AddBlock([]byte("this is a testing block"))
+		errs <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, chain.Close())
+	require.Equal(t, ErrChainClosed, <-errs)
+
+	// The chain was left unchanged
+	chain, err = NewBadgerChain(dir, opts...)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), chain.Length())
+	require.NoError(t, chain.Destroy())
+}
+
+// TestBadgerChainProofOfWork checks that a Badger database can only be opened
+// with the Proof of Work used to create it.
+func TestBadgerChainProofOfWork(t *testing.T) {
+	dir := "../../test/blockchain/badger-proof"
+	proof := pow.NewMemoryHard(1024, pow.SHA256)
+	chain, err := NewBadgerChain(dir, WithDifficulty(4), WithProofOfWork(proof))
+	require.NoError(t, err)
+	_, err = chain.AddBlock([]byte("this is a testing block"))
+	require.NoError(t, err)
+	require.NoError(t, chain.Close())
+
+	// Open the database with a different Proof of Work
+	_, err = NewBadgerChain(dir, WithDifficulty(4))
+	require.Equal(t, ErrProofOfWorkMismatch, err)
+	_, err = NewBadgerChain(dir, WithDifficulty(4),
+		WithProofOfWork(pow.NewMemoryHard(2048, pow.SHA256)))
+	require.Equal(t, ErrProofOfWorkMismatch, err)
+
+	// Open the database with the same Proof of Work
+	chain, err = NewBadgerChain(dir, WithDifficulty(4), WithProofOfWork(proof))
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), chain.Length())
+	require.NoError(t, chain.Verify())
+	require.NoError(t, chain.Destroy())
+
+	// Databases without Proof of Work were mined with hashcash
+	chain, err = NewBadgerChain(dir, WithDifficulty(4))
+	require.NoError(t, err)
+	err = chain.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(chain.proofKey)
+	})
+	require.NoError(t, err)
+	require.NoError(t, chain.Close())
+
+	_, err = NewBadgerChain(dir, WithDifficulty(4), WithProofOfWork(proof))
+	require.Equal(t, ErrProofOfWorkMismatch, err)
+	chain, err = NewBadgerChain(dir, WithDifficulty(4))
+	require.NoError(t, err)
+	require.NoError(t, chain.Destroy())
+}
+
+// badgerTestLogger counts the messages logged by a Badger database.
+type badgerTestLogger struct {
+	messages int64
+}
+
+func (l *badgerTestLogger) Errorf(string, ...interface{})   { atomic.AddInt64(&l.messages, 1) }
+func (l *badgerTestLogger) Warningf(string, ...interface{}) { atomic.AddInt64(&l.messages, 1) }
+func (l *badgerTestLogger) Infof(string, ...interface{})    { atomic.AddInt64(&l.messages, 1) }
+func (l *badgerTestLogger) Debugf(string, ...interface{})   { atomic.AddInt64(&l.messages, 1) }
+
+// TestBadgerChainOptions checks that the Badger database is opened with the
+// given options.
+func TestBadgerChainOptions(t *testing.T) {
+	dir := "../../test/blockchain/badger-options"
+	key := []byte("0123456789abcdef0123456789abcdef")
+	logger := badgerTestLogger{}
+	chain, err := NewBadgerChain(dir, WithDifficulty(4), WithEncryptionKey(key),
+		WithCompression(options.ZSTD), WithSyncWrites(true),
+		WithValueLogFileSize(1<<20), WithCacheSizes(1<<20, 1<<20),
+		WithLogger(&logger))
+	require.NoError(t, err)
+	require.True(t, chain.db.Opts().SyncWrites)
+	require.Equal(t, int64(1<<20), chain.db.Opts().ValueLogFileSize)
+	require.Equal(t, options.ZSTD, chain.db.Opts().Compression)
+	require.Greater(t, atomic.LoadInt64(&logger.messages), int64(0))
+	_, err = chain.AddBlock([]byte("this is a testing block"))
+	require.NoError(t, err)
+	require.NoError(t, chain.Close())
+
+	// An encrypted database needs its key
+	_, err = NewBadgerChain(dir, WithDifficulty(4))
+	require.Error(t, err)
+	_, err = NewBadgerChain(dir, WithDifficulty(4), WithEncryptionKey(key))
+	require.Equal(t, ErrInvalidBadgerOptions, err)
+	chain, err = NewBadgerChain(dir, WithDifficulty(4), WithEncryptionKey(key),
+		WithCacheSizes(1<<20, 1<<20))
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), chain.Length())
+	require.NoError(t, chain.Verify())
+	require.NoError(t, chain.Destroy())
+
+	// Compression needs the block cache
+	_, err = NewBadgerChain(dir, WithCompression(options.Snappy),
+		WithCacheSizes(0, 0))
+	require.Equal(t, ErrInvalidBadgerOptions, err)
+}
+
+// TestBadgerChainCompact checks that the space of the deleted blocks is
+// reclaimed by Compact and that the database is garbage collected in the
+// background until the chain is destroyed.
+func TestBadgerChainCompact(t *testing.T) {
+	dir := "../../test/blockchain/badger-compact"
+
+	// A small memory table is flushed to the LSM tree while blocks are added.
+	// The value threshold must fit in a write batch of the memory table. The
+	// compactions of Badger are disabled, so the deleted keys are only dropped
+	// by Compact.
+	opts := []ChainOption{WithDifficulty(1), WithGCInterval(0),
+		WithValueLogFileSize(1 << 20), WithValueThreshold(128 << 10),
+		withBadgerOptions(func(opts badger.Options) badger.Options {
+			return opts.WithMemTableSize(1 << 20).WithNumCompactors(0)
+		})}
+	chain, err := NewBadgerChain(dir, opts...)
+	require.NoError(t, err)
+	record := bytes.Repeat([]byte("this is a testing record"), 2<<10)
+	for i := 0; i < 150; i++ {
+		_, err = chain.AddBlock(record, []byte(strconv.Itoa(i)))
+		require.NoError(t, err)
+	}
+
+	// Roll back most of the blocks and reopen the chain, so the deleted keys
+	// are flushed to the LSM tree
+	_, err = chain.RollbackTo(10)
+	require.NoError(t, err)
+	require.NoError(t, chain.Close())
+	chain, err = NewBadgerChain(dir, opts...)
+	require.NoError(t, err)
+
+	sizeBefore := dirSize(t, dir)
+	stats, err := chain.Compact()
+	require.NoError(t, err)
+	require.Equal(t, 1, stats.Runs)
+	require.Greater(t, stats.ReclaimedBytes, int64(0))
+	require.Less(t, dirSize(t, dir), sizeBefore)
+	require.Equal(t, *stats, chain.GCStats())
+	require.Equal(t, uint64(11), chain.Length())
+	require.NoError(t, chain.Verify())
+	require.NoError(t, chain.Close())
+
+	// The background runs are added to the stats of the chain
+	chain, err = NewBadgerChain(dir, WithDifficulty(1),
+		WithGCInterval(10*time.Millisecond), WithGCDiscardRatio(0.1))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return chain.GCStats().Runs > 2
+	}, time.Second, 10*time.Millisecond)
+	require.Zero(t, chain.GCStats().Errors)
+	require.NoError(t, chain.GCStats().LastError)
+	require.NoError(t, chain.Verify())
+
+	// The background collection is stopped with the chain
+	done := chain.gcDone
+	require.NoError(t, chain.Destroy())
+	require.Nil(t, chain.gcStop)
+	<-done
+
+	// In-memory databases have no value log to collect
+	chain, err = NewBadgerChain("", WithInMemory(), WithGCInterval(time.Millisecond))
+	require.NoError(t, err)
+	require.Nil(t, chain.gcStop)
+	stats, err = chain.Compact()
+	require.NoError(t, err)
+	require.Equal(t, int64(0), stats.ReclaimedBytes)
+	require.NoError(t, chain.Destroy())
+
+	// The discard ratio must be in (0, 1)
+	_, err = NewBadgerChain(dir, WithGCDiscardRatio(1))
+	require.Equal(t, ErrInvalidBadgerOptions, err)
+}
+
+// TestBadgerInMemoryBlockchain runs the test suite for the Badger database
+// backend kept in memory.
+func TestBadgerInMemoryBlockchain(t *testing.T) {
+	chain, err := NewBadgerChain("", WithInMemory())
+	require.NoError(t, err)
+	require.True(t, chain.db.Opts().InMemory)
+
+	// Run a new test suite for this blockchain
+	badgerChainTestSuite := ChainTestSuite{
+		chain: chain,
+	}
+	suite.Run(t, &badgerChainTestSuite)
+}
+
+// dirSize returns the size in bytes of the files of a directory.
+func dirSize(t *testing.T, dir string) int64 {
+	var size int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	return size
+}
+
+// TestBadgerHeightIndex checks that the height index is built when opening a
+// database without it.
+func TestBadgerHeightIndex(t *testing.T) {
+	dir := "../../test/blockchain/badger-height"
+	chain, err := NewBadgerChain(dir, WithDifficulty(4))
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = chain.AddBlock([]byte("this is a testing block"))
+		require.NoError(t, err)
+	}
+
+	// Remove the height index and reopen the database
+	require.NoError(t, chain.db.DropPrefix(chain.heightPrefix))
+	_, err = chain.GetBlockByHeight(0)
+	require.Equal(t, ErrBlockNotFound, err)
+	require.NoError(t, chain.Close())
+
+	chain, err = NewBadgerChain(dir, WithDifficulty(4))
+	require.NoError(t, err)
+	for height := uint64(0); height < 4; height++ {
+		block, err := chain.GetBlockByHeight(height)
+		require.NoError(t, err)
+		require.Equal(t, height, block.Height)
+	}
+	require.Equal(t, uint64(4), chain.Length())
+	require.NoError(t, chain.Destroy())
+}
+
+// TestBadgerLength checks that the stored length follows the new blocks and
+// that it is recomputed when opening a database without it.
+func TestBadgerLength(t *testing.T) {
+	dir := "../../test/blockchain/badger-length"
+	chain, err := NewBadgerChain(dir, WithDifficulty(4))
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), chain.Length())
+	for i := 0; i < 3; i++ {
+		_, err = chain.AddBlock([]byte("this is a testing block"))
+		require.NoError(t, err)
+	}
+	require.Equal(t, uint64(4), chain.Length())
+
+	// Remove the length and reopen the database
+	err = chain.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(chain.lengthKey)
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), chain.Length())
+	require.NoError(t, chain.Close())
+
+	chain, err = NewBadgerChain(dir, WithDifficulty(4))
+	require.NoError(t, err)
+	err = chain.db.View(func(txn *badger.Txn) error {
+		length, err := chain.getLength(txn)
+		require.Equal(t, uint64(4), length)
+		return err
+	})
+	require.NoError(t, err)
+	require.NoError(t, chain.Destroy())
+}
+
+// TestBadgerBlockIndex checks that the blocks are listed by height when
+// opening a database without the list, so the rollback finds the branches.
+func TestBadgerBlockIndex(t *testing.T) {
+	dir := "../../test/blockchain/badger-blocks"
+	chain, err := NewBadgerChain(dir, WithDifficulty(4))
+	require.NoError(t, err)
+	genesis, err := chain.GetBlockByHeight(0)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = chain.AddBlock([]byte("this is a testing block"))
+		require.NoError(t, err)
+	}
+	branch := NewBlock([][]byte{[]byte("branch")}, genesis, 4)
+	_, err = chain.ImportBlock(branch)
+	require.NoError(t, err)
+
+	// Remove the list of blocks and reopen the database
+	require.NoError(t, chain.db.DropPrefix(chain.blockPrefix))
+	require.NoError(t, chain.Close())
+
+	chain, err = NewBadgerChain(dir, WithDifficulty(4))
+	require.NoError(t, err)
+	err = chain.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(chain.blockKey(branch.Height, branch.Hash))
+		return err
+	})
+	require.NoError(t, err)
+
+	// The branch above the height is removed with the canonical blocks
+	removed, err := chain.RollbackTo(0)
+	require.NoError(t, err)
+	require.Len(t, removed, 3)
+	_, err = chain.GetBlock(branch.Hash)
+	require.Equal(t, ErrBlockNotFound, err)
+	require.NoError(t, chain.Destroy())
+}
+
 // TestSliceBlockchain runs the test suite for the slice of blocks
 // backend.
 func TestSliceBlockchain(t *testing.T) {
@@ -115,6 +788,43 @@ func TestBadgerBlockchain(t *testing.T) {
 	// Run a new test suite for this blockchain
 	badgerChainTestSuite := ChainTestSuite{
 		chain: chain,
+		reopen: func() (Chain, error) {
+			return NewBadgerChain("../../test/blockchain/badger")
+		},
 	}
 	suite.Run(t, &badgerChainTestSuite)
 }
+
+// TestFileBlockchain runs the test suite for the segment files backend.
+func TestFileBlockchain(t *testing.T) {
+	// Initiliaze a new blockchain stored in temporal segment files. They will
+	// be removed when the tests are done.
+	chain, err := NewFileChain("../../test/blockchain/file")
+	require.NoError(t, err)
+
+	// Run a new test suite for this blockchain
+	fileChainTestSuite := ChainTestSuite{
+		chain: chain,
+		reopen: func() (Chain, error) {
+			return NewFileChain("../../test/blockchain/file")
+		},
+	}
+	suite.Run(t, &fileChainTestSuite)
+}
+
+// TestSQLiteBlockchain runs the test suite for the SQLite database backend.
+func TestSQLiteBlockchain(t *testing.T) {
+	// Initiliaze a new blockchain stored in a temporal SQLite database. It will
+	// be removed when the tests are done.
+	chain, err := NewSQLiteChain("../../test/blockchain/sqlite.db")
+	require.NoError(t, err)
+
+	// Run a new test suite for this blockchain
+	sqliteChainTestSuite := ChainTestSuite{
+		chain: chain,
+		reopen: func() (Chain, error) {
+			return NewSQLiteChain("../../test/blockchain/sqlite.db")
+		},
+	}
+	suite.Run(t, &sqliteChainTestSuite)
+}
@@ -0,0 +1,273 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"math"
+)
+
+// Block encoding format. Every encoded block starts with the magic byte
+// followed by the format version, so it can be told apart from the legacy gob
+// encoding: a gob stream never starts with the magic byte.
+const (
+	EncodingMagic   byte = 0xBC
+	EncodingVersion byte = 0x01
+)
+
+// ErrInvalidEncoding error when an encoded block is truncated or malformed, or
+// when a block has a field too large for the binary encoding.
+var ErrInvalidEncoding = errors.New("blockchain: invalid block encoding")
+
+// ErrLegacyBlock error when a block encoded with gob by the first version is
+// decoded. Those blocks have no header, so they cannot be converted.
+var ErrLegacyBlock = errors.New("blockchain: legacy block without header")
+
+// ErrUnsupportedEncoding error when the format version of an encoded block is
+// not supported.
+var ErrUnsupportedEncoding = errors.New("blockchain: unsupported block encoding")
+
+// Codec converts blocks to and from slices of bytes. The name identifies the
+// codec in the metadata of the storage backends, so it must be unique.
+type Codec interface {
+	Name() string
+	Encode(b *Block) ([]byte, error)
+	Decode(data []byte) (*Block, error)
+}
+
+// BinaryCodec encodes blocks with the canonical binary encoding, the one used
+// by Block.Serialize. Blocks encoded with gob can be decoded too.
+type BinaryCodec struct{}
+
+// Name returns the identifier of the codec.
+func (BinaryCodec) Name() string {
+	return "binary"
+}
+
+// Encode converts the block in the canonical binary encoding.
+func (BinaryCodec) Encode(b *Block) ([]byte, error) {
+	return encodeBlock(b)
+}
+
+// Decode converts the canonical binary encoding in a block.
+func (BinaryCodec) Decode(data []byte) (*Block, error) {
+	return decodeBlock(data)
+}
+
+// GobCodec encodes blocks with the gob library, the encoding used by older
+// versions. It is only readable from Go.
+type GobCodec struct{}
+
+// Name returns the identifier of the codec.
+func (GobCodec) Name() string {
+	return "gob"
+}
+
+// Encode converts the block in a gob stream.
+func (GobCodec) Encode(b *Block) ([]byte, error) {
+	buffer := new(bytes.Buffer)
+	err := gob.NewEncoder(buffer).Encode(b)
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// Decode converts a gob stream in a block.
+func (GobCodec) Decode(data []byte) (*Block, error) {
+	return decodeGobBlock(data)
+}
+
+// JSONCodec encodes blocks in json format, the one printed by Block.String.
+// The records are encoded in base64.
+type JSONCodec struct{}
+
+// Name returns the identifier of the codec.
+func (JSONCodec) Name() string {
+	return "json"
+}
+
+// Encode converts the block in json format.
+func (JSONCodec) Encode(b *Block) ([]byte, error) {
+	return json.Marshal(b)
+}
+
+// Decode converts a block in json format in a block.
+func (JSONCodec) Decode(data []byte) (*Block, error) {
+	block := Block{}
+	err := json.Unmarshal(data, &block)
+	if err != nil {
+		return nil, err
+	}
+	return &block, nil
+}
+
+// encodeBlock encodes the block in the canonical binary format. The header is
+// encoded as it is hashed, followed by the nonce, the hash and the records.
+// All the integers are big-endian and the variable-length fields are prefixed
+// with their length:
+//
+// magic (1) | format version (1) | header payload | nonce (4) |
+// len(hash) (2) | hash | len(records) (4) | len(record) (4) | record | ...
+//
+// The header payload is described in BlockHeader.payload. ErrInvalidEncoding
+// is returned if a field does not fit in its length prefix.
+func encodeBlock(b *Block) ([]byte, error) {
+	if len(b.PrevHash) > math.MaxUint16 || len(b.MerkleRoot) > math.MaxUint16 ||
+		len(b.Hash) > math.MaxUint16 || b.Difficulty > math.MaxUint16 ||
+		uint64(len(b.Records)) > math.MaxUint32 {
+		return nil, ErrInvalidEncoding
+	}
+	for _, record := range b.Records {
+		if uint64(len(record)) > math.MaxUint32 {
+			return nil, ErrInvalidEncoding
+		}
+	}
+
+	buffer := new(bytes.Buffer)
+	buffer.WriteByte(EncodingMagic)
+	buffer.WriteByte(EncodingVersion)
+	buffer.Write(b.BlockHeader.payload())
+	binary.Write(buffer, binary.BigEndian, b.Nonce)
+	binary.Write(buffer, binary.BigEndian, uint16(len(b.Hash)))
+	buffer.WriteString(b.Hash)
+	binary.Write(buffer, binary.BigEndian, uint32(len(b.Records)))
+	for _, record := range b.Records {
+		binary.Write(buffer, binary.BigEndian, uint32(len(record)))
+		buffer.Write(record)
+	}
+	return buffer.Bytes(), nil
+}
+
+// decodeBlock decodes a block encoded in the canonical binary format. Blocks
+// encoded with gob by older versions are decoded too.
+func decodeBlock(data []byte) (*Block, error) {
+	if len(data) == 0 || data[0] != EncodingMagic {
+		return decodeGobBlock(data)
+	}
+	if len(data) < 2 || data[1] != EncodingVersion {
+		return nil, ErrUnsupportedEncoding
+	}
+
+	decoder := blockDecoder{data: data[2:]}
+	block := Block{}
+	block.Version = decoder.uint32()
+	block.Height = decoder.uint64()
+	block.Timestamp = int64(decoder.uint64())
+	block.PrevHash = string(decoder.bytes(int(decoder.uint16())))
+	block.MerkleRoot = string(decoder.bytes(int(decoder.uint16())))
+	block.Difficulty = uint(decoder.uint16())
+	block.Nonce = int32(decoder.uint32())
+	block.Hash = string(decoder.bytes(int(decoder.uint16())))
+
+	// Every record takes 4 bytes at least, do not trust the count to allocate
+	count := decoder.uint32()
+	if uint64(count)*4 > uint64(len(decoder.data)) {
+		return nil, ErrInvalidEncoding
+	}
+	block.Records = make([][]byte, count)
+	for i := range block.Records {
+		record := decoder.bytes(int(decoder.uint32()))
+		block.Records[i] = append([]byte{}, record...)
+	}
+
+	// The whole data must be consumed
+	if decoder.err != nil || len(decoder.data) > 0 {
+		return nil, ErrInvalidEncoding
+	}
+
+	return &block, nil
+}
+
+// decodeGobBlock decodes a block encoded with the gob library, the encoding
+// used by older versions. Blocks of the first version have no header and
+// ErrLegacyBlock is returned for them.
+func decodeGobBlock(data []byte) (*Block, error) {
+	legacy := legacyBlock{}
+	decoder := gob.NewDecoder(bytes.NewBuffer(data))
+	err := decoder.Decode(&legacy)
+	if err != nil {
+		return nil, err
+	}
+	return legacy.block()
+}
+
+// legacyBlock has the fields of the blocks encoded with gob by older versions.
+// The gob library matches the fields by name, so it decodes both the blocks of
+// the first version, which only had the data, the hash, the previous hash and
+// the nonce, and the blocks with a header and records.
+type legacyBlock struct {
+	// Fields of the first version
+	Data     []byte
+	PrevHash string
+	Nonce    int32
+
+	// Fields of the blocks with a header
+	BlockHeader *BlockHeader
+	Records     [][]byte
+
+	Hash string
+}
+
+// block converts the legacy block in a block. The blocks of the first version
+// lack the height, the timestamp, the merkle root and the difficulty, and
+// their hash does not cover a header, so ErrLegacyBlock is returned for them.
+func (b *legacyBlock) block() (*Block, error) {
+	if b.BlockHeader == nil || b.Data != nil {
+		return nil, ErrLegacyBlock
+	}
+
+	block := Block{
+		BlockHeader: *b.BlockHeader,
+		Hash:        b.Hash,
+		Records:     b.Records,
+	}
+	return &block, nil
+}
+
+// blockDecoder reads the fields of an encoded block. Once the data is
+// exhausted, every read returns a zero value and the error is kept.
+type blockDecoder struct {
+	data []byte
+	err  error
+}
+
+// bytes reads the next n bytes.
+func (d *blockDecoder) bytes(n int) []byte {
+	if d.err != nil || n > len(d.data) {
+		d.err = ErrInvalidEncoding
+		return nil
+	}
+	value := d.data[:n]
+	d.data = d.data[n:]
+	return value
+}
+
+// uint16 reads the next big-endian uint16.
+func (d *blockDecoder) uint16() uint16 {
+	value := d.bytes(2)
+	if value == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(value)
+}
+
+// uint32 reads the next big-endian uint32.
+func (d *blockDecoder) uint32() uint32 {
+	value := d.bytes(4)
+	if value == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(value)
+}
+
+// uint64 reads the next big-endian uint64.
+func (d *blockDecoder) uint64() uint64 {
+	value := d.bytes(8)
+	if value == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(value)
+}
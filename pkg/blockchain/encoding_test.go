@@ -0,0 +1,323 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	badger "github.com/dgraph-io/badger/v3"
+	"github.com/stretchr/testify/require"
+)
+
+// gobHeaderBlock has the layout of the blocks encoded with gob by the versions
+// with a header, before the binary encoding.
+type gobHeaderBlock struct {
+	BlockHeader gobHeader
+	Hash        string
+	Records     [][]byte
+}
+
+// gobHeader has the layout of the header of gobHeaderBlock.
+type gobHeader struct {
+	Version    uint32
+	Height     uint64
+	Timestamp  int64
+	PrevHash   string
+	MerkleRoot string
+	Difficulty uint
+	Nonce      int32
+}
+
+// gobFirstBlock has the layout of the blocks encoded with gob by the first
+// version.
+type gobFirstBlock struct {
+	Data     []byte
+	Hash     string
+	PrevHash string
+	Nonce    int32
+}
+
+// gobEncode encodes the block with the legacy gob encoding, using the layout
+// of the versions with a header.
+func gobEncode(t *testing.T, block *Block) []byte {
+	legacy := gobHeaderBlock{
+		BlockHeader: gobHeader{
+			Version:    block.Version,
+			Height:     block.Height,
+			Timestamp:  block.Timestamp,
+			PrevHash:   block.PrevHash,
+			MerkleRoot: block.MerkleRoot,
+			Difficulty: block.Difficulty,
+			Nonce:      block.Nonce,
+		},
+		Hash:    block.Hash,
+		Records: block.Records,
+	}
+	buffer := new(bytes.Buffer)
+	require.NoError(t, gob.NewEncoder(buffer).Encode(legacy))
+	return buffer.Bytes()
+}
+
+// gobEncodeFirst encodes a block of the first version with gob.
+func gobEncodeFirst(t *testing.T, data []byte, prevHash string) []byte {
+	legacy := gobFirstBlock{
+		Data:     data,
+		Hash:     "00005985b00e566bd5679ee10741ffa3c4cd50cbad545cb8d00c90537bc8498c",
+		PrevHash: prevHash,
+		Nonce:    42,
+	}
+	buffer := new(bytes.Buffer)
+	require.NoError(t, gob.NewEncoder(buffer).Encode(legacy))
+	return buffer.Bytes()
+}
+
+// TestBlockEncoding tests the canonical binary encoding of a block.
+func TestBlockEncoding(t *testing.T) {
+	block := Block{
+		BlockHeader: genesisHeader(),
+		Hash:        "00005985b00e566bd5679ee10741ffa3c4cd50cbad545cb8d00c90537bc8498c",
+		Records:     [][]byte{[]byte("Genesis")},
+	}
+	encoded := "bc01" +
+		// Header payload
+		"00000001" + "0000000000000000" + "16c69999c8bd0000" + "0000" +
+		"0040" + hex.EncodeToString([]byte(block.MerkleRoot)) + "0010" +
+		// Nonce and hash
+		"00000000" + "0040" + hex.EncodeToString([]byte(block.Hash)) +
+		// Records
+		"00000001" + "00000007" + hex.EncodeToString([]byte("Genesis"))
+
+	blockBytes, err := block.Serialize()
+	require.NoError(t, err)
+	require.Equal(t, encoded, hex.EncodeToString(blockBytes))
+	require.Equal(t, block.payload(), blockBytes[2:2+len(block.payload())])
+
+	decodedBlock := Block{}
+	require.NoError(t, decodedBlock.Deserialize(blockBytes))
+	require.Equal(t, block, decodedBlock)
+
+	// Blocks encoded with gob by the versions with a header can still be
+	// decoded
+	block.Height = 7
+	block.PrevHash = "0000e7b0f3fd0a2fc0a4bb53e1dc3ef0c0b8da6cbeb0adfd2a5c93d5b7d0dc4b"
+	block.Records = append(block.Records, []byte("this is a testing record"))
+	decodedBlock = Block{}
+	require.NoError(t, decodedBlock.Deserialize(gobEncode(t, &block)))
+	require.Equal(t, block, decodedBlock)
+	require.Equal(t, uint64(7), decodedBlock.Height)
+	require.Equal(t, block.Hash, decodedBlock.Hash)
+	require.Equal(t, block.Records, decodedBlock.Records)
+
+	// Blocks of the first version have no header to convert
+	decodedBlock = Block{}
+	err = decodedBlock.Deserialize(gobEncodeFirst(t, []byte("Genesis"), ""))
+	require.Equal(t, ErrLegacyBlock, err)
+
+	// Fields too large for their length prefix cannot be encoded
+	block.Difficulty = 1 << 16
+	_, err = block.Serialize()
+	require.Equal(t, ErrInvalidEncoding, err)
+}
+
+// TestBlockEncodingErrors tests the errors reported when decoding malformed
+// blocks.
+func TestBlockEncodingErrors(t *testing.T) {
+	block := NewBlock([][]byte{[]byte("this is a testing block")}, nil, 4)
+	blockBytes, err := block.Serialize()
+	require.NoError(t, err)
+
+	var tests = []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{
+			name: "truncated block",
+			data: blockBytes[:len(blockBytes)-1],
+			err:  ErrInvalidEncoding,
+		},
+		{
+			name: "trailing data",
+			data: append(append([]byte{}, blockBytes...), 0x00),
+			err:  ErrInvalidEncoding,
+		},
+		{
+			name: "missing version",
+			data: []byte{EncodingMagic},
+			err:  ErrUnsupportedEncoding,
+		},
+		{
+			name: "unsupported version",
+			data: append([]byte{EncodingMagic, 0x02}, blockBytes[2:]...),
+			err:  ErrUnsupportedEncoding,
+		},
+		{
+			name: "too many records",
+			data: append(append([]byte{}, blockBytes[:len(blockBytes)-31]...),
+				0xff, 0xff, 0xff, 0xff),
+			err: ErrInvalidEncoding,
+		},
+	}
+
+	for _, test := range tests {
+		decodedBlock := Block{}
+		err := decodedBlock.Deserialize(test.data)
+		require.Equal(t, test.err, err, test.name)
+	}
+}
+
+// TestCodecs tests the serialization of a block with every codec.
+func TestCodecs(t *testing.T) {
+	block := NewBlock([][]byte{[]byte("this is a testing block"),
+		[]byte("this is another testing record")}, FirstBlock(4), 4)
+
+	codecs := []Codec{BinaryCodec{}, GobCodec{}, JSONCodec{}, ProtoCodec{}}
+	names := map[string]bool{}
+	for _, codec := range codecs {
+		blockBytes, err := block.SerializeWith(codec)
+		require.NoError(t, err, codec.Name())
+
+		deserializedBlock := Block{}
+		err = deserializedBlock.DeserializeWith(codec, blockBytes)
+		require.NoError(t, err, codec.Name())
+		require.Equal(t, *block, deserializedBlock, codec.Name())
+
+		// The names identify the codecs
+		require.False(t, names[codec.Name()], codec.Name())
+		names[codec.Name()] = true
+	}
+}
+
+// TestBadgerMigrate checks that the blocks stored with gob are rewritten with
+// the canonical binary encoding without losing data.
+func TestBadgerMigrate(t *testing.T) {
+	chain, err := NewBadgerChain("../../test/blockchain/badger-migrate",
+		WithDifficulty(4))
+	require.NoError(t, err)
+	defer chain.Destroy()
+
+	blocks := []*Block{}
+	for i := 0; i < 3; i++ {
+		block, err := chain.AddBlock([]byte("this is a testing block"),
+			[]byte(fmt.Sprintf("this is testing record %d", i)))
+		require.NoError(t, err)
+		blocks = append(blocks, block)
+	}
+
+	// Store the blocks and the last block with gob as older versions did
+	err = chain.db.Update(func(txn *badger.Txn) error {
+		for _, block := range blocks {
+			err := txn.Set([]byte(block.Hash), gobEncode(t, block))
+			if err != nil {
+				return err
+			}
+		}
+		return txn.Set(chain.lastBlockKey, gobEncode(t, blocks[2]))
+	})
+	require.NoError(t, err)
+	require.NoError(t, chain.Verify())
+
+	// isMigrated checks if the entry is stored with the binary encoding
+	isMigrated := func(key []byte) bool {
+		var blockRaw []byte
+		err := chain.db.View(func(txn *badger.Txn) error {
+			item, err := txn.Get(key)
+			if err != nil {
+				return err
+			}
+			blockRaw, err = item.ValueCopy(nil)
+			return err
+		})
+		require.NoError(t, err)
+		return blockRaw[0] == EncodingMagic
+	}
+
+	// Nothing is rewritten while a block of the first version is stored
+	firstBlock := gobEncodeFirst(t, []byte("this is a testing block"),
+		blocks[0].PrevHash)
+	err = chain.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(blocks[0].Hash), firstBlock)
+	})
+	require.NoError(t, err)
+	_, err = chain.Migrate()
+	require.Equal(t, ErrLegacyBlock, err)
+	require.False(t, isMigrated(chain.lastBlockKey))
+	for _, block := range blocks[1:] {
+		require.False(t, isMigrated([]byte(block.Hash)))
+	}
+
+	// Only the gob encoded entries are migrated
+	err = chain.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(blocks[0].Hash), gobEncode(t, blocks[0]))
+	})
+	require.NoError(t, err)
+	migrated, err := chain.Migrate()
+	require.NoError(t, err)
+	require.Equal(t, 4, migrated)
+	require.True(t, isMigrated(chain.lastBlockKey))
+
+	// The records, the height and the hash are kept
+	for _, block := range blocks {
+		require.True(t, isMigrated([]byte(block.Hash)))
+		migratedBlock, err := chain.GetBlock(block.Hash)
+		require.NoError(t, err)
+		require.Equal(t, block, migratedBlock)
+		require.Equal(t, block.Records, migratedBlock.Records)
+		require.Equal(t, block.Height, migratedBlock.Height)
+		require.Equal(t, block.Hash, migratedBlock.Hash)
+	}
+	lastBlock, err := chain.GetLastBlock()
+	require.NoError(t, err)
+	require.Equal(t, blocks[2], lastBlock)
+	require.NoError(t, chain.Verify())
+
+	migrated, err = chain.Migrate()
+	require.NoError(t, err)
+	require.Equal(t, 0, migrated)
+}
+
+// TestBadgerChainCodec checks that a database can only be opened with the
+// codec used to create it.
+func TestBadgerChainCodec(t *testing.T) {
+	dir := "../../test/blockchain/badger-codec"
+	for _, codec := range []Codec{GobCodec{}, JSONCodec{}, ProtoCodec{}} {
+		chain, err := NewBadgerChain(dir, WithDifficulty(4), WithCodec(codec))
+		require.NoError(t, err, codec.Name())
+		_, err = chain.AddBlock([]byte("this is a testing block"))
+		require.NoError(t, err, codec.Name())
+		require.NoError(t, chain.Close(), codec.Name())
+
+		// Open the database with a different codec
+		_, err = NewBadgerChain(dir, WithDifficulty(4))
+		require.Equal(t, ErrInvalidCodec, err, codec.Name())
+
+		// Open the database with the same codec
+		chain, err = NewBadgerChain(dir, WithDifficulty(4), WithCodec(codec))
+		require.NoError(t, err, codec.Name())
+		require.Equal(t, uint64(2), chain.Length(), codec.Name())
+		require.NoError(t, chain.Verify(), codec.Name())
+		require.NoError(t, chain.Destroy(), codec.Name())
+	}
+
+	// Databases without codec were written with the binary codec
+	chain, err := NewBadgerChain(dir, WithDifficulty(4))
+	require.NoError(t, err)
+	err = chain.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(chain.codecKey)
+	})
+	require.NoError(t, err)
+	require.NoError(t, chain.Close())
+
+	_, err = NewBadgerChain(dir, WithDifficulty(4), WithCodec(JSONCodec{}))
+	require.Equal(t, ErrInvalidCodec, err)
+	chain, err = NewBadgerChain(dir, WithDifficulty(4))
+	require.NoError(t, err)
+	err = chain.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(chain.codecKey)
+		return err
+	})
+	require.NoError(t, err)
+	require.NoError(t, chain.Destroy())
+}
@@ -0,0 +1,1159 @@
+package blockchain
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/samuelvl/blockchain-lab/pkg/pow"
+)
+
+// DefaultSegmentSize is the size of the segment files of a FileChain when the
+// chain does not set one, as the blk*.dat files of Bitcoin.
+const DefaultSegmentSize int64 = 128 << 20
+
+// ErrCorruptedIndex error when the index of a FileChain points to a block that
+// cannot be read from the segment files.
+var ErrCorruptedIndex = errors.New("blockchain: corrupted file index")
+
+// ErrCorruptedRecord error when a record of the files of a FileChain does not
+// match its checksum or its size and it was not torn by a crash.
+var ErrCorruptedRecord = errors.New("blockchain: corrupted file record")
+
+// FsyncPolicy sets when a FileChain flushes its files to the disk.
+type FsyncPolicy int
+
+// Supported fsync policies. With FsyncAlways no acknowledged block is lost on
+// a crash. With FsyncOnRotate only the closed segments are flushed and with
+// FsyncNever the operating system decides; the last blocks may be lost on a
+// crash, but the chain is recovered up to the last complete record.
+const (
+	FsyncAlways FsyncPolicy = iota
+	FsyncOnRotate
+	FsyncNever
+)
+
+// Names of the files of a FileChain.
+const (
+	fileMetadataName = "chain.json"
+	fileIndexName    = "index.dat"
+	fileSegmentName  = "blk%05d.dat"
+)
+
+// Kinds of the entries of the index of a FileChain.
+const (
+	fileEntryBlock  byte = 'B'
+	fileEntryDelete byte = 'D'
+	fileEntryTip    byte = 'T'
+)
+
+// fileRecordHeader is the size of the header of every record: the size and
+// the crc32 checksum of the payload.
+const fileRecordHeader = 8
+
+// maxOpenSegments is the number of segment files kept open to read blocks. The
+// least recently used segment is closed to open another one.
+const maxOpenSegments = 16
+
+// FileChain stores the blocks in append-only segment files. Every block is a
+// record of the current segment, which is rotated when it reaches the segment
+// size. A record is the size of the payload, its crc32 checksum and the
+// payload, the block encoded with the chain's codec:
+//
+// len(payload) (4) | crc32(payload) (4) | payload
+//
+// The location, height and parent of every block are kept in a separate index
+// file made of records too. The index is a log of entries: a stored block, a
+// deleted block or a new last block. It is replayed when the chain is opened to
+// build the hash and height indexes in memory.
+//
+// Records are never rewritten, so rolled back blocks stay in the segments but
+// are deleted from the index. A record torn by a crash is truncated when the
+// chain is opened, and the complete blocks missing in the index are indexed
+// again from the segments. Only the last record of the index or of the last
+// segment can be torn by a crash; any other corrupted record, or a last record
+// followed by valid records because its size was corrupted, is reported and
+// the chain is not opened.
+type FileChain struct {
+	dir         string
+	config      *chainConfig
+	entries     map[string]*fileEntry
+	heights     []string
+	segments    map[uint32]*os.File
+	segmentLRU  []uint32
+	segmentID   uint32
+	segmentSize int64
+	index       *os.File
+	indexSize   int64
+	closed      bool
+	sync.Mutex
+}
+
+// fileEntry is the location of a block in the segment files along with the
+// fields needed to walk the chain without reading the block.
+type fileEntry struct {
+	segment    uint32
+	offset     int64
+	size       uint32
+	height     uint64
+	difficulty uint
+	prevHash   string
+	work       *big.Int
+}
+
+// fileMetadata stores the parameters of a FileChain that cannot be changed
+// once it is created.
+type fileMetadata struct {
+	Difficulty    uint   `json:"difficulty"`
+	Codec         string `json:"codec"`
+	HashAlgorithm string `json:"hashAlgorithm"`
+	ProofOfWork   string `json:"proofOfWork"`
+	Retarget      string `json:"retarget"`
+}
+
+// NewFileChain initializes a blockchain to store blocks in segment files in
+// the given directory. It will add the Genesis block as the first block of the
+// chain. If the directory is already initialized, its parameters must match
+// the configured ones as in NewBadgerChain, and the blocks are recovered from
+// its files.
+func NewFileChain(dir string, opts ...ChainOption) (*FileChain, error) {
+	// Apply the chain options
+	config, err := newChainConfig(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	chain := FileChain{
+		dir:      dir,
+		config:   config,
+		entries:  map[string]*fileEntry{},
+		heights:  []string{},
+		segments: map[uint32]*os.File{},
+	}
+
+	// Initialize the files and release them if they cannot be used
+	err = chain.init()
+	if err != nil {
+		chain.closeFiles()
+		return nil, err
+	}
+
+	return &chain, nil
+}
+
+// init checks the metadata of the chain, recovers its index and its segments,
+// and adds the Genesis block to new chains.
+func (chain *FileChain) init() error {
+	err := os.MkdirAll(chain.dir, 0755)
+	if err != nil {
+		return err
+	}
+	err = chain.checkMetadata()
+	if err != nil {
+		return err
+	}
+
+	// Replay the index and index the blocks missing in it
+	indexed, err := chain.loadIndex()
+	if err != nil {
+		return err
+	}
+	err = chain.recoverSegments(indexed)
+	if err != nil {
+		return err
+	}
+
+	// Add the Genesis block to new chains
+	if len(chain.heights) == 0 {
+		return chain.appendBlock(chain.config.firstBlock(), true)
+	}
+
+	// The Genesis block must be the given one, if any
+	if chain.config.genesis != nil &&
+		chain.heights[0] != chain.config.genesis.Hash {
+		return ErrInvalidGenesis
+	}
+
+	return nil
+}
+
+// checkMetadata compares the stored parameters of the chain with the
+// configured ones, storing them if the chain is new.
+func (chain *FileChain) checkMetadata() error {
+	metadata := fileMetadata{
+		Difficulty:    chain.config.difficulty,
+		Codec:         chain.config.codec.Name(),
+		HashAlgorithm: chain.config.algorithm.String(),
+		ProofOfWork:   chain.config.proof.Name(),
+		Retarget:      chain.config.retargetName(),
+	}
+
+	path := filepath.Join(chain.dir, fileMetadataName)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		data, err = json.Marshal(metadata)
+		if err != nil {
+			return err
+		}
+		return writeFileSync(path, data)
+	}
+	if err != nil {
+		return err
+	}
+
+	stored := fileMetadata{}
+	err = json.Unmarshal(data, &stored)
+	if err != nil {
+		return err
+	}
+	// Chains created before the retarget was stored were mined with a fixed
+	// difficulty
+	if stored.Retarget == "" {
+		stored.Retarget = "none"
+	}
+	switch {
+	case stored.Difficulty != metadata.Difficulty:
+		return ErrInvalidDifficulty
+	case stored.Codec != metadata.Codec:
+		return ErrInvalidCodec
+	case stored.HashAlgorithm != metadata.HashAlgorithm:
+		return ErrInvalidHashAlgorithm
+	case stored.ProofOfWork != metadata.ProofOfWork:
+		return ErrProofOfWorkMismatch
+	case stored.Retarget != metadata.Retarget:
+		return ErrRetargetMismatch
+	}
+
+	return nil
+}
+
+// loadIndex replays the entries of the index, truncating a torn last record.
+// It returns the end of the last indexed record of every segment, so the
+// blocks written after it can be recovered.
+func (chain *FileChain) loadIndex() (map[uint32]int64, error) {
+	index, err := os.OpenFile(filepath.Join(chain.dir, fileIndexName),
+		os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	chain.index = index
+
+	indexed := map[uint32]int64{}
+	tip := ""
+	size, err := readRecords(index, 0, true, func(payload []byte) error {
+		decoder := blockDecoder{data: payload}
+		kind := decoder.bytes(1)
+		if kind == nil {
+			return ErrCorruptedIndex
+		}
+		switch kind[0] {
+		case fileEntryBlock:
+			entry := fileEntry{}
+			entry.segment = decoder.uint32()
+			entry.offset = int64(decoder.uint64())
+			entry.size = decoder.uint32()
+			entry.height = decoder.uint64()
+			entry.difficulty = uint(decoder.uint16())
+			hash := string(decoder.bytes(int(decoder.uint16())))
+			entry.prevHash = string(decoder.bytes(int(decoder.uint16())))
+			if decoder.err != nil {
+				return ErrCorruptedIndex
+			}
+			end := entry.offset + fileRecordHeader + int64(entry.size)
+			if end > indexed[entry.segment] {
+				indexed[entry.segment] = end
+			}
+			return chain.addEntry(hash, &entry)
+		case fileEntryDelete:
+			delete(chain.entries, string(decoder.bytes(len(decoder.data))))
+		case fileEntryTip:
+			tip = string(decoder.bytes(len(decoder.data)))
+		default:
+			return ErrCorruptedIndex
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	chain.indexSize = size
+
+	// The last block must be known, otherwise the heaviest block is used
+	if _, ok := chain.entries[tip]; !ok {
+		tip = chain.heaviest()
+	}
+	if tip != "" {
+		chain.setTip(tip)
+	}
+
+	return indexed, nil
+}
+
+// recoverSegments indexes the blocks stored after the last indexed record of
+// the segments and truncates a torn last record. The last segment is opened
+// to append the new blocks.
+func (chain *FileChain) recoverSegments(indexed map[uint32]int64) error {
+	ids, err := chain.segmentIDs()
+	if err != nil {
+		return err
+	}
+
+	// The last segment is the current segment
+	if len(ids) == 0 {
+		return chain.openSegment(0)
+	}
+	err = chain.openSegment(ids[len(ids)-1])
+	if err != nil {
+		return err
+	}
+
+	// Only the segments from the last indexed one may have blocks missing in
+	// the index
+	first := 0
+	for i, id := range ids {
+		if _, ok := indexed[id]; ok {
+			first = i
+		}
+	}
+	for _, id := range ids[first:] {
+		segment, err := chain.segment(id)
+		if err != nil {
+			return err
+		}
+		offset := indexed[id]
+		size, err := readRecords(segment, offset, id == chain.segmentID,
+			func(payload []byte) error {
+				// The offset of the record is the end of the previous one
+				recordOffset := offset
+				offset += fileRecordHeader + int64(len(payload))
+
+				block, err := chain.config.codec.Decode(payload)
+				if err != nil {
+					return err
+				}
+				return chain.recoverBlock(block, id, recordOffset,
+					uint32(len(payload)))
+			})
+		if err != nil {
+			return err
+		}
+		if id == chain.segmentID {
+			chain.segmentSize = size
+		}
+	}
+
+	return nil
+}
+
+// recoverBlock indexes a block found in the segments. Blocks whose parent is
+// not known were rolled back along with their parent, so they are skipped.
+func (chain *FileChain) recoverBlock(block *Block, segment uint32, offset int64, size uint32) error {
+	if _, ok := chain.entries[block.Hash]; ok {
+		return nil
+	}
+	if _, ok := chain.entries[block.PrevHash]; !ok && block.PrevHash != "" {
+		return nil
+	}
+
+	entry := fileEntry{
+		segment:    segment,
+		offset:     offset,
+		size:       size,
+		height:     block.Height,
+		difficulty: block.Difficulty,
+		prevHash:   block.PrevHash,
+	}
+	err := chain.writeIndex(encodeFileEntry(block.Hash, &entry))
+	if err != nil {
+		return err
+	}
+	err = chain.addEntry(block.Hash, &entry)
+	if err != nil {
+		return err
+	}
+
+	// The recovered block becomes the last block if it is heavier
+	if len(chain.heights) == 0 || entry.work.Cmp(
+		chain.entries[chain.heights[len(chain.heights)-1]].work) > 0 {
+		err = chain.writeIndex(encodeFileTip(block.Hash))
+		if err != nil {
+			return err
+		}
+		chain.setTip(block.Hash)
+	}
+
+	return nil
+}
+
+// addEntry adds the block's entry to the hash index, computing its cumulative
+// work from its parent.
+func (chain *FileChain) addEntry(hash string, entry *fileEntry) error {
+	entry.work = blockWork(entry.difficulty)
+	if entry.prevHash != "" {
+		parent, ok := chain.entries[entry.prevHash]
+		if !ok {
+			return ErrCorruptedIndex
+		}
+		entry.work.Add(entry.work, parent.work)
+	}
+	chain.entries[hash] = entry
+	return nil
+}
+
+// setTip rebuilds the height index walking the chain from the given block to
+// the Genesis block.
+func (chain *FileChain) setTip(hash string) {
+	entry := chain.entries[hash]
+	heights := make([]string, entry.height+1)
+	for {
+		heights[entry.height] = hash
+		if entry.prevHash == "" {
+			break
+		}
+		hash = entry.prevHash
+		entry = chain.entries[hash]
+	}
+	chain.heights = heights
+}
+
+// heaviest returns the hash of the block with the most cumulative work.
+func (chain *FileChain) heaviest() string {
+	heaviest := ""
+	for hash, entry := range chain.entries {
+		if heaviest == "" || entry.work.Cmp(chain.entries[heaviest].work) > 0 {
+			heaviest = hash
+		}
+	}
+	return heaviest
+}
+
+// segmentIDs returns the sorted identifiers of the segment files.
+func (chain *FileChain) segmentIDs() ([]uint32, error) {
+	paths, err := filepath.Glob(filepath.Join(chain.dir, "blk*.dat"))
+	if err != nil {
+		return nil, err
+	}
+	ids := []uint32{}
+	for _, path := range paths {
+		var id uint32
+		_, err := fmt.Sscanf(filepath.Base(path), fileSegmentName, &id)
+		if err == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// openSegment opens the segment with the given identifier, creating it if it
+// does not exist, and makes it the current segment.
+func (chain *FileChain) openSegment(id uint32) error {
+	path := filepath.Join(chain.dir, fmt.Sprintf(fileSegmentName, id))
+	segment, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := segment.Stat()
+	if err != nil {
+		segment.Close()
+		return err
+	}
+	chain.segmentID = id
+	chain.segmentSize = info.Size()
+	return chain.cacheSegment(id, segment)
+}
+
+// segment returns the open segment with the given identifier, opening it if it
+// was closed. If the segment does not exist, ErrCorruptedIndex is returned.
+func (chain *FileChain) segment(id uint32) (*os.File, error) {
+	if segment, ok := chain.segments[id]; ok {
+		chain.touchSegment(id)
+		return segment, nil
+	}
+
+	path := filepath.Join(chain.dir, fmt.Sprintf(fileSegmentName, id))
+	segment, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if os.IsNotExist(err) {
+		return nil, ErrCorruptedIndex
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = chain.cacheSegment(id, segment)
+	if err != nil {
+		return nil, err
+	}
+	return segment, nil
+}
+
+// cacheSegment keeps the segment open as the most recently used one, closing
+// the least recently used segments but the current one above maxOpenSegments.
+func (chain *FileChain) cacheSegment(id uint32, segment *os.File) error {
+	chain.segments[id] = segment
+	chain.touchSegment(id)
+
+	var closeErr error
+	for i := 0; len(chain.segments) > maxOpenSegments; {
+		oldest := chain.segmentLRU[i]
+		if oldest == chain.segmentID {
+			i++
+			continue
+		}
+		err := chain.segments[oldest].Close()
+		if err != nil && closeErr == nil {
+			closeErr = err
+		}
+		delete(chain.segments, oldest)
+		chain.segmentLRU = append(chain.segmentLRU[:i],
+			chain.segmentLRU[i+1:]...)
+	}
+	return closeErr
+}
+
+// touchSegment moves the segment to the end of the least recently used list.
+func (chain *FileChain) touchSegment(id uint32) {
+	for i, used := range chain.segmentLRU {
+		if used == id {
+			chain.segmentLRU = append(chain.segmentLRU[:i],
+				chain.segmentLRU[i+1:]...)
+			break
+		}
+	}
+	chain.segmentLRU = append(chain.segmentLRU, id)
+}
+
+// rotate flushes the current segment and opens the next one.
+func (chain *FileChain) rotate() error {
+	if chain.config.fsync != FsyncNever {
+		err := chain.segments[chain.segmentID].Sync()
+		if err != nil {
+			return err
+		}
+	}
+	return chain.openSegment(chain.segmentID + 1)
+}
+
+// appendBlock stores the block in the current segment and adds it to the
+// index. If tip is true, the block becomes the last block of the chain.
+func (chain *FileChain) appendBlock(block *Block, tip bool) error {
+	payload, err := chain.config.codec.Encode(block)
+	if err != nil {
+		return err
+	}
+	record := encodeFileRecord(payload)
+
+	// Start a new segment if the record does not fit in the current one
+	if chain.segmentSize > 0 &&
+		chain.segmentSize+int64(len(record)) > chain.config.segmentSize {
+		err = chain.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	// Write the block before its index entry, so the index never points to
+	// a missing block
+	segment := chain.segments[chain.segmentID]
+	_, err = segment.WriteAt(record, chain.segmentSize)
+	if err != nil {
+		return err
+	}
+	if chain.config.fsync == FsyncAlways {
+		err = segment.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	entry := fileEntry{
+		segment:    chain.segmentID,
+		offset:     chain.segmentSize,
+		size:       uint32(len(payload)),
+		height:     block.Height,
+		difficulty: block.Difficulty,
+		prevHash:   block.PrevHash,
+	}
+	chain.segmentSize += int64(len(record))
+
+	entries := encodeFileEntry(block.Hash, &entry)
+	if tip {
+		entries = append(entries, encodeFileTip(block.Hash)...)
+	}
+	err = chain.writeIndex(entries)
+	if err != nil {
+		return err
+	}
+
+	err = chain.addEntry(block.Hash, &entry)
+	if err != nil {
+		return err
+	}
+	if tip {
+		chain.heights = append(chain.heights[:block.Height], block.Hash)
+	}
+
+	return nil
+}
+
+// writeIndex appends the records to the index file.
+func (chain *FileChain) writeIndex(records []byte) error {
+	_, err := chain.index.WriteAt(records, chain.indexSize)
+	if err != nil {
+		return err
+	}
+	chain.indexSize += int64(len(records))
+	if chain.config.fsync == FsyncAlways {
+		return chain.index.Sync()
+	}
+	return nil
+}
+
+// AddBlock adds a new block to the chain from the input records.
+func (chain *FileChain) AddBlock(records ...[]byte) (*Block, error) {
+	return chain.AddBlockContext(context.Background(), records...)
+}
+
+// AddBlockContext adds a new block to the chain from the input records. If the
+// context is done before the block is mined, pow.ErrMiningCanceled is returned
+// and the chain is left unchanged.
+func (chain *FileChain) AddBlockContext(ctx context.Context, records ...[]byte) (*Block, error) {
+	// Avoid race conditions while adding new blocks
+	chain.Lock()
+	defer chain.Unlock()
+	if chain.closed {
+		return nil, ErrChainClosed
+	}
+
+	// Compute the difficulty of the new block from its ancestors
+	prevBlock, err := chain.getBlock(chain.heights[len(chain.heights)-1])
+	if err != nil {
+		return nil, err
+	}
+	difficulty, err := chain.config.nextDifficulty(prevBlock, chain.getBlock)
+	if err != nil {
+		return nil, err
+	}
+
+	newBlock, err := NewBlockWithProof(ctx, chain.config.algorithm,
+		chain.config.proof, records, prevBlock, difficulty)
+	if err != nil {
+		return nil, err
+	}
+	err = chain.appendBlock(newBlock, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return newBlock, nil
+}
+
+// GetBlock finds and returns a block from its hash. If block is not found,
+// ErrBlockNotFound is returned.
+func (chain *FileChain) GetBlock(hash string) (*Block, error) {
+	// Avoid race conditions while reading blocks
+	chain.Lock()
+	defer chain.Unlock()
+	if chain.closed {
+		return nil, ErrChainClosed
+	}
+
+	return chain.getBlock(hash)
+}
+
+// getBlock reads a block from the segment files without locking the chain.
+// The block may be part of the canonical chain or of a competing branch.
+func (chain *FileChain) getBlock(hash string) (*Block, error) {
+	entry, ok := chain.entries[hash]
+	if !ok {
+		return nil, ErrBlockNotFound
+	}
+	segment, err := chain.segment(entry.segment)
+	if err != nil {
+		return nil, err
+	}
+
+	record := make([]byte, fileRecordHeader+int(entry.size))
+	_, err = segment.ReadAt(record, entry.offset)
+	if err != nil {
+		return nil, ErrCorruptedIndex
+	}
+	payload, ok := decodeFileRecord(record)
+	if !ok {
+		return nil, ErrCorruptedIndex
+	}
+
+	return chain.config.codec.Decode(payload)
+}
+
+// GetBlockByHeight finds and returns a block from its height. If block is not
+// found, ErrBlockNotFound is returned.
+func (chain *FileChain) GetBlockByHeight(height uint64) (*Block, error) {
+	// Avoid race conditions while reading blocks
+	chain.Lock()
+	defer chain.Unlock()
+	if chain.closed {
+		return nil, ErrChainClosed
+	}
+
+	if height >= uint64(len(chain.heights)) {
+		return nil, ErrBlockNotFound
+	}
+
+	return chain.getBlock(chain.heights[height])
+}
+
+// GetLastBlock returns the last block of the chain.
+func (chain *FileChain) GetLastBlock() (*Block, error) {
+	// Avoid race conditions while reading blocks
+	chain.Lock()
+	defer chain.Unlock()
+	if chain.closed {
+		return nil, ErrChainClosed
+	}
+
+	if len(chain.heights) == 0 {
+		return nil, ErrBlockNotFound
+	}
+
+	return chain.getBlock(chain.heights[len(chain.heights)-1])
+}
+
+// GetWork returns the cumulative work of the chain ending in the block with
+// the given hash. If block is not found, ErrBlockNotFound is returned.
+func (chain *FileChain) GetWork(hash string) (*big.Int, error) {
+	// Avoid race conditions while reading blocks
+	chain.Lock()
+	defer chain.Unlock()
+	if chain.closed {
+		return nil, ErrChainClosed
+	}
+
+	entry, ok := chain.entries[hash]
+	if !ok {
+		return nil, ErrBlockNotFound
+	}
+
+	return new(big.Int).Set(entry.work), nil
+}
+
+// ImportBlock adds a block mined outside the chain on top of any known block.
+// If the branch of the new block has more cumulative work than the canonical
+// chain, it becomes the canonical chain and the reorganization is returned.
+//
+// The block is validated before storing it. ErrDuplicateBlock is returned if
+// the block is already in the chain, ErrUnknownParent if its parent is not,
+// and ErrInvalidProofOfWork if its hash or nonce are not valid.
+func (chain *FileChain) ImportBlock(block *Block) (*Reorg, error) {
+	// Avoid race conditions while adding new blocks
+	chain.Lock()
+	defer chain.Unlock()
+	if chain.closed {
+		return nil, ErrChainClosed
+	}
+
+	if _, ok := chain.entries[block.Hash]; ok {
+		return nil, ErrDuplicateBlock
+	}
+
+	// The block must be a valid child of a known block
+	parent, err := chain.getBlock(block.PrevHash)
+	if err == ErrBlockNotFound {
+		return nil, ErrUnknownParent
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = checkImport(block, parent, chain.config, chain.getBlock)
+	if err != nil {
+		return nil, err
+	}
+	err = chain.appendBlock(block, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep the canonical chain unless the new branch is heavier
+	oldTipHash := chain.heights[len(chain.heights)-1]
+	if chain.entries[block.Hash].work.Cmp(chain.entries[oldTipHash].work) <= 0 {
+		return nil, nil
+	}
+	oldHeights := chain.heights
+	err = chain.writeIndex(encodeFileTip(block.Hash))
+	if err != nil {
+		return nil, err
+	}
+	chain.setTip(block.Hash)
+
+	// The fork is the highest block shared by both branches
+	forkHeight := block.Height - 1
+	for forkHeight >= uint64(len(oldHeights)) ||
+		oldHeights[forkHeight] != chain.heights[forkHeight] {
+		forkHeight--
+	}
+
+	// Extending the canonical chain is not a reorganization
+	if forkHeight+1 == uint64(len(oldHeights)) {
+		return nil, nil
+	}
+
+	reorg := Reorg{NewTip: block}
+	reorg.Fork, err = chain.getBlock(chain.heights[forkHeight])
+	if err != nil {
+		return nil, err
+	}
+	reorg.OldTip, err = chain.getBlock(oldTipHash)
+	if err != nil {
+		return nil, err
+	}
+	reorg.Removed, err = chain.getBlocks(oldHeights[forkHeight+1:])
+	if err != nil {
+		return nil, err
+	}
+	reorg.Added, err = chain.getBlocks(chain.heights[forkHeight+1:])
+	if err != nil {
+		return nil, err
+	}
+
+	return &reorg, nil
+}
+
+// getBlocks reads the blocks with the given hashes.
+func (chain *FileChain) getBlocks(hashes []string) ([]*Block, error) {
+	blocks := make([]*Block, len(hashes))
+	for i, hash := range hashes {
+		block, err := chain.getBlock(hash)
+		if err != nil {
+			return nil, err
+		}
+		blocks[i] = block
+	}
+	return blocks, nil
+}
+
+// RollbackTo removes the blocks above the given height, so the block at that
+// height becomes the last block. The removed blocks of the canonical chain are
+// returned sorted by height. The blocks of the competing branches above the
+// height are discarded too. The blocks are only deleted from the index, the
+// segment files are never rewritten.
+func (chain *FileChain) RollbackTo(height uint64) ([]*Block, error) {
+	return chain.rollbackTo(height, "")
+}
+
+// rollbackTo removes the blocks above the height as RollbackTo. If the hash is
+// not empty, it must be the hash of the canonical block at that height when
+// the chain is locked, otherwise ErrBlockNotFound is returned.
+func (chain *FileChain) rollbackTo(height uint64, hash string) ([]*Block, error) {
+	// Avoid race conditions while removing blocks
+	chain.Lock()
+	defer chain.Unlock()
+	if chain.closed {
+		return nil, ErrChainClosed
+	}
+
+	// The block must be the canonical one at the height
+	if hash != "" && (height >= uint64(len(chain.heights)) ||
+		chain.heights[height] != hash) {
+		return nil, ErrBlockNotFound
+	}
+
+	// Nothing to remove above the last block
+	if height+1 >= uint64(len(chain.heights)) {
+		return []*Block{}, nil
+	}
+
+	removed, err := chain.getBlocks(chain.heights[height+1:])
+	if err != nil {
+		return nil, err
+	}
+
+	// Delete every block above the height and set the new last block
+	entries := []byte{}
+	for hash, entry := range chain.entries {
+		if entry.height > height {
+			entries = append(entries, encodeFileDelete(hash)...)
+		}
+	}
+	entries = append(entries, encodeFileTip(chain.heights[height])...)
+	err = chain.writeIndex(entries)
+	if err != nil {
+		return nil, err
+	}
+	for hash, entry := range chain.entries {
+		if entry.height > height {
+			delete(chain.entries, hash)
+		}
+	}
+	chain.heights = chain.heights[:height+1]
+
+	return removed, nil
+}
+
+// Close flushes the index and the current segment to the disk, unless the
+// fsync policy is FsyncNever, and closes the files. The blocks are kept, so the
+// chain can be opened again with NewFileChain. Blocks being added finish before
+// the files are closed, and the methods called after Close return
+// ErrChainClosed.
+func (chain *FileChain) Close() error {
+	// Wait for the blocks being added
+	chain.Lock()
+	defer chain.Unlock()
+
+	if chain.closed {
+		return nil
+	}
+	chain.closed = true
+
+	if chain.config.fsync != FsyncNever {
+		err := chain.index.Sync()
+		if err != nil {
+			chain.closeFiles()
+			return err
+		}
+		err = chain.segments[chain.segmentID].Sync()
+		if err != nil {
+			chain.closeFiles()
+			return err
+		}
+	}
+	return chain.closeFiles()
+}
+
+// Destroy removes all the blocks from the chain, deleting its directory.
+func (chain *FileChain) Destroy() error {
+	// Avoid race conditions while removing blocks
+	chain.Lock()
+	defer chain.Unlock()
+
+	chain.closed = true
+	err := chain.closeFiles()
+	if err != nil {
+		return err
+	}
+	chain.entries = map[string]*fileEntry{}
+	chain.heights = []string{}
+
+	return os.RemoveAll(chain.dir)
+}
+
+// closeFiles closes the index and the segment files.
+func (chain *FileChain) closeFiles() error {
+	var closeErr error
+	if chain.index != nil {
+		closeErr = chain.index.Close()
+		chain.index = nil
+	}
+	for id, segment := range chain.segments {
+		err := segment.Close()
+		if err != nil && closeErr == nil {
+			closeErr = err
+		}
+		delete(chain.segments, id)
+	}
+	chain.segmentLRU = nil
+	return closeErr
+}
+
+// HashAlgorithm returns the hash algorithm used to mine the blocks of the
+// chain.
+func (chain *FileChain) HashAlgorithm() pow.Algorithm {
+	return chain.config.algorithm
+}
+
+// ProofOfWork returns the Proof of Work used to mine the blocks of the chain.
+func (chain *FileChain) ProofOfWork() pow.ProofOfWork {
+	return chain.config.proof
+}
+
+// Length returns the total size of the blockchain. It is 0 once the chain is
+// closed.
+func (chain *FileChain) Length() uint64 {
+	// Avoid race conditions while reading blocks
+	chain.Lock()
+	defer chain.Unlock()
+	if chain.closed {
+		return 0
+	}
+
+	return uint64(len(chain.heights))
+}
+
+// NewIterator initializes the blockchain iterator from the last block.
+func (chain *FileChain) NewIterator() (*ChainIterator, error) {
+	lastBlock, err := chain.GetLastBlock()
+	if err != nil {
+		return nil, err
+	}
+	iterator := ChainIterator{
+		currentHash: lastBlock.Hash,
+		chain:       chain,
+	}
+	return &iterator, nil
+}
+
+// Verify checks the integrity of the whole chain, from the last block to the
+// Genesis block. It returns a VerificationError with every invalid block found.
+func (chain *FileChain) Verify() error {
+	return verifyChain(chain, chain.config)
+}
+
+// encodeFileRecord frames the payload with its size and crc32 checksum.
+func encodeFileRecord(payload []byte) []byte {
+	record := make([]byte, fileRecordHeader+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	copy(record[fileRecordHeader:], payload)
+	return record
+}
+
+// decodeFileRecord returns the payload of a record if it is complete and its
+// checksum matches.
+func decodeFileRecord(record []byte) ([]byte, bool) {
+	if len(record) < fileRecordHeader {
+		return nil, false
+	}
+	size := binary.BigEndian.Uint32(record[0:4])
+	if uint64(len(record)-fileRecordHeader) < uint64(size) {
+		return nil, false
+	}
+	payload := record[fileRecordHeader : fileRecordHeader+int(size)]
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(record[4:8]) {
+		return nil, false
+	}
+	return payload, true
+}
+
+// readRecords calls fn with the payload of every record of the file from the
+// given offset, reading them one by one. Fewer bytes than a record header at
+// the end of the file can only be torn by a crash, so the file is truncated
+// there. If tail is true, the file is the last one written to and a corrupted
+// record running to its end was torn by a crash too, unless a valid record is
+// found after it because its size was corrupted. Any other corrupted record
+// returns ErrCorruptedRecord. It returns the size of the file once truncated.
+func readRecords(file *os.File, offset int64, tail bool, fn func(payload []byte) error) (int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	fileSize := info.Size()
+
+	header := make([]byte, fileRecordHeader)
+	for offset < fileSize {
+		if fileSize-offset < fileRecordHeader {
+			return offset, file.Truncate(offset)
+		}
+		_, err = file.ReadAt(header, offset)
+		if err != nil {
+			return 0, err
+		}
+		end := offset + fileRecordHeader +
+			int64(binary.BigEndian.Uint32(header[0:4]))
+
+		// Read the payload only if it fits in the file
+		if end <= fileSize {
+			record := make([]byte, end-offset)
+			_, err = file.ReadAt(record, offset)
+			if err != nil {
+				return 0, err
+			}
+			payload, ok := decodeFileRecord(record)
+			if ok {
+				err = fn(payload)
+				if err != nil {
+					return 0, err
+				}
+				offset = end
+				continue
+			}
+		}
+
+		// Only the last record of the last file can be torn
+		if !tail || end < fileSize {
+			return 0, ErrCorruptedRecord
+		}
+		found, err := findRecord(file, offset+fileRecordHeader, fileSize)
+		if err != nil {
+			return 0, err
+		}
+		if found {
+			return 0, ErrCorruptedRecord
+		}
+		return offset, file.Truncate(offset)
+	}
+
+	return offset, nil
+}
+
+// findRecord reports whether a complete record with a valid checksum starts
+// anywhere in the given range of the file. Records are never empty, so zeroed
+// bytes are not taken as a record.
+func findRecord(file *os.File, from, to int64) (bool, error) {
+	data := make([]byte, to-from)
+	_, err := file.ReadAt(data, from)
+	if err != nil {
+		return false, err
+	}
+	for i := range data {
+		payload, ok := decodeFileRecord(data[i:])
+		if ok && len(payload) > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// encodeFileEntry encodes the index record of a stored block.
+func encodeFileEntry(hash string, entry *fileEntry) []byte {
+	buffer := new(bytes.Buffer)
+	buffer.WriteByte(fileEntryBlock)
+	binary.Write(buffer, binary.BigEndian, entry.segment)
+	binary.Write(buffer, binary.BigEndian, uint64(entry.offset))
+	binary.Write(buffer, binary.BigEndian, entry.size)
+	binary.Write(buffer, binary.BigEndian, entry.height)
+	binary.Write(buffer, binary.BigEndian, uint16(entry.difficulty))
+	binary.Write(buffer, binary.BigEndian, uint16(len(hash)))
+	buffer.WriteString(hash)
+	binary.Write(buffer, binary.BigEndian, uint16(len(entry.prevHash)))
+	buffer.WriteString(entry.prevHash)
+	return encodeFileRecord(buffer.Bytes())
+}
+
+// encodeFileDelete encodes the index record of a deleted block.
+func encodeFileDelete(hash string) []byte {
+	return encodeFileRecord(append([]byte{fileEntryDelete}, hash...))
+}
+
+// encodeFileTip encodes the index record of a new last block.
+func encodeFileTip(hash string) []byte {
+	return encodeFileRecord(append([]byte{fileEntryTip}, hash...))
+}
+
+// writeFileSync writes the data to a temporary file and renames it to the
+// given path once flushed, so the file is never partially written.
+func writeFileSync(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
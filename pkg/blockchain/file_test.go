@@ -0,0 +1,295 @@
+package blockchain
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/samuelvl/blockchain-lab/pkg/pow"
+	"github.com/stretchr/testify/require"
+)
+
+// TestFileChainReopen checks that the blocks, the branches and the last block
+// are recovered when the files are opened again.
+func TestFileChainReopen(t *testing.T) {
+	dir := "../../test/blockchain/file-reopen"
+	chain, err := NewFileChain(dir, WithDifficulty(4))
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = chain.AddBlock([]byte("this is a testing block"))
+		require.NoError(t, err)
+	}
+	genesis, err := chain.GetBlockByHeight(0)
+	require.NoError(t, err)
+	branch := newBranch(genesis, 1)[0]
+	_, err = chain.ImportBlock(branch)
+	require.NoError(t, err)
+	_, err = chain.RollbackTo(2)
+	require.NoError(t, err)
+	lastBlock, err := chain.GetLastBlock()
+	require.NoError(t, err)
+	require.NoError(t, chain.Close())
+
+	chain, err = NewFileChain(dir, WithDifficulty(4))
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), chain.Length())
+	reopenedBlock, err := chain.GetLastBlock()
+	require.NoError(t, err)
+	require.Equal(t, lastBlock, reopenedBlock)
+	_, err = chain.GetBlock(branch.Hash)
+	require.NoError(t, err)
+	require.NoError(t, chain.Verify())
+
+	// New blocks are added on top of the last block
+	newBlock, err := chain.AddBlock([]byte("this is a testing block"))
+	require.NoError(t, err)
+	require.Equal(t, lastBlock.Hash, newBlock.PrevHash)
+
+	// The destroyed chain cannot be used anymore
+	require.NoError(t, chain.Destroy())
+	_, err = chain.AddBlock([]byte("this is a testing block"))
+	require.Equal(t, ErrChainClosed, err)
+}
+
+// TestFileChainSegments checks that a new segment is started when a block does
+// not fit in the current one.
+func TestFileChainSegments(t *testing.T) {
+	dir := "../../test/blockchain/file-segments"
+	chain, err := NewFileChain(dir, WithDifficulty(4), WithSegmentSize(512),
+		WithFsyncPolicy(FsyncOnRotate))
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err = chain.AddBlock([]byte("this is a testing block"))
+		require.NoError(t, err)
+	}
+	require.NoError(t, chain.Close())
+
+	segments, err := filepath.Glob(filepath.Join(dir, "blk*.dat"))
+	require.NoError(t, err)
+	require.Greater(t, len(segments), 1)
+	for _, segment := range segments {
+		info, err := os.Stat(segment)
+		require.NoError(t, err)
+		require.LessOrEqual(t, info.Size(), int64(512))
+	}
+
+	// The blocks are read from every segment
+	chain, err = NewFileChain(dir, WithDifficulty(4), WithSegmentSize(512))
+	require.NoError(t, err)
+	defer chain.Destroy()
+	require.Equal(t, uint64(6), chain.Length())
+	require.NoError(t, chain.Verify())
+
+	// Only the most recently used segments are kept open
+	for i := 0; i < 2*maxOpenSegments; i++ {
+		_, err = chain.AddBlock([]byte("this is a testing block"))
+		require.NoError(t, err)
+	}
+	require.NoError(t, chain.Verify())
+	ids, err := chain.segmentIDs()
+	require.NoError(t, err)
+	require.Greater(t, len(ids), maxOpenSegments)
+	require.Len(t, chain.segments, maxOpenSegments)
+	require.Contains(t, chain.segments, chain.segmentID)
+}
+
+// TestFileChainRecovery checks that torn records are truncated and that the
+// blocks missing in the index are indexed again from the segments.
+func TestFileChainRecovery(t *testing.T) {
+	dir := "../../test/blockchain/file-recovery"
+	chain, err := NewFileChain(dir, WithDifficulty(4))
+	require.NoError(t, err)
+	_, err = chain.AddBlock([]byte("this is a testing block"))
+	require.NoError(t, err)
+	indexSize := chain.indexSize
+	lastBlock, err := chain.AddBlock([]byte("this is a testing block"))
+	require.NoError(t, err)
+	segmentSize := chain.segmentSize
+	require.NoError(t, chain.Close())
+
+	// Lose the index entries of the last block and tear the last records as
+	// a crash in the middle of a write would do
+	indexPath := filepath.Join(dir, fileIndexName)
+	segmentPath := filepath.Join(dir, "blk00000.dat")
+	require.NoError(t, os.Truncate(indexPath, indexSize))
+	appendFile(t, indexPath, encodeFileTip(lastBlock.Hash)[:10])
+	appendFile(t, segmentPath, encodeFileRecord([]byte("torn record"))[:12])
+
+	chain, err = NewFileChain(dir, WithDifficulty(4))
+	require.NoError(t, err)
+	defer chain.Destroy()
+	require.Equal(t, segmentSize, chain.segmentSize)
+	require.Equal(t, uint64(3), chain.Length())
+	recoveredBlock, err := chain.GetLastBlock()
+	require.NoError(t, err)
+	require.Equal(t, lastBlock, recoveredBlock)
+	require.NoError(t, chain.Verify())
+
+	// The torn records were truncated
+	info, err := os.Stat(segmentPath)
+	require.NoError(t, err)
+	require.Equal(t, segmentSize, info.Size())
+	_, err = chain.AddBlock([]byte("this is a testing block"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), chain.Length())
+}
+
+// TestFileChainCorruption checks that only the corrupted records at the end of
+// the files are truncated.
+func TestFileChainCorruption(t *testing.T) {
+	dir := "../../test/blockchain/file-corruption"
+	defer os.RemoveAll(dir)
+	chain, err := NewFileChain(dir, WithDifficulty(4))
+	require.NoError(t, err)
+	_, err = chain.AddBlock([]byte("this is a testing block"))
+	require.NoError(t, err)
+	segmentSize := chain.segmentSize
+	require.NoError(t, chain.Close())
+
+	// A complete last record with a wrong checksum was torn by a crash
+	segmentPath := filepath.Join(dir, "blk00000.dat")
+	record := encodeFileRecord([]byte("torn record"))
+	record[len(record)-1] ^= 0xff
+	appendFile(t, segmentPath, record)
+
+	chain, err = NewFileChain(dir, WithDifficulty(4))
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), chain.Length())
+	require.Equal(t, segmentSize, chain.segmentSize)
+	require.NoError(t, chain.Close())
+
+	// A corrupted record followed by other records is not truncated
+	indexPath := filepath.Join(dir, fileIndexName)
+	index, err := os.ReadFile(indexPath)
+	require.NoError(t, err)
+	index[fileRecordHeader] ^= 0xff
+	require.NoError(t, os.WriteFile(indexPath, index, 0644))
+
+	_, err = NewFileChain(dir, WithDifficulty(4))
+	require.Equal(t, ErrCorruptedRecord, err)
+	info, err := os.Stat(indexPath)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(index)), info.Size())
+}
+
+// TestFileChainCorruptedSize checks that a record whose size was corrupted is
+// not taken as a torn record, so the records after it are not truncated.
+func TestFileChainCorruptedSize(t *testing.T) {
+	dir := "../../test/blockchain/file-corrupted-size"
+	defer os.RemoveAll(dir)
+	chain, err := NewFileChain(dir, WithDifficulty(4))
+	require.NoError(t, err)
+	genesisSize := chain.segmentSize
+	for i := 0; i < 3; i++ {
+		_, err = chain.AddBlock([]byte("this is a testing block"))
+		require.NoError(t, err)
+	}
+	require.NoError(t, chain.Close())
+
+	// The size of the first entry of the index reaches past its end
+	indexPath := filepath.Join(dir, fileIndexName)
+	index, err := os.ReadFile(indexPath)
+	require.NoError(t, err)
+	corrupted := append([]byte{}, index...)
+	corrupted[0] ^= 0x80
+	require.NoError(t, os.WriteFile(indexPath, corrupted, 0644))
+
+	_, err = NewFileChain(dir, WithDifficulty(4))
+	require.Equal(t, ErrCorruptedRecord, err)
+	info, err := os.Stat(indexPath)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(index)), info.Size())
+
+	// Without the index, the size of a block in the middle of the last
+	// segment reaches past its end
+	require.NoError(t, os.Remove(indexPath))
+	segmentPath := filepath.Join(dir, "blk00000.dat")
+	segment, err := os.ReadFile(segmentPath)
+	require.NoError(t, err)
+	corrupted = append([]byte{}, segment...)
+	corrupted[genesisSize] ^= 0x80
+	require.NoError(t, os.WriteFile(segmentPath, corrupted, 0644))
+
+	_, err = NewFileChain(dir, WithDifficulty(4))
+	require.Equal(t, ErrCorruptedRecord, err)
+	info, err = os.Stat(segmentPath)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(segment)), info.Size())
+
+	// Once repaired, every block is recovered
+	require.NoError(t, os.Remove(indexPath))
+	require.NoError(t, os.WriteFile(segmentPath, segment, 0644))
+	chain, err = NewFileChain(dir, WithDifficulty(4))
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), chain.Length())
+	require.NoError(t, chain.Verify())
+	require.NoError(t, chain.Close())
+}
+
+// TestFileChainMetadata checks that the files can only be opened with the
+// parameters used to create them.
+func TestFileChainMetadata(t *testing.T) {
+	dir := "../../test/blockchain/file-metadata"
+	chain, err := NewFileChain(dir, WithDifficulty(4))
+	require.NoError(t, err)
+	defer chain.Destroy()
+	genesis, err := chain.GetLastBlock()
+	require.NoError(t, err)
+
+	var tests = []struct {
+		opts []ChainOption
+		err  error
+	}{
+		{
+			opts: []ChainOption{WithDifficulty(5)},
+			err:  ErrInvalidDifficulty,
+		},
+		{
+			opts: []ChainOption{WithDifficulty(4), WithCodec(JSONCodec{})},
+			err:  ErrInvalidCodec,
+		},
+		{
+			opts: []ChainOption{WithDifficulty(4),
+				WithHashAlgorithm(pow.SHA3_256)},
+			err: ErrInvalidHashAlgorithm,
+		},
+		{
+			opts: []ChainOption{WithDifficulty(4),
+				WithProofOfWork(pow.NewMemoryHard(1024, pow.SHA256))},
+			err: ErrProofOfWorkMismatch,
+		},
+		{
+			opts: []ChainOption{WithDifficulty(4),
+				WithRetarget(EMARetarget{Window: 4, BlockTime: time.Minute})},
+			err: ErrRetargetMismatch,
+		},
+		{
+			opts: []ChainOption{WithDifficulty(4),
+				WithGenesis(FirstBlock(4))},
+			err: ErrInvalidGenesis,
+		},
+		{
+			opts: []ChainOption{WithDifficulty(4), WithGenesis(genesis)},
+			err:  nil,
+		},
+	}
+
+	require.NoError(t, chain.Close())
+	for _, test := range tests {
+		reopened, err := NewFileChain(dir, test.opts...)
+		require.Equal(t, test.err, err)
+		if err == nil {
+			require.NoError(t, reopened.Close())
+		}
+	}
+}
+
+// appendFile appends the data to the file.
+func appendFile(t *testing.T, path string, data []byte) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = file.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+}
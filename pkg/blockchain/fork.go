@@ -0,0 +1,109 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/samuelvl/blockchain-lab/pkg/pow"
+)
+
+// ErrUnknownParent error when the parent of an imported block is not found in
+// the chain.
+var ErrUnknownParent = errors.New("blockchain: unknown parent block")
+
+// ErrInvalidProofOfWork error when the hash or the nonce of an imported block
+// are not a valid Proof of Work of its header.
+var ErrInvalidProofOfWork = errors.New("blockchain: invalid proof of work")
+
+// ErrDuplicateBlock error when an imported block is already in the chain.
+var ErrDuplicateBlock = errors.New("blockchain: duplicate block")
+
+// Reorg reports a change of the canonical chain to a heavier branch. The Fork
+// block is the last block shared by both branches. The blocks removed from and
+// added to the canonical chain are sorted by height.
+type Reorg struct {
+	Fork    *Block
+	OldTip  *Block
+	NewTip  *Block
+	Removed []*Block
+	Added   []*Block
+}
+
+// blockWork returns the expected number of hashes to mine a block with the
+// given difficulty, this is, 2^difficulty.
+func blockWork(difficulty uint) *big.Int {
+	return new(big.Int).Lsh(big.NewInt(1), difficulty)
+}
+
+// checkImport validates a block mined outside the chain before adding it on top
+// of its parent. The block must be valid by itself, follow its parent in height
+// and time and be mined with the difficulty expected from its ancestors. An invalid hash or
+// nonce is reported as ErrInvalidProofOfWork.
+func checkImport(block, parent *Block, config *chainConfig, getBlock BlockGetter) error {
+	err := verifyImport(block, config.algorithm, config.proof)
+	if err != nil {
+		return err
+	}
+
+	if block.Height != parent.Height+1 {
+		return ErrInvalidHeight
+	}
+
+	err = checkTimestamp(block, parent)
+	if err != nil {
+		return err
+	}
+
+	difficulty, err := config.nextDifficulty(parent, getBlock)
+	if err != nil {
+		return err
+	}
+	if block.Difficulty != difficulty {
+		return ErrInvalidDifficulty
+	}
+
+	return nil
+}
+
+// verifyImport validates a block mined outside the chain by itself, reporting
+// an invalid hash or nonce as ErrInvalidProofOfWork.
+func verifyImport(block *Block, algorithm pow.Algorithm, proof pow.ProofOfWork) error {
+	err := block.VerifyWithProof(algorithm, proof)
+	if errors.Is(err, ErrInvalidHash) || errors.Is(err, ErrInvalidNonce) {
+		return fmt.Errorf("%w: %v", ErrInvalidProofOfWork, err)
+	}
+	return err
+}
+
+// RollbackToHash removes the blocks above the block with the given hash, so it
+// becomes the last block of the chain. The block must be part of the canonical
+// chain, otherwise ErrBlockNotFound is returned. The backends of this package
+// check it while the chain is locked, so a block added or a reorganization
+// in the meantime cannot make it roll back to another block.
+func RollbackToHash(chain Chain, hash string) ([]*Block, error) {
+	block, err := chain.GetBlock(hash)
+	if err != nil {
+		return nil, err
+	}
+	if rollbacker, ok := chain.(hashRollbacker); ok {
+		return rollbacker.rollbackTo(block.Height, hash)
+	}
+
+	// The block must be the canonical one at its height
+	canonical, err := chain.GetBlockByHeight(block.Height)
+	if err != nil {
+		return nil, err
+	}
+	if canonical.Hash != hash {
+		return nil, ErrBlockNotFound
+	}
+
+	return chain.RollbackTo(block.Height)
+}
+
+// hashRollbacker is implemented by the backends that check the hash of the
+// block at the rollback height while the chain is locked.
+type hashRollbacker interface {
+	rollbackTo(height uint64, hash string) ([]*Block, error)
+}
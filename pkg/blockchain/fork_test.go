@@ -0,0 +1,393 @@
+package blockchain
+
+import (
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// hashes returns the hashes of the blocks, so blocks read from different
+// backends can be compared.
+func hashes(blocks []*Block) []string {
+	blockHashes := make([]string, len(blocks))
+	for i, block := range blocks {
+		blockHashes[i] = block.Hash
+	}
+	return blockHashes
+}
+
+// testImportBlock builds two competing branches on top of the Genesis block and
+// checks that the chain switches to the heaviest one.
+func testImportBlock(t *testing.T, chain Chain) {
+	genesis, err := chain.GetLastBlock()
+	require.NoError(t, err)
+
+	// Build the canonical chain with two blocks
+	a1, err := chain.AddBlock([]byte("a1"))
+	require.NoError(t, err)
+	a2, err := chain.AddBlock([]byte("a2"))
+	require.NoError(t, err)
+
+	// A lighter or equally heavy branch does not replace the canonical chain
+	b1 := NewBlock([][]byte{[]byte("b1")}, genesis, 4)
+	reorg, err := chain.ImportBlock(b1)
+	require.NoError(t, err)
+	require.Nil(t, reorg)
+	b2 := NewBlock([][]byte{[]byte("b2")}, b1, 4)
+	reorg, err = chain.ImportBlock(b2)
+	require.NoError(t, err)
+	require.Nil(t, reorg)
+
+	// The competing blocks are stored but they are not canonical
+	block, err := chain.GetBlock(b2.Hash)
+	require.NoError(t, err)
+	require.Equal(t, b2.Hash, block.Hash)
+	block, err = chain.GetBlockByHeight(2)
+	require.NoError(t, err)
+	require.Equal(t, a2.Hash, block.Hash)
+
+	// A heavier branch becomes the canonical chain
+	b3 := NewBlock([][]byte{[]byte("b3")}, b2, 4)
+	reorg, err = chain.ImportBlock(b3)
+	require.NoError(t, err)
+	require.NotNil(t, reorg)
+	require.Equal(t, genesis.Hash, reorg.Fork.Hash)
+	require.Equal(t, a2.Hash, reorg.OldTip.Hash)
+	require.Equal(t, b3.Hash, reorg.NewTip.Hash)
+	require.Equal(t, []string{a1.Hash, a2.Hash}, hashes(reorg.Removed))
+	require.Equal(t, []string{b1.Hash, b2.Hash, b3.Hash}, hashes(reorg.Added))
+
+	require.Equal(t, uint64(4), chain.Length())
+	lastBlock, err := chain.GetLastBlock()
+	require.NoError(t, err)
+	require.Equal(t, b3.Hash, lastBlock.Hash)
+	for height, expected := range []*Block{genesis, b1, b2, b3} {
+		block, err := chain.GetBlockByHeight(uint64(height))
+		require.NoError(t, err)
+		require.Equal(t, expected.Hash, block.Hash)
+	}
+	require.NoError(t, chain.Verify())
+
+	// New blocks are mined on top of the new canonical chain
+	b4, err := chain.AddBlock([]byte("b4"))
+	require.NoError(t, err)
+	require.Equal(t, b3.Hash, b4.PrevHash)
+
+	// Extending the old branch is not enough to recover it
+	a3 := NewBlock([][]byte{[]byte("a3")}, a2, 4)
+	reorg, err = chain.ImportBlock(a3)
+	require.NoError(t, err)
+	require.Nil(t, reorg)
+
+	// A known block cannot be imported again
+	reorg, err = chain.ImportBlock(a3)
+	require.Equal(t, ErrDuplicateBlock, err)
+	require.Nil(t, reorg)
+
+	// The work is the sum of 2^difficulty of every block
+	work, err := chain.GetWork(b4.Hash)
+	require.NoError(t, err)
+	require.Equal(t, big.NewInt(5*16), work)
+	work, err = chain.GetWork(a3.Hash)
+	require.NoError(t, err)
+	require.Equal(t, big.NewInt(4*16), work)
+	_, err = chain.GetWork("oblivion")
+	require.Equal(t, ErrBlockNotFound, err)
+
+	// Blocks must follow a known parent with the expected difficulty
+	_, err = chain.ImportBlock(NewBlock([][]byte{[]byte("c1")}, genesis, 5))
+	require.Equal(t, ErrInvalidDifficulty, err)
+	orphan := NewBlock([][]byte{[]byte("c1")}, genesis, 4)
+	orphan.PrevHash = "oblivion"
+	orphan.ComputeHash()
+	require.NoError(t, orphan.Mine())
+	_, err = chain.ImportBlock(orphan)
+	require.Equal(t, ErrUnknownParent, err)
+}
+
+// TestSliceChainImportBlock tests the fork handling of the slice of blocks
+// backend.
+func TestSliceChainImportBlock(t *testing.T) {
+	chain, err := NewSliceChain(WithDifficulty(4))
+	require.NoError(t, err)
+	testImportBlock(t, chain)
+}
+
+// TestBadgerChainImportBlock tests the fork handling of the Badger database
+// backend.
+func TestBadgerChainImportBlock(t *testing.T) {
+	chain, err := NewBadgerChain("../../test/blockchain/badger-fork",
+		WithDifficulty(4))
+	require.NoError(t, err)
+	defer chain.Destroy()
+	testImportBlock(t, chain)
+}
+
+// TestFileChainImportBlock tests the fork handling of the segment files
+// backend.
+func TestFileChainImportBlock(t *testing.T) {
+	chain, err := NewFileChain("../../test/blockchain/file-fork",
+		WithDifficulty(4))
+	require.NoError(t, err)
+	defer chain.Destroy()
+	testImportBlock(t, chain)
+}
+
+// TestSQLiteChainImportBlock tests the fork handling of the SQLite database
+// backend.
+func TestSQLiteChainImportBlock(t *testing.T) {
+	chain, err := NewSQLiteChain("../../test/blockchain/sqlite-fork.db",
+		WithDifficulty(4))
+	require.NoError(t, err)
+	defer chain.Destroy()
+	testImportBlock(t, chain)
+}
+
+// TestImportBlockErrors tests the errors reported when importing invalid
+// blocks.
+func TestImportBlockErrors(t *testing.T) {
+	chain, err := NewSliceChain(WithDifficulty(4))
+	require.NoError(t, err)
+	genesis, err := chain.GetLastBlock()
+	require.NoError(t, err)
+
+	var tests = []struct {
+		name   string
+		tamper func(block *Block)
+		err    error
+	}{
+		{
+			name:   "duplicate block",
+			tamper: func(block *Block) { *block = *genesis },
+			err:    ErrDuplicateBlock,
+		},
+		{
+			name: "unknown parent",
+			tamper: func(block *Block) {
+				block.PrevHash = "oblivion"
+				block.ComputeHash()
+				block.Mine()
+			},
+			err: ErrUnknownParent,
+		},
+		{
+			name: "tampered hash",
+			tamper: func(block *Block) {
+				block.Hash = "0000" + block.Hash[4:60] + "0000"
+			},
+			err: ErrInvalidProofOfWork,
+		},
+		{
+			name: "uppercase hash",
+			tamper: func(block *Block) {
+				block.Hash = strings.ToUpper(block.Hash)
+			},
+			err: ErrInvalidProofOfWork,
+		},
+		{
+			name:   "tampered nonce",
+			tamper: func(block *Block) { block.Nonce++ },
+			err:    ErrInvalidProofOfWork,
+		},
+		{
+			name: "tampered records",
+			tamper: func(block *Block) {
+				block.Records[0] = []byte("this is a tampered block")
+			},
+			err: ErrInvalidMerkleRoot,
+		},
+		{
+			name: "invalid height",
+			tamper: func(block *Block) {
+				block.Height = 2
+				block.ComputeHash()
+				block.Mine()
+			},
+			err: ErrInvalidHeight,
+		},
+		{
+			name: "invalid difficulty",
+			tamper: func(block *Block) {
+				block.Difficulty = 5
+				block.ComputeHash()
+				block.Mine()
+			},
+			err: ErrInvalidDifficulty,
+		},
+		{
+			name: "timestamp before parent",
+			tamper: func(block *Block) {
+				block.Timestamp = genesis.Timestamp
+				block.ComputeHash()
+				block.Mine()
+			},
+			err: ErrInvalidTimestamp,
+		},
+		{
+			name: "timestamp in the future",
+			tamper: func(block *Block) {
+				block.Timestamp = time.Now().Add(2 * MaxTimeDrift).UnixNano()
+				block.ComputeHash()
+				block.Mine()
+			},
+			err: ErrInvalidTimestamp,
+		},
+	}
+
+	for _, test := range tests {
+		block := NewBlock([][]byte{[]byte("this is a testing block")}, genesis, 4)
+		test.tamper(block)
+		reorg, err := chain.ImportBlock(block)
+		require.True(t, errors.Is(err, test.err), test.name)
+		require.Nil(t, reorg, test.name)
+	}
+
+	// Nothing was imported
+	require.Equal(t, uint64(1), chain.Length())
+}
+
+// TestReplicateChain copies the blocks of a chain into another chain starting
+// from the same Genesis block.
+func TestReplicateChain(t *testing.T) {
+	source, err := NewSliceChain(WithDifficulty(4))
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err = source.AddBlock([]byte("this is a testing block"))
+		require.NoError(t, err)
+	}
+
+	// The replica must start from the source's Genesis block
+	genesis, err := source.GetBlockByHeight(0)
+	require.NoError(t, err)
+	replica, err := NewBadgerChain("../../test/blockchain/badger-replica",
+		WithDifficulty(4), WithGenesis(genesis))
+	require.NoError(t, err)
+	defer replica.Destroy()
+
+	iterator, err := NewRangeIterator(source, 1, source.Length())
+	require.NoError(t, err)
+	for iterator.HasNext() {
+		block, err := iterator.Next()
+		require.NoError(t, err)
+		reorg, err := replica.ImportBlock(block)
+		require.NoError(t, err)
+		require.Nil(t, reorg)
+	}
+
+	sourceTip, err := source.GetLastBlock()
+	require.NoError(t, err)
+	replicaTip, err := replica.GetLastBlock()
+	require.NoError(t, err)
+	require.Equal(t, sourceTip, replicaTip)
+	require.Equal(t, source.Length(), replica.Length())
+	require.NoError(t, replica.Verify())
+
+	// A different Genesis block is rejected
+	_, err = NewSliceChain(WithDifficulty(5), WithGenesis(genesis))
+	require.Equal(t, ErrInvalidGenesis, err)
+}
+
+// testRollback removes the last blocks of a chain with competing branches.
+func testRollback(t *testing.T, chain Chain) {
+	genesis, err := chain.GetLastBlock()
+	require.NoError(t, err)
+	blocks := []*Block{genesis}
+	for i := 0; i < 4; i++ {
+		block, err := chain.AddBlock([]byte("this is a testing block"))
+		require.NoError(t, err)
+		blocks = append(blocks, block)
+	}
+
+	// Add competing branches at heights 1 and 2
+	c1 := NewBlock([][]byte{[]byte("c1")}, genesis, 4)
+	_, err = chain.ImportBlock(c1)
+	require.NoError(t, err)
+	b2 := NewBlock([][]byte{[]byte("b2")}, blocks[1], 4)
+	_, err = chain.ImportBlock(b2)
+	require.NoError(t, err)
+
+	// Remove the blocks above height 2
+	removed, err := chain.RollbackTo(2)
+	require.NoError(t, err)
+	require.Equal(t, hashes(blocks[3:]), hashes(removed))
+	require.Equal(t, uint64(3), chain.Length())
+	lastBlock, err := chain.GetLastBlock()
+	require.NoError(t, err)
+	require.Equal(t, blocks[2].Hash, lastBlock.Hash)
+	_, err = chain.GetBlock(blocks[3].Hash)
+	require.Equal(t, ErrBlockNotFound, err)
+	_, err = chain.GetBlockByHeight(3)
+	require.Equal(t, ErrBlockNotFound, err)
+	require.NoError(t, chain.Verify())
+
+	// New blocks are added on top of the new last block
+	block, err := chain.AddBlock([]byte("this is a testing block"))
+	require.NoError(t, err)
+	require.Equal(t, blocks[2].Hash, block.PrevHash)
+	require.Equal(t, uint64(3), block.Height)
+
+	// Only blocks of the canonical chain can be the target
+	_, err = RollbackToHash(chain, b2.Hash)
+	require.Equal(t, ErrBlockNotFound, err)
+
+	// The hash is checked again while the chain is locked, so a block that
+	// is no longer canonical when the chain is rolled back is not the target
+	_, err = chain.(hashRollbacker).rollbackTo(b2.Height, b2.Hash)
+	require.Equal(t, ErrBlockNotFound, err)
+	require.Equal(t, uint64(4), chain.Length())
+
+	// The competing branches above the target are discarded too
+	removed, err = RollbackToHash(chain, blocks[1].Hash)
+	require.NoError(t, err)
+	require.Equal(t, []string{blocks[2].Hash, block.Hash}, hashes(removed))
+	require.Equal(t, uint64(2), chain.Length())
+	_, err = chain.GetBlock(b2.Hash)
+	require.Equal(t, ErrBlockNotFound, err)
+	_, err = chain.GetBlock(c1.Hash)
+	require.NoError(t, err)
+	require.NoError(t, chain.Verify())
+
+	// There is nothing to remove above the last block
+	removed, err = chain.RollbackTo(10)
+	require.NoError(t, err)
+	require.Empty(t, removed)
+	require.Equal(t, uint64(2), chain.Length())
+}
+
+// TestSliceChainRollback tests the rollback of the slice of blocks backend.
+func TestSliceChainRollback(t *testing.T) {
+	chain, err := NewSliceChain(WithDifficulty(4))
+	require.NoError(t, err)
+	testRollback(t, chain)
+}
+
+// TestBadgerChainRollback tests the rollback of the Badger database backend.
+func TestBadgerChainRollback(t *testing.T) {
+	chain, err := NewBadgerChain("../../test/blockchain/badger-rollback",
+		WithDifficulty(4))
+	require.NoError(t, err)
+	defer chain.Destroy()
+	testRollback(t, chain)
+}
+
+// TestFileChainRollback tests the rollback of the segment files backend.
+func TestFileChainRollback(t *testing.T) {
+	chain, err := NewFileChain("../../test/blockchain/file-rollback",
+		WithDifficulty(4))
+	require.NoError(t, err)
+	defer chain.Destroy()
+	testRollback(t, chain)
+}
+
+// TestSQLiteChainRollback tests the rollback of the SQLite database backend.
+func TestSQLiteChainRollback(t *testing.T) {
+	chain, err := NewSQLiteChain("../../test/blockchain/sqlite-rollback.db",
+		WithDifficulty(4))
+	require.NoError(t, err)
+	defer chain.Destroy()
+	testRollback(t, chain)
+}
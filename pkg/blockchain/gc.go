@@ -0,0 +1,194 @@
+package blockchain
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v3"
+)
+
+// DefaultGCInterval is how often a BadgerChain runs the garbage collection of
+// its database when the chain does not set it.
+const DefaultGCInterval = 10 * time.Minute
+
+// DefaultGCDiscardRatio is the fraction of a value log file that must be
+// discarded before it is rewritten when the chain does not set it.
+const DefaultGCDiscardRatio = 0.5
+
+// GCStats reports the work done by the garbage collection of the database of a
+// BadgerChain. The rewrites are the value log files rewritten. The reclaimed
+// bytes are the decrease of the size of the tables of the LSM tree and the
+// value log files, a run that rewrites files without shrinking them reclaims
+// none. The errors are the failed background runs, which are retried on the
+// next interval, along with the last error returned by them.
+type GCStats struct {
+	Runs           int
+	Rewrites       int
+	ReclaimedBytes int64
+	Errors         int
+	LastError      error
+}
+
+// Compact reclaims the space of the deleted blocks, returning the stats of this
+// run. Blocks smaller than the value threshold are stored in the LSM tree, so
+// its tables are compacted into a single level first, dropping the deleted
+// keys. The compaction also finds the discarded data of the value log, which
+// is then garbage collected until no file has enough discarded data to be
+// rewritten. It does nothing for in-memory databases, which have no files.
+func (chain *BadgerChain) Compact() (*GCStats, error) {
+	return chain.collectGarbage(true)
+}
+
+// collectGarbage runs the garbage collection of the value log, flattening the
+// LSM tree first if flatten is true, and adds the run to the stats of the
+// chain.
+func (chain *BadgerChain) collectGarbage(flatten bool) (*GCStats, error) {
+	// Keep the database open while it is used
+	err := chain.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer chain.release()
+
+	chain.gcMutex.Lock()
+	defer chain.gcMutex.Unlock()
+
+	stats := GCStats{
+		Runs: 1,
+	}
+	if chain.db.Opts().InMemory {
+		chain.gcStats.Runs++
+		return &stats, nil
+	}
+
+	sizeBefore, err := chain.diskSize()
+	if err != nil {
+		return nil, err
+	}
+
+	// Badger only compacts the levels of the LSM tree when they are too large,
+	// so the deleted keys of a small database would never be dropped
+	if flatten {
+		err = chain.db.Flatten(1)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Every successful call rewrites a single file, so keep calling it until
+	// there is nothing left to rewrite
+	for {
+		err = chain.db.RunValueLogGC(chain.config.gcDiscardRatio)
+		if err == badger.ErrNoRewrite || err == badger.ErrRejected {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		stats.Rewrites++
+	}
+
+	sizeAfter, err := chain.diskSize()
+	if err != nil {
+		return nil, err
+	}
+	if sizeAfter < sizeBefore {
+		stats.ReclaimedBytes = sizeBefore - sizeAfter
+	}
+
+	// Add the run to the stats of the chain
+	chain.gcStats.Runs += stats.Runs
+	chain.gcStats.Rewrites += stats.Rewrites
+	chain.gcStats.ReclaimedBytes += stats.ReclaimedBytes
+
+	return &stats, nil
+}
+
+// GCStats returns the stats of all the garbage collection runs since the chain
+// was opened, both the background ones and the ones done by Compact.
+func (chain *BadgerChain) GCStats() GCStats {
+	chain.gcMutex.Lock()
+	defer chain.gcMutex.Unlock()
+
+	return chain.gcStats
+}
+
+// startGC starts the background garbage collection of the database, unless it
+// is disabled or the database is in memory.
+func (chain *BadgerChain) startGC() {
+	if chain.config.gcInterval <= 0 || chain.db.Opts().InMemory {
+		return
+	}
+
+	chain.gcStop = make(chan struct{})
+	chain.gcDone = make(chan struct{})
+	go chain.runGC(chain.config.gcInterval, chain.gcStop, chain.gcDone)
+}
+
+// stopGC stops the background garbage collection and waits until the running
+// collection, if any, is finished. It can be called more than once.
+func (chain *BadgerChain) stopGC() {
+	chain.gcStopped.Do(func() {
+		if chain.gcStop == nil {
+			return
+		}
+
+		close(chain.gcStop)
+		<-chain.gcDone
+		chain.gcStop = nil
+	})
+}
+
+// runGC garbage collects the value log every interval until the stop channel
+// is closed, then it closes the done channel. Flattening the LSM tree blocks
+// its compactions, so it is only done by Compact.
+func (chain *BadgerChain) runGC(interval time.Duration, stop, done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			// A failed run is retried on the next tick
+			_, err := chain.collectGarbage(false)
+			if err != nil {
+				chain.gcMutex.Lock()
+				chain.gcStats.Errors++
+				chain.gcStats.LastError = err
+				chain.gcMutex.Unlock()
+			}
+		}
+	}
+}
+
+// diskSize returns the size in bytes of the tables of the LSM tree and of the
+// value log files.
+func (chain *BadgerChain) diskSize() (int64, error) {
+	tables, err := filepath.Glob(filepath.Join(chain.db.Opts().Dir, "*.sst"))
+	if err != nil {
+		return 0, err
+	}
+	valueLogs, err := filepath.Glob(filepath.Join(chain.db.Opts().ValueDir, "*.vlog"))
+	if err != nil {
+		return 0, err
+	}
+	paths := append(tables, valueLogs...)
+
+	var size int64
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			// The file was removed by a compaction or a rewrite
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		size += info.Size()
+	}
+	return size, nil
+}
@@ -0,0 +1,62 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+
+	"github.com/samuelvl/blockchain-lab/pkg/pow"
+)
+
+// BlockVersion is the version of the block header format.
+const BlockVersion uint32 = 1
+
+// ErrUnsupportedVersion error when the block's version is not supported.
+var ErrUnsupportedVersion = errors.New("blockchain: unsupported block version")
+
+// ErrInvalidMerkleRoot error when the block's merkle root does not match its
+// records.
+var ErrInvalidMerkleRoot = errors.New("blockchain: invalid merkle root")
+
+// BlockHeader stores the metadata of a block. The header is what the Proof of
+// Work commits to, so the records are only included through their merkle root.
+//
+// The height is the position of the block in the chain, starting from 0 for
+// the Genesis block. The timestamp is the time in Unix nanoseconds when the
+// block was created. The difficulty is the one used to mine the block.
+type BlockHeader struct {
+	Version    uint32 `json:"version"`
+	Height     uint64 `json:"height"`
+	Timestamp  int64  `json:"timestamp"`
+	PrevHash   string `json:"prevHash"`
+	MerkleRoot string `json:"merkleRoot"`
+	Difficulty uint   `json:"difficulty"`
+	Nonce      int32  `json:"nonce"`
+}
+
+// hash computes the header's hash using the given hash algorithm.
+//
+// The nonce is not part of the hash, it is added later by the Proof of Work.
+func (h *BlockHeader) hash(algorithm pow.Algorithm) string {
+	hash := algorithm.Sum(h.payload())
+	return hex.EncodeToString(hash[:])
+}
+
+// payload encodes the header fields, but the nonce, in big-endian order. The
+// hashes are prefixed with their length, so the encoding is unambiguous:
+//
+// version (4) | height (8) | timestamp (8) | len(prevHash) (2) | prevHash |
+// len(merkleRoot) (2) | merkleRoot | difficulty (2)
+func (h *BlockHeader) payload() []byte {
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, h.Version)
+	binary.Write(buffer, binary.BigEndian, h.Height)
+	binary.Write(buffer, binary.BigEndian, h.Timestamp)
+	binary.Write(buffer, binary.BigEndian, uint16(len(h.PrevHash)))
+	buffer.WriteString(h.PrevHash)
+	binary.Write(buffer, binary.BigEndian, uint16(len(h.MerkleRoot)))
+	buffer.WriteString(h.MerkleRoot)
+	binary.Write(buffer, binary.BigEndian, uint16(h.Difficulty))
+	return buffer.Bytes()
+}
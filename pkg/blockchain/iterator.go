@@ -0,0 +1,220 @@
+package blockchain
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+)
+
+// DefaultPageLimit is the number of blocks of a page when no limit is given.
+const DefaultPageLimit = 100
+
+// ErrInvalidRange error when the start of a height range is above its end.
+var ErrInvalidRange = errors.New("blockchain: invalid height range")
+
+// ErrInvalidCursor error when a pagination cursor cannot be decoded.
+var ErrInvalidCursor = errors.New("blockchain: invalid cursor")
+
+// ErrStaleCursor error when the block pointed by a pagination cursor is no
+// longer part of the canonical chain, for instance after a reorganization.
+var ErrStaleCursor = errors.New("blockchain: cursor is not in the canonical chain")
+
+// RangeIterator iterates through the blocks of a height range in chronological
+// order, from the lowest to the highest height, using the Next() method.
+type RangeIterator struct {
+	nextHeight uint64
+	toHeight   uint64
+	chain      Chain
+}
+
+// Page is a set of consecutive blocks in chronological order. The NextCursor
+// points to the last block of the page, so it can be used to request the next
+// page even if the chain has not grown yet. HasMore reports whether the chain
+// had more blocks when the page was read.
+type Page struct {
+	Blocks     []*Block `json:"blocks"`
+	NextCursor string   `json:"nextCursor"`
+	HasMore    bool     `json:"hasMore"`
+}
+
+// NewIteratorFrom initializes the blockchain iterator from the block with the
+// given hash, so it walks back from that block to the Genesis block. If block
+// is not found, ErrBlockNotFound is returned.
+func NewIteratorFrom(chain Chain, hash string) (*ChainIterator, error) {
+	block, err := chain.GetBlock(hash)
+	if err != nil {
+		return nil, err
+	}
+	iterator := ChainIterator{
+		currentHash: block.Hash,
+		chain:       chain,
+	}
+	return &iterator, nil
+}
+
+// NewForwardIterator initializes an iterator from the Genesis block to the last
+// block of the chain. Blocks added after the iterator is created are not
+// returned.
+func NewForwardIterator(chain Chain) *RangeIterator {
+	iterator, _ := NewRangeIterator(chain, 0, chain.Length())
+	return iterator
+}
+
+// NewRangeIterator initializes an iterator over the blocks whose height is in
+// the range [from, to). The end is limited to the length of the chain when the
+// iterator is created. If from is above to, ErrInvalidRange is returned.
+func NewRangeIterator(chain Chain, from, to uint64) (*RangeIterator, error) {
+	if from > to {
+		return nil, ErrInvalidRange
+	}
+
+	// Do not go beyond the last block
+	length := chain.Length()
+	if to > length {
+		to = length
+	}
+
+	iterator := RangeIterator{
+		nextHeight: from,
+		toHeight:   to,
+		chain:      chain,
+	}
+	return &iterator, nil
+}
+
+// Next returns the next block of the range until the end is reached.
+func (iterator *RangeIterator) Next() (*Block, error) {
+	if !iterator.HasNext() {
+		return nil, ErrBlockNotFound
+	}
+
+	// Get the next element in the range
+	nextBlock, err := iterator.chain.GetBlockByHeight(iterator.nextHeight)
+	if err != nil {
+		return nil, err
+	}
+
+	// Update the iterator height pointer
+	iterator.nextHeight++
+
+	return nextBlock, nil
+}
+
+// HasNext checks if the range has remaining blocks.
+func (iterator *RangeIterator) HasNext() bool {
+	return iterator.nextHeight < iterator.toHeight
+}
+
+// GetPage returns up to limit blocks in chronological order, starting after the
+// block pointed by the cursor. An empty cursor starts from the Genesis block
+// and a limit of 0 uses DefaultPageLimit. The cursor is an opaque string safe
+// to be used in URLs. If it cannot be decoded, ErrInvalidCursor is returned.
+//
+// The cursor stores the hash of the last block of the previous page, so pages
+// do not skip or repeat blocks when the canonical chain changes. If that block
+// is no longer part of the canonical chain, ErrStaleCursor is returned and the
+// pages must be read again from the Genesis block. The blocks are read one by
+// one, so the canonical chain may change while the page is read; every block
+// must link to the previous one or ErrStaleCursor is returned too.
+func GetPage(chain Chain, cursor string, limit uint) (*Page, error) {
+	from, prevHash, err := cursorBlock(chain, cursor)
+	if err != nil {
+		return nil, err
+	}
+	if limit == 0 {
+		limit = DefaultPageLimit
+	}
+
+	// Read the blocks of the page. The range is limited to the last block.
+	iterator, err := NewRangeIterator(chain, from, from+uint64(limit))
+	if err != nil {
+		return nil, err
+	}
+	page := Page{
+		Blocks:     []*Block{},
+		NextCursor: cursor,
+	}
+	for iterator.HasNext() {
+		block, err := iterator.Next()
+		// The chain was rolled back while the page was read
+		if err == ErrBlockNotFound {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// The blocks must belong to the same branch as the cursor's block
+		if block.PrevHash != prevHash {
+			return nil, ErrStaleCursor
+		}
+		prevHash = block.Hash
+		page.Blocks = append(page.Blocks, block)
+	}
+
+	// The next page starts after the last block of this one
+	if len(page.Blocks) > 0 {
+		lastBlock := page.Blocks[len(page.Blocks)-1]
+		page.NextCursor, err = encodeCursor(lastBlock.Hash)
+		if err != nil {
+			return nil, err
+		}
+	}
+	page.HasMore = from+uint64(len(page.Blocks)) < chain.Length()
+
+	return &page, nil
+}
+
+// cursorBlock returns the height of the first block after the one pointed by
+// the cursor along with the pointed block's hash, checking that the pointed
+// block is still part of the canonical chain. An empty cursor starts from the
+// Genesis block, whose previous hash is empty.
+func cursorBlock(chain Chain, cursor string) (uint64, string, error) {
+	if cursor == "" {
+		return 0, "", nil
+	}
+	hash, err := decodeCursor(cursor)
+	if err != nil {
+		return 0, "", err
+	}
+
+	// The block must be the one at its height in the canonical chain
+	block, err := chain.GetBlock(hash)
+	if err == ErrBlockNotFound {
+		return 0, "", ErrStaleCursor
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	canonical, err := chain.GetBlockByHeight(block.Height)
+	if err == ErrBlockNotFound {
+		return 0, "", ErrStaleCursor
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	if canonical.Hash != block.Hash {
+		return 0, "", ErrStaleCursor
+	}
+
+	return block.Height + 1, block.Hash, nil
+}
+
+// encodeCursor returns the cursor pointing to the block with the given hash,
+// this is, the hash bytes encoded in URL-safe base64.
+func encodeCursor(hash string) (string, error) {
+	buffer, err := hex.DecodeString(hash)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buffer), nil
+}
+
+// decodeCursor returns the hash of the block pointed by the cursor.
+func decodeCursor(cursor string) (string, error) {
+	buffer, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(buffer) == 0 {
+		return "", ErrInvalidCursor
+	}
+	return hex.EncodeToString(buffer), nil
+}
@@ -0,0 +1,212 @@
+package blockchain
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestForwardIterator iterates through all the blocks in the chain from the
+// Genesis block to the last block.
+func (suite *ChainTestSuite) TestForwardIterator() {
+	var height uint64
+	var block *Block
+	var err error
+	iterator := NewForwardIterator(suite.chain)
+	for iterator.HasNext() {
+		block, err = iterator.Next()
+		require.NoError(suite.T(), err)
+		require.Equal(suite.T(), height, block.Height)
+		height++
+	}
+
+	// Check if the last returned block is the last block of the chain
+	lastBlock, err := suite.chain.GetLastBlock()
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), lastBlock, block)
+	require.Equal(suite.T(), suite.chain.Length(), height)
+
+	// There are no blocks after the end
+	_, err = iterator.Next()
+	require.Equal(suite.T(), ErrBlockNotFound, err)
+}
+
+// TestRangeIterator iterates through the blocks of several height ranges.
+func (suite *ChainTestSuite) TestRangeIterator() {
+	length := suite.chain.Length()
+	var tests = []struct {
+		from    uint64
+		to      uint64
+		heights []uint64
+	}{
+		{from: 0, to: 3, heights: []uint64{0, 1, 2}},
+		{from: 4, to: 6, heights: []uint64{4, 5}},
+		{from: 5, to: 5, heights: []uint64{}},
+		// The range is limited to the last block
+		{from: length - 1, to: length + 5, heights: []uint64{length - 1}},
+		{from: length + 1, to: length + 5, heights: []uint64{}},
+	}
+
+	for _, test := range tests {
+		iterator, err := NewRangeIterator(suite.chain, test.from, test.to)
+		require.NoError(suite.T(), err)
+		heights := []uint64{}
+		for iterator.HasNext() {
+			block, err := iterator.Next()
+			require.NoError(suite.T(), err)
+			heights = append(heights, block.Height)
+		}
+		require.Equal(suite.T(), test.heights, heights)
+	}
+
+	// The start must not be above the end
+	_, err := NewRangeIterator(suite.chain, 3, 2)
+	require.Equal(suite.T(), ErrInvalidRange, err)
+}
+
+// TestIteratorFrom iterates from a block in the middle of the chain back to the
+// Genesis block.
+func (suite *ChainTestSuite) TestIteratorFrom() {
+	middleBlock, err := suite.chain.GetBlockByHeight(5)
+	require.NoError(suite.T(), err)
+
+	iterator, err := NewIteratorFrom(suite.chain, middleBlock.Hash)
+	require.NoError(suite.T(), err)
+	heights := []uint64{}
+	for iterator.HasNext() {
+		block, err := iterator.Next()
+		require.NoError(suite.T(), err)
+		heights = append(heights, block.Height)
+	}
+	require.Equal(suite.T(), []uint64{5, 4, 3, 2, 1, 0}, heights)
+
+	// The starting block must exist
+	_, err = NewIteratorFrom(suite.chain, "oblivion")
+	require.Equal(suite.T(), ErrBlockNotFound, err)
+}
+
+// TestPages reads the whole chain page by page.
+func (suite *ChainTestSuite) TestPages() {
+	length := suite.chain.Length()
+	heights := []uint64{}
+	cursor := ""
+	for {
+		page, err := GetPage(suite.chain, cursor, 4)
+		require.NoError(suite.T(), err)
+		require.LessOrEqual(suite.T(), len(page.Blocks), 4)
+		for _, block := range page.Blocks {
+			heights = append(heights, block.Height)
+		}
+		cursor = page.NextCursor
+		if !page.HasMore {
+			break
+		}
+	}
+	require.Equal(suite.T(), length, uint64(len(heights)))
+	for i, height := range heights {
+		require.Equal(suite.T(), uint64(i), height)
+	}
+
+	// The last cursor points to the last block
+	page, err := GetPage(suite.chain, cursor, 0)
+	require.NoError(suite.T(), err)
+	require.Empty(suite.T(), page.Blocks)
+	require.Equal(suite.T(), cursor, page.NextCursor)
+	require.False(suite.T(), page.HasMore)
+
+	// The cursor must be a valid one
+	_, err = GetPage(suite.chain, "oblivion!", 4)
+	require.Equal(suite.T(), ErrInvalidCursor, err)
+	_, err = GetPage(suite.chain, "oblivion", 4)
+	require.Equal(suite.T(), ErrStaleCursor, err)
+}
+
+// TestPagesReorg checks that a cursor cannot be used once its block is no
+// longer part of the canonical chain.
+func TestPagesReorg(t *testing.T) {
+	chain, err := NewSliceChain(WithDifficulty(4))
+	require.NoError(t, err)
+	for i := 0; i < 4; i++ {
+		_, err = chain.AddBlock([]byte("this is a testing block"))
+		require.NoError(t, err)
+	}
+	page, err := GetPage(chain, "", 3)
+	require.NoError(t, err)
+	require.True(t, page.HasMore)
+
+	// A heavier branch replaces the last block of the page
+	parent, err := chain.GetBlockByHeight(1)
+	require.NoError(t, err)
+	for _, block := range newBranch(parent, 4) {
+		_, err = chain.ImportBlock(block)
+		require.NoError(t, err)
+	}
+	_, err = GetPage(chain, page.NextCursor, 3)
+	require.Equal(t, ErrStaleCursor, err)
+
+	// The cursor of a removed block cannot be used either
+	page, err = GetPage(chain, "", 3)
+	require.NoError(t, err)
+	_, err = chain.RollbackTo(1)
+	require.NoError(t, err)
+	_, err = GetPage(chain, page.NextCursor, 3)
+	require.Equal(t, ErrStaleCursor, err)
+
+	// The pages are read again from the Genesis block
+	page, err = GetPage(chain, "", 3)
+	require.NoError(t, err)
+	require.Len(t, page.Blocks, 2)
+	require.False(t, page.HasMore)
+}
+
+// reorgChain is a chain which runs a reorganization right after the given
+// number of blocks are read by height.
+type reorgChain struct {
+	Chain
+	reads int
+	reorg func()
+}
+
+// GetBlockByHeight reads the block and runs the reorganization once the
+// number of reads is reached.
+func (chain *reorgChain) GetBlockByHeight(height uint64) (*Block, error) {
+	block, err := chain.Chain.GetBlockByHeight(height)
+	chain.reads--
+	if chain.reads == 0 {
+		chain.reorg()
+	}
+	return block, err
+}
+
+// TestPagesReorgWhileReading checks that a page does not mix the blocks of two
+// branches when the canonical chain changes while it is read.
+func TestPagesReorgWhileReading(t *testing.T) {
+	chain, err := NewSliceChain(WithDifficulty(4))
+	require.NoError(t, err)
+	for i := 0; i < 4; i++ {
+		_, err = chain.AddBlock([]byte("this is a testing block"))
+		require.NoError(t, err)
+	}
+
+	// A heavier branch replaces the cursor's block once it is checked, and
+	// then the first block of the page once it is read
+	for _, reads := range []int{1, 2} {
+		page, err := GetPage(chain, "", 2)
+		require.NoError(t, err)
+		parent, err := chain.GetBlockByHeight(uint64(reads - 1))
+		require.NoError(t, err)
+		branch := newBranch(parent, 6)
+		reorging := &reorgChain{
+			Chain: chain,
+			reads: reads,
+			reorg: func() {
+				for _, block := range branch {
+					_, err := chain.ImportBlock(block)
+					require.NoError(t, err)
+				}
+			},
+		}
+		_, err = GetPage(reorging, page.NextCursor, 3)
+		require.Equal(t, ErrStaleCursor, err)
+	}
+}
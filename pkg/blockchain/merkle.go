@@ -0,0 +1,230 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+
+	"github.com/samuelvl/blockchain-lab/pkg/pow"
+)
+
+// ErrRecordNotFound error when a record is not found in a block.
+var ErrRecordNotFound = errors.New("blockchain: record not found")
+
+// ErrInvalidMerkleProof error when a merkle proof does not prove the inclusion
+// of a record.
+var ErrInvalidMerkleProof = errors.New("blockchain: invalid merkle proof")
+
+// Prefixes to distinguish the hash of a leaf from the hash of an inner node,
+// so an inner node cannot be presented as a record.
+const (
+	merkleLeafPrefix byte = 0x00
+	merkleNodePrefix byte = 0x01
+)
+
+// MerkleNode is a step of the path from a record to the merkle root. It stores
+// the hash of the sibling node and whether the sibling is on the left.
+type MerkleNode struct {
+	Hash string `json:"hash"`
+	Left bool   `json:"left"`
+}
+
+// MerkleProof proves that a record is included in a block without the rest of
+// the block's records. It stores the block's header, so the proof can be
+// verified against the block's hash. The hash algorithm is not part of the
+// proof: the verifier uses the one of the block's chain.
+//
+// The index of the record and the number of records of the block give the
+// shape of the tree, so the side of every step of the path is derived from
+// them instead of trusted. However, the number of records is not committed by
+// the merkle root, so a proof only proves that the record is in the block, not
+// its position among the block's records.
+type MerkleProof struct {
+	Header    BlockHeader  `json:"header"`
+	BlockHash string       `json:"blockHash"`
+	Index     int          `json:"index"`
+	Records   int          `json:"records"`
+	Path      []MerkleNode `json:"path"`
+}
+
+// MerkleRoot returns the root of the merkle tree built from the records. The
+// leaves are the sha256 of the records and every inner node is the sha256 of
+// its two children. If a level has an odd number of nodes, the last one is
+// promoted to the next level as is.
+func MerkleRoot(records [][]byte) string {
+	return MerkleRootWith(pow.SHA256, records)
+}
+
+// MerkleRootWith returns the root of the merkle tree built from the records
+// using the given hash algorithm instead of sha256.
+func MerkleRootWith(algorithm pow.Algorithm, records [][]byte) string {
+	if len(records) == 0 {
+		hash := algorithm.Sum([]byte{})
+		return hex.EncodeToString(hash[:])
+	}
+
+	// Reduce the leaves level by level until only the root remains
+	level := merkleLeaves(algorithm, records)
+	for len(level) > 1 {
+		level = merkleLevel(algorithm, level)
+	}
+
+	return hex.EncodeToString(level[0])
+}
+
+// MerkleProof returns the proof of inclusion of the record in the given
+// position of the block. If there is no such record, ErrRecordNotFound is
+// returned.
+func (b *Block) MerkleProof(index int) (*MerkleProof, error) {
+	return b.MerkleProofWith(pow.SHA256, index)
+}
+
+// MerkleProofWith returns the proof of inclusion of the record in the given
+// position of a block mined with the given hash algorithm.
+func (b *Block) MerkleProofWith(algorithm pow.Algorithm, index int) (*MerkleProof, error) {
+	if index < 0 || index >= len(b.Records) {
+		return nil, ErrRecordNotFound
+	}
+
+	proof := MerkleProof{
+		Header:    b.BlockHeader,
+		BlockHash: b.Hash,
+		Index:     index,
+		Records:   len(b.Records),
+		Path:      []MerkleNode{},
+	}
+
+	// Collect the sibling of the record's ancestor at every level
+	level := merkleLeaves(algorithm, b.Records)
+	position := index
+	for len(level) > 1 {
+		sibling := position ^ 1
+		if sibling < len(level) {
+			proof.Path = append(proof.Path, MerkleNode{
+				Hash: hex.EncodeToString(level[sibling]),
+				Left: sibling < position,
+			})
+		}
+		level = merkleLevel(algorithm, level)
+		position /= 2
+	}
+
+	return &proof, nil
+}
+
+// Verify checks that the record is included in the block of the proof. The
+// path must lead from the record to the header's merkle root, and the header
+// must be the one mined in the block's hash.
+func (p *MerkleProof) Verify(record []byte) error {
+	return p.VerifyWith(record, pow.SHA256)
+}
+
+// VerifyWith checks that the record is included in the block of the proof, for
+// a block of a chain using the given hash algorithm.
+func (p *MerkleProof) VerifyWith(record []byte, algorithm pow.Algorithm) error {
+	return p.VerifyWithProof(record, algorithm, newMiner(0, algorithm))
+}
+
+// VerifyWithProof checks that the record is included in the block of the
+// proof, for a block hashed with the given hash algorithm and mined with the
+// given Proof of Work instead of hashcash.
+func (p *MerkleProof) VerifyWithProof(record []byte, algorithm pow.Algorithm, proof pow.ProofOfWork) error {
+	if p.Index < 0 || p.Index >= p.Records {
+		return ErrInvalidMerkleProof
+	}
+
+	// Walk the path from the record to the root. The record's ancestor has a
+	// sibling at every level but the ones where it is promoted, and the side
+	// of the sibling must match the ancestor's position.
+	hash := merkleLeaf(algorithm, record)
+	position, size, step := p.Index, p.Records, 0
+	for size > 1 {
+		sibling := position ^ 1
+		if sibling < size {
+			if step >= len(p.Path) || p.Path[step].Left != (sibling < position) {
+				return ErrInvalidMerkleProof
+			}
+			siblingHash, err := hex.DecodeString(p.Path[step].Hash)
+			if err != nil {
+				return ErrInvalidMerkleProof
+			}
+			if sibling < position {
+				hash = merkleParent(algorithm, siblingHash, hash)
+			} else {
+				hash = merkleParent(algorithm, hash, siblingHash)
+			}
+			step++
+		}
+		position /= 2
+		size = (size + 1) / 2
+	}
+	if step != len(p.Path) || hex.EncodeToString(hash) != p.Header.MerkleRoot {
+		return ErrInvalidMerkleProof
+	}
+
+	// The header must be the one committed by the block's hash
+	block := Block{
+		BlockHeader: p.Header,
+		Hash:        p.BlockHash,
+	}
+	return block.verifyProofOfWork(algorithm, proof)
+}
+
+// VerifyMerkleProof checks that the record is included in the block of the
+// proof with the chain's hash algorithm and Proof of Work. The block must be
+// in the chain, otherwise ErrBlockNotFound is returned.
+func VerifyMerkleProof(chain Chain, proof *MerkleProof, record []byte) error {
+	block, err := chain.GetBlock(proof.BlockHash)
+	if err != nil {
+		return err
+	}
+	if block.BlockHeader != proof.Header {
+		return ErrInvalidMerkleProof
+	}
+	return proof.VerifyWithProof(record, chain.HashAlgorithm(),
+		chain.ProofOfWork())
+}
+
+// String prints the merkle proof in json format.
+func (p MerkleProof) String() string {
+	jsonProof, _ := json.MarshalIndent(p, "", "  ")
+	return string(jsonProof)
+}
+
+// merkleLeaves returns the hashes of the records, this is the lowest level of
+// the merkle tree.
+func merkleLeaves(algorithm pow.Algorithm, records [][]byte) [][]byte {
+	leaves := make([][]byte, len(records))
+	for i, record := range records {
+		leaves[i] = merkleLeaf(algorithm, record)
+	}
+	return leaves
+}
+
+// merkleLevel returns the level of the merkle tree above the given one.
+func merkleLevel(algorithm pow.Algorithm, level [][]byte) [][]byte {
+	nextLevel := make([][]byte, 0, (len(level)+1)/2)
+	for i := 0; i < len(level); i += 2 {
+		if i+1 == len(level) {
+			nextLevel = append(nextLevel, level[i])
+		} else {
+			nextLevel = append(nextLevel,
+				merkleParent(algorithm, level[i], level[i+1]))
+		}
+	}
+	return nextLevel
+}
+
+// merkleLeaf returns the hash of a record in the merkle tree.
+func merkleLeaf(algorithm pow.Algorithm, record []byte) []byte {
+	hash := algorithm.Sum(bytes.Join([][]byte{{merkleLeafPrefix}, record}, nil))
+	return hash[:]
+}
+
+// merkleParent returns the hash of an inner node from its children.
+func merkleParent(algorithm pow.Algorithm, left, right []byte) []byte {
+	hash := algorithm.Sum(
+		bytes.Join([][]byte{{merkleNodePrefix}, left, right}, nil))
+	return hash[:]
+}
@@ -0,0 +1,211 @@
+package blockchain
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/samuelvl/blockchain-lab/pkg/pow"
+	"github.com/stretchr/testify/require"
+)
+
+// newRecords returns n records with different contents.
+func newRecords(n int) [][]byte {
+	records := [][]byte{}
+	for i := 0; i < n; i++ {
+		records = append(records, []byte(fmt.Sprintf("record %d", i)))
+	}
+	return records
+}
+
+// TestMerkleRoot tests the root of merkle trees with different sizes.
+func TestMerkleRoot(t *testing.T) {
+	var tests = []struct {
+		records [][]byte
+		root    string
+	}{
+		{
+			records: newRecords(0),
+			root:    "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		},
+		{
+			records: newRecords(1),
+			root:    "3b367d6db7bc51726d918b18e9a79e0fce53f867fbe38671f609e6bb59d46035",
+		},
+		{
+			records: newRecords(2),
+			root:    "5c34a11205877ecf2c4f28e25495d08301b33dbfb862419f7946fa6fdf8124ef",
+		},
+		{
+			records: newRecords(3),
+			root:    "11139f0ae3789cb227ab8c3e57d66e8925e3adb96c24d57311832150d6ac905b",
+		},
+		{
+			records: newRecords(5),
+			root:    "ab5ba240d5c5f66d57c43fc3e948d87beca519d4da8b028b6c582fda7bbf99b4",
+		},
+	}
+
+	for _, test := range tests {
+		require.Equal(t, test.root, MerkleRoot(test.records))
+	}
+}
+
+// TestMerkleProof tests the proof of inclusion of every record of blocks with
+// different number of records.
+func TestMerkleProof(t *testing.T) {
+	for _, n := range []int{1, 2, 3, 4, 5, 8, 13} {
+		records := newRecords(n)
+		block := NewBlock(records, nil, 8)
+
+		for i, record := range records {
+			proof, err := block.MerkleProof(i)
+			require.NoError(t, err)
+			require.NoError(t, proof.Verify(record))
+
+			// The proof does not work for any other record
+			require.Equal(t, ErrInvalidMerkleProof,
+				proof.Verify([]byte("this is a tampered record")))
+		}
+
+		// There is no proof for records out of the block
+		_, err := block.MerkleProof(n)
+		require.Equal(t, ErrRecordNotFound, err)
+		_, err = block.MerkleProof(-1)
+		require.Equal(t, ErrRecordNotFound, err)
+	}
+}
+
+// TestMerkleProofWith tests the proof of inclusion of a record in a block mined
+// with a hash algorithm other than sha256.
+func TestMerkleProofWith(t *testing.T) {
+	records := newRecords(5)
+	block, err := NewBlockWith(context.Background(), pow.SHA3_256, records,
+		nil, 8)
+	require.NoError(t, err)
+
+	proof, err := block.MerkleProofWith(pow.SHA3_256, 3)
+	require.NoError(t, err)
+	require.NoError(t, proof.VerifyWith(records[3], pow.SHA3_256))
+
+	// The proof is not valid for another algorithm
+	require.Equal(t, ErrInvalidMerkleProof, proof.Verify(records[3]))
+}
+
+// TestVerifyMerkleProof tests that a proof is verified with the algorithm of
+// the chain and only for the blocks of the chain.
+func TestVerifyMerkleProof(t *testing.T) {
+	chain, err := NewSliceChain(WithDifficulty(4),
+		WithHashAlgorithm(pow.SHA3_256))
+	require.NoError(t, err)
+	records := newRecords(5)
+	block, err := chain.AddBlock(records...)
+	require.NoError(t, err)
+
+	proof, err := block.MerkleProofWith(pow.SHA3_256, 3)
+	require.NoError(t, err)
+	require.NoError(t, VerifyMerkleProof(chain, proof, records[3]))
+	require.Equal(t, ErrInvalidMerkleProof,
+		VerifyMerkleProof(chain, proof, records[2]))
+
+	// A proof built with another algorithm is not valid for the chain
+	sha256Proof, err := block.MerkleProof(3)
+	require.NoError(t, err)
+	require.Equal(t, ErrInvalidMerkleProof,
+		VerifyMerkleProof(chain, sha256Proof, records[3]))
+
+	// The block must be in the chain
+	other := NewBlock(records, nil, 4)
+	otherProof, err := other.MerkleProof(3)
+	require.NoError(t, err)
+	require.NoError(t, otherProof.Verify(records[3]))
+	require.Equal(t, ErrBlockNotFound,
+		VerifyMerkleProof(chain, otherProof, records[3]))
+}
+
+// TestMerkleProofIndex tests that a proof cannot claim another index for its
+// record, even where the other index leads to the same sides of the path.
+func TestMerkleProofIndex(t *testing.T) {
+	records := newRecords(3)
+	block := NewBlock(records, nil, 8)
+
+	// The last record is promoted and then hashed as a right child, so its
+	// path has the same sides as the one of the second record
+	proof, err := block.MerkleProof(2)
+	require.NoError(t, err)
+	require.Len(t, proof.Path, 1)
+	require.True(t, proof.Path[0].Left)
+	for _, index := range []int{0, 1} {
+		proof.Index = index
+		require.Equal(t, ErrInvalidMerkleProof, proof.Verify(records[2]))
+	}
+	proof.Index = 2
+	require.NoError(t, proof.Verify(records[2]))
+}
+
+// TestMerkleProofTampered tests that a tampered proof is rejected.
+func TestMerkleProofTampered(t *testing.T) {
+	records := newRecords(5)
+	block := NewBlock(records, nil, 8)
+
+	var tests = []struct {
+		tamper func(proof *MerkleProof)
+		err    error
+	}{
+		{
+			tamper: func(proof *MerkleProof) {
+				proof.Path[0].Left = !proof.Path[0].Left
+			},
+			err: ErrInvalidMerkleProof,
+		},
+		{
+			tamper: func(proof *MerkleProof) {
+				proof.Path[1].Hash = proof.Path[0].Hash
+			},
+			err: ErrInvalidMerkleProof,
+		},
+		{
+			tamper: func(proof *MerkleProof) {
+				proof.Path[0].Hash = "not an hexadecimal hash"
+			},
+			err: ErrInvalidMerkleProof,
+		},
+		{
+			tamper: func(proof *MerkleProof) {
+				proof.Header.Timestamp++
+			},
+			err: ErrInvalidNonce,
+		},
+		{
+			tamper: func(proof *MerkleProof) {
+				proof.Index = 3
+			},
+			err: ErrInvalidMerkleProof,
+		},
+		{
+			tamper: func(proof *MerkleProof) {
+				proof.Index = 5
+			},
+			err: ErrInvalidMerkleProof,
+		},
+		{
+			tamper: func(proof *MerkleProof) {
+				proof.Records = 4
+			},
+			err: ErrInvalidMerkleProof,
+		},
+		{
+			tamper: func(proof *MerkleProof) {
+				proof.Path = append(proof.Path, proof.Path[0])
+			},
+			err: ErrInvalidMerkleProof,
+		},
+	}
+
+	for _, test := range tests {
+		proof, err := block.MerkleProof(2)
+		require.NoError(t, err)
+		test.tamper(proof)
+		require.Equal(t, test.err, proof.Verify(records[2]))
+	}
+}
@@ -0,0 +1,303 @@
+package blockchain
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v3"
+	"github.com/dgraph-io/badger/v3/options"
+	"github.com/samuelvl/blockchain-lab/pkg/pow"
+)
+
+// ErrInvalidGenesis error when the Genesis block of a chain is not valid or it
+// does not match the stored one.
+var ErrInvalidGenesis = errors.New("blockchain: invalid genesis block")
+
+// ChainOption configures an optional parameter of a blockchain backend.
+type ChainOption func(*chainConfig)
+
+// chainConfig stores the parameters shared by all the blockchain backends.
+type chainConfig struct {
+	difficulty uint
+	retarget   Retarget
+	genesis    *Block
+	codec      Codec
+	algorithm  pow.Algorithm
+	proof      pow.ProofOfWork
+	workers    int
+
+	// Parameters of the FileChain backend
+	segmentSize int64
+	fsync       FsyncPolicy
+
+	// Parameters of the BadgerChain backend
+	badgerOptions  []func(badger.Options) badger.Options
+	gcInterval     time.Duration
+	gcDiscardRatio float64
+}
+
+// newChainConfig returns the chain parameters after applying the options to
+// the default ones.
+func newChainConfig(opts ...ChainOption) (*chainConfig, error) {
+	config := chainConfig{
+		difficulty:     DefaultDifficulty,
+		codec:          BinaryCodec{},
+		algorithm:      pow.SHA256,
+		segmentSize:    DefaultSegmentSize,
+		gcInterval:     DefaultGCInterval,
+		gcDiscardRatio: DefaultGCDiscardRatio,
+	}
+	for _, opt := range opts {
+		opt(&config)
+	}
+
+	// Check the difficulty is in the range of the hashcash algorithm
+	if config.difficulty == 0 || config.difficulty > MaxDifficulty {
+		return nil, ErrInvalidDifficulty
+	}
+
+	// Check the hash algorithm is supported
+	if !config.algorithm.Valid() {
+		return nil, pow.ErrUnknownAlgorithm
+	}
+
+	// Mine with hashcash and the chain's hash algorithm by default
+	if config.proof == nil {
+		config.proof = newMiner(config.workers, config.algorithm)
+	}
+
+	// Check the given Genesis block can be the first block of the chain
+	if config.genesis != nil {
+		genesis := config.genesis
+		if genesis.PrevHash != "" || genesis.Height != 0 ||
+			genesis.Difficulty != config.difficulty || genesis.VerifyWithProof(config.algorithm, config.proof) != nil {
+			return nil, ErrInvalidGenesis
+		}
+	}
+
+	return &config, nil
+}
+
+// firstBlock returns the Genesis block of the chain. A new one is mined unless
+// it is given with WithGenesis.
+func (config *chainConfig) firstBlock() *Block {
+	if config.genesis != nil {
+		return config.genesis
+	}
+	block, _ := NewBlockWithProof(context.Background(), config.algorithm,
+		config.proof, [][]byte{[]byte("Genesis")}, nil, config.difficulty)
+	return block
+}
+
+// WithDifficulty sets the difficulty used to mine every block of the chain.
+// If the chain has a retarget algorithm, it is the difficulty of the Genesis
+// block. The closer to 256, the harder to find a nonce.
+func WithDifficulty(difficulty uint) ChainOption {
+	return func(config *chainConfig) {
+		config.difficulty = difficulty
+	}
+}
+
+// WithRetarget sets the algorithm used to adjust the difficulty of the chain
+// from the time spent to mine its blocks. By default, every block is mined with
+// the same difficulty.
+func WithRetarget(retarget Retarget) ChainOption {
+	return func(config *chainConfig) {
+		config.retarget = retarget
+	}
+}
+
+// WithGenesis sets the Genesis block of the chain instead of mining a new one,
+// so the blocks of another chain starting from the same Genesis block can be
+// imported. It must be mined with the chain's difficulty.
+func WithGenesis(genesis *Block) ChainOption {
+	return func(config *chainConfig) {
+		config.genesis = genesis
+	}
+}
+
+// WithCodec sets the codec used to store the blocks, the canonical binary
+// encoding by default. The codec of a database cannot be changed once it is
+// created. It is ignored by the backends that do not serialize blocks.
+func WithCodec(codec Codec) ChainOption {
+	return func(config *chainConfig) {
+		config.codec = codec
+	}
+}
+
+// WithHashAlgorithm sets the hash algorithm used to hash, mine and verify the
+// blocks of the chain, sha256 by default. The algorithm of a database cannot be
+// changed once it is created.
+func WithHashAlgorithm(algorithm pow.Algorithm) ChainOption {
+	return func(config *chainConfig) {
+		config.algorithm = algorithm
+	}
+}
+
+// WithProofOfWork sets the Proof of Work used to mine and verify the blocks of
+// the chain, hashcash with the chain's hash algorithm by default. The Proof of
+// Work of a database cannot be changed once it is created.
+func WithProofOfWork(proof pow.ProofOfWork) ChainOption {
+	return func(config *chainConfig) {
+		config.proof = proof
+	}
+}
+
+// WithWorkers sets the number of workers used to mine the blocks of the chain
+// with hashcash, one per CPU by default. The mined blocks do not depend on the
+// number of workers. It is ignored if WithProofOfWork is used.
+func WithWorkers(workers int) ChainOption {
+	return func(config *chainConfig) {
+		config.workers = workers
+	}
+}
+
+// WithSegmentSize sets the size of the segment files of a FileChain. A new
+// segment is started when a block does not fit in the current one. It is
+// ignored by the other backends.
+func WithSegmentSize(size int64) ChainOption {
+	return func(config *chainConfig) {
+		config.segmentSize = size
+	}
+}
+
+// WithFsyncPolicy sets when a FileChain flushes its files to the disk,
+// FsyncAlways by default. It is ignored by the other backends.
+func WithFsyncPolicy(policy FsyncPolicy) ChainOption {
+	return func(config *chainConfig) {
+		config.fsync = policy
+	}
+}
+
+// WithInMemory keeps the Badger database in memory instead of in a directory,
+// so the chain is lost once it is closed. The directory given to
+// NewBadgerChain is ignored. It is ignored by the other backends.
+func WithInMemory() ChainOption {
+	return withBadgerOptions(func(opts badger.Options) badger.Options {
+		opts.Dir = ""
+		opts.ValueDir = ""
+		return opts.WithInMemory(true)
+	})
+}
+
+// WithSyncWrites flushes every write of the Badger database to the disk before
+// returning, so no block is lost on a crash at the cost of slower writes. It
+// is ignored by the other backends.
+func WithSyncWrites(syncWrites bool) ChainOption {
+	return withBadgerOptions(func(opts badger.Options) badger.Options {
+		return opts.WithSyncWrites(syncWrites)
+	})
+}
+
+// WithValueLogFileSize sets the maximum size in bytes of the value log files of
+// the Badger database. It is ignored by the other backends.
+func WithValueLogFileSize(size int64) ChainOption {
+	return withBadgerOptions(func(opts badger.Options) badger.Options {
+		return opts.WithValueLogFileSize(size)
+	})
+}
+
+// WithValueThreshold sets the size in bytes from which the blocks of the
+// Badger database are stored in the value log instead of the LSM tree, 1MB by
+// default. Large blocks in the value log keep the LSM tree small and their
+// space is reclaimed by the garbage collection of the value log. It is ignored
+// by the other backends.
+func WithValueThreshold(threshold int64) ChainOption {
+	return withBadgerOptions(func(opts badger.Options) badger.Options {
+		return opts.WithValueThreshold(threshold)
+	})
+}
+
+// WithCompression sets the algorithm used to compress the tables of the Badger
+// database, Snappy by default. It is ignored by the other backends.
+func WithCompression(compression options.CompressionType) ChainOption {
+	return withBadgerOptions(func(opts badger.Options) badger.Options {
+		return opts.WithCompression(compression)
+	})
+}
+
+// WithEncryptionKey encrypts the Badger database with the given AES key of 16,
+// 24 or 32 bytes. An encrypted database can only be opened with the same key.
+// It is ignored by the other backends.
+func WithEncryptionKey(key []byte) ChainOption {
+	return withBadgerOptions(func(opts badger.Options) badger.Options {
+		return opts.WithEncryptionKey(key)
+	})
+}
+
+// WithCacheSizes sets the size in bytes of the block and index caches of the
+// Badger database. The block cache is needed by compression and encryption,
+// and the index cache by encryption. It is ignored by the other backends.
+func WithCacheSizes(blockCacheSize, indexCacheSize int64) ChainOption {
+	return withBadgerOptions(func(opts badger.Options) badger.Options {
+		return opts.WithBlockCacheSize(blockCacheSize).
+			WithIndexCacheSize(indexCacheSize)
+	})
+}
+
+// WithLogger sets the logger of the Badger database, which is disabled by
+// default. It is ignored by the other backends.
+func WithLogger(logger badger.Logger) ChainOption {
+	return withBadgerOptions(func(opts badger.Options) badger.Options {
+		return opts.WithLogger(logger)
+	})
+}
+
+// WithGCInterval sets how often a BadgerChain runs the garbage collection of
+// its value log in the background, DefaultGCInterval by default. A zero or
+// negative interval disables it, the value log can still be compacted with
+// Compact. It is ignored by the other backends.
+func WithGCInterval(interval time.Duration) ChainOption {
+	return func(config *chainConfig) {
+		config.gcInterval = interval
+	}
+}
+
+// WithGCDiscardRatio sets the fraction of a value log file of a BadgerChain
+// that must be discarded before the garbage collection rewrites it. It must
+// be greater than 0 and lower than 1, DefaultGCDiscardRatio by default. It is
+// ignored by the other backends.
+func WithGCDiscardRatio(ratio float64) ChainOption {
+	return func(config *chainConfig) {
+		config.gcDiscardRatio = ratio
+	}
+}
+
+// withBadgerOptions adds a change to the default options of the Badger
+// database.
+func withBadgerOptions(change func(badger.Options) badger.Options) ChainOption {
+	return func(config *chainConfig) {
+		config.badgerOptions = append(config.badgerOptions, change)
+	}
+}
+
+// retargetName returns the name of the retarget algorithm stored along with the
+// chain, or "none" if every block is mined with the same difficulty.
+func (config *chainConfig) retargetName() string {
+	if config.retarget == nil {
+		return "none"
+	}
+	return config.retarget.Name()
+}
+
+// nextDifficulty returns the difficulty of the block following the parent.
+// The difficulty is limited to the range of the hashcash algorithm.
+func (config *chainConfig) nextDifficulty(parent *Block, getBlock BlockGetter) (uint, error) {
+	if config.retarget == nil {
+		return config.difficulty, nil
+	}
+
+	difficulty, err := config.retarget.NextDifficulty(parent, getBlock)
+	if err != nil {
+		return 0, err
+	}
+	if difficulty < 1 {
+		difficulty = 1
+	}
+	if difficulty > MaxDifficulty {
+		difficulty = MaxDifficulty
+	}
+
+	return difficulty, nil
+}
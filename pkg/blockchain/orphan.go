@@ -0,0 +1,332 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default bounds of the orphan pool.
+const (
+	DefaultOrphanPoolSize = 100
+	DefaultOrphanAge      = time.Hour
+)
+
+// MaxOrphansPerParent is the number of orphans that can wait for the same
+// missing parent, so a single parent cannot take up the whole pool.
+const MaxOrphansPerParent = 8
+
+// ErrOrphanBlock error when an imported block is kept in the orphan pool until
+// its parent is imported.
+var ErrOrphanBlock = errors.New("blockchain: orphan block")
+
+// ErrOrphanDifficulty error when an orphan block is mined with a difficulty
+// lower than the one of the chain's Genesis block.
+var ErrOrphanDifficulty = errors.New("blockchain: orphan difficulty below the chain's difficulty")
+
+// ErrTooManyOrphans error when there are already MaxOrphansPerParent orphans
+// waiting for the parent of an orphan block.
+var ErrTooManyOrphans = errors.New("blockchain: too many orphans for the same parent")
+
+// ConnectError reports the orphans discarded while connecting them to an
+// imported block, because the chain rejected them or one of their ancestors.
+type ConnectError struct {
+	Errors []*BlockError
+}
+
+// Error prints the reason why every orphan was discarded.
+func (e *ConnectError) Error() string {
+	messages := make([]string, len(e.Errors))
+	for i, blockErr := range e.Errors {
+		messages[i] = blockErr.Error()
+	}
+	return fmt.Sprintf("blockchain: %d orphans discarded: %s",
+		len(e.Errors), strings.Join(messages, "; "))
+}
+
+// Is reports whether any of the orphans was discarded with the target error.
+func (e *ConnectError) Is(target error) bool {
+	for _, blockErr := range e.Errors {
+		if errors.Is(blockErr, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// OrphanPool imports blocks into a chain, holding the blocks whose parent is
+// not known yet. When the missing parent is imported, its orphan children are
+// imported too. The pool is bounded by size and age: the oldest orphan is
+// evicted when the pool is full and orphans older than the maximum age are
+// discarded.
+//
+// The chain does not know about the pool, so a parent added with
+// Chain.AddBlock or Chain.ImportBlock does not connect its orphans right away.
+// They are connected on the next call to ImportBlock or Connect.
+type OrphanPool struct {
+	chain    Chain
+	maxSize  int
+	maxAge   time.Duration
+	orphans  map[string]*orphan
+	children map[string][]string
+	now      func() time.Time
+	sync.Mutex
+}
+
+// orphan is a block in the pool along with the time it was added.
+type orphan struct {
+	block *Block
+	added time.Time
+}
+
+// NewOrphanPool initializes an orphan pool to import blocks into the chain. A
+// size or age of 0 uses DefaultOrphanPoolSize or DefaultOrphanAge.
+func NewOrphanPool(chain Chain, maxSize int, maxAge time.Duration) *OrphanPool {
+	if maxSize <= 0 {
+		maxSize = DefaultOrphanPoolSize
+	}
+	if maxAge <= 0 {
+		maxAge = DefaultOrphanAge
+	}
+
+	pool := OrphanPool{
+		chain:    chain,
+		maxSize:  maxSize,
+		maxAge:   maxAge,
+		orphans:  map[string]*orphan{},
+		children: map[string][]string{},
+		now:      time.Now,
+	}
+	return &pool
+}
+
+// ImportBlock imports the block into the chain along with the orphans waiting
+// for it, returning the reorganizations caused by them. If the parent of the
+// block is not known, the block is kept in the pool and ErrOrphanBlock is
+// returned, unless it is mined with a lower difficulty than the chain's Genesis
+// block (ErrOrphanDifficulty) or its parent has too many orphans already
+// (ErrTooManyOrphans). Other errors are the ones returned by
+// Chain.ImportBlock. The orphans whose parent was added to the chain without
+// the pool are connected too.
+//
+// If the block is imported but some of its orphans are not, they are
+// discarded along with their descendants and a ConnectError is returned with
+// the reorganizations caused by the other orphans.
+func (pool *OrphanPool) ImportBlock(block *Block) ([]*Reorg, error) {
+	// Avoid race conditions while updating the pool
+	pool.Lock()
+	defer pool.Unlock()
+
+	pool.prune()
+
+	reorg, err := pool.chain.ImportBlock(block)
+	if err == ErrUnknownParent {
+		return nil, pool.add(block)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	reorgs := []*Reorg{}
+	if reorg != nil {
+		reorgs = append(reorgs, reorg)
+	}
+	return pool.connect(pool.knownParents(), reorgs)
+}
+
+// Connect imports the orphans whose parent is already in the chain, for
+// instance because it was added with Chain.AddBlock or Chain.ImportBlock
+// instead of the pool. It returns the reorganizations caused by them and a
+// ConnectError if some of them are rejected, as ImportBlock.
+func (pool *OrphanPool) Connect() ([]*Reorg, error) {
+	// Avoid race conditions while updating the pool
+	pool.Lock()
+	defer pool.Unlock()
+
+	pool.prune()
+	return pool.connect(pool.knownParents(), []*Reorg{})
+}
+
+// Len returns the number of orphans in the pool.
+func (pool *OrphanPool) Len() int {
+	// Avoid race conditions while reading the pool
+	pool.Lock()
+	defer pool.Unlock()
+
+	pool.prune()
+	return len(pool.orphans)
+}
+
+// Has checks if the block with the given hash is in the pool.
+func (pool *OrphanPool) Has(hash string) bool {
+	// Avoid race conditions while reading the pool
+	pool.Lock()
+	defer pool.Unlock()
+
+	pool.prune()
+	_, ok := pool.orphans[hash]
+	return ok
+}
+
+// add keeps the block in the pool until its parent is imported. The block must
+// be valid by itself and as hard to mine as the chain's Genesis block, so the
+// pool cannot be filled with garbage or with cheap blocks. The tip is not used
+// as the floor because a retarget algorithm may lower the difficulty of the
+// branch the orphan belongs to.
+func (pool *OrphanPool) add(block *Block) error {
+	if _, ok := pool.orphans[block.Hash]; ok {
+		return ErrDuplicateBlock
+	}
+	genesis, err := pool.chain.GetBlockByHeight(0)
+	if err != nil {
+		return err
+	}
+	if block.Difficulty < genesis.Difficulty {
+		return ErrOrphanDifficulty
+	}
+	if len(pool.children[block.PrevHash]) >= MaxOrphansPerParent {
+		return ErrTooManyOrphans
+	}
+	err = verifyImport(block, pool.chain.HashAlgorithm(),
+		pool.chain.ProofOfWork())
+	if err != nil {
+		return err
+	}
+
+	// Make room for the new orphan
+	if len(pool.orphans) >= pool.maxSize {
+		pool.remove(pool.oldest())
+	}
+
+	pool.orphans[block.Hash] = &orphan{block: block, added: pool.now()}
+	pool.children[block.PrevHash] = append(pool.children[block.PrevHash],
+		block.Hash)
+
+	return ErrOrphanBlock
+}
+
+// knownParents returns the hashes of the blocks in the chain with orphans
+// waiting for them, sorted so they are connected in a stable order.
+func (pool *OrphanPool) knownParents() []string {
+	parents := []string{}
+	for parent := range pool.children {
+		_, err := pool.chain.GetBlock(parent)
+		if err == nil {
+			parents = append(parents, parent)
+		}
+	}
+	sort.Strings(parents)
+	return parents
+}
+
+// connect imports the orphans descending from the given blocks, appending the
+// reorganizations caused by them. The orphans rejected by the chain are
+// discarded along with their descendants, and they are reported in a
+// ConnectError.
+func (pool *OrphanPool) connect(parents []string, reorgs []*Reorg) ([]*Reorg, error) {
+	discarded := []*BlockError{}
+	for len(parents) > 0 {
+		parent := parents[0]
+		parents = parents[1:]
+
+		// Copy the children, they are removed from the pool while iterating
+		children := append([]string{}, pool.children[parent]...)
+		for _, childHash := range children {
+			child, ok := pool.orphans[childHash]
+			if !ok {
+				continue
+			}
+			pool.remove(childHash)
+
+			reorg, err := pool.chain.ImportBlock(child.block)
+			if err != nil {
+				discarded = append(discarded,
+					&BlockError{Block: child.block, Err: err})
+				discarded = pool.discard(childHash, discarded)
+				continue
+			}
+			if reorg != nil {
+				reorgs = append(reorgs, reorg)
+			}
+			parents = append(parents, childHash)
+		}
+		delete(pool.children, parent)
+	}
+
+	if len(discarded) > 0 {
+		return reorgs, &ConnectError{Errors: discarded}
+	}
+	return reorgs, nil
+}
+
+// discard removes the descendants of a rejected orphan from the pool, appending
+// them to the discarded orphans with ErrUnknownParent.
+func (pool *OrphanPool) discard(hash string, discarded []*BlockError) []*BlockError {
+	parents := []string{hash}
+	for len(parents) > 0 {
+		parent := parents[0]
+		parents = parents[1:]
+
+		children := append([]string{}, pool.children[parent]...)
+		for _, childHash := range children {
+			child, ok := pool.orphans[childHash]
+			if !ok {
+				continue
+			}
+			pool.remove(childHash)
+			discarded = append(discarded,
+				&BlockError{Block: child.block, Err: ErrUnknownParent})
+			parents = append(parents, childHash)
+		}
+		delete(pool.children, parent)
+	}
+	return discarded
+}
+
+// prune discards the orphans older than the maximum age.
+func (pool *OrphanPool) prune() {
+	now := pool.now()
+	for hash, orphan := range pool.orphans {
+		if now.Sub(orphan.added) > pool.maxAge {
+			pool.remove(hash)
+		}
+	}
+}
+
+// oldest returns the hash of the oldest orphan in the pool.
+func (pool *OrphanPool) oldest() string {
+	var oldestHash string
+	var oldestTime time.Time
+	for hash, orphan := range pool.orphans {
+		if oldestHash == "" || orphan.added.Before(oldestTime) {
+			oldestHash = hash
+			oldestTime = orphan.added
+		}
+	}
+	return oldestHash
+}
+
+// remove deletes the orphan from the pool and from its parent's children.
+func (pool *OrphanPool) remove(hash string) {
+	orphan, ok := pool.orphans[hash]
+	if !ok {
+		return
+	}
+	delete(pool.orphans, hash)
+
+	siblings := pool.children[orphan.block.PrevHash]
+	for i, sibling := range siblings {
+		if sibling == hash {
+			siblings = append(siblings[:i], siblings[i+1:]...)
+			break
+		}
+	}
+	if len(siblings) == 0 {
+		delete(pool.children, orphan.block.PrevHash)
+	} else {
+		pool.children[orphan.block.PrevHash] = siblings
+	}
+}
@@ -0,0 +1,253 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newBranch mines n blocks on top of the parent without adding them to any
+// chain.
+func newBranch(parent *Block, n int) []*Block {
+	blocks := make([]*Block, n)
+	for i := range blocks {
+		parent = NewBlock([][]byte{[]byte("this is a branch block")}, parent, 4)
+		blocks[i] = parent
+	}
+	return blocks
+}
+
+// TestOrphanPool imports blocks in reverse order and checks that they are
+// connected once the first one is imported.
+func TestOrphanPool(t *testing.T) {
+	chain, err := NewSliceChain(WithDifficulty(4))
+	require.NoError(t, err)
+	genesis, err := chain.GetLastBlock()
+	require.NoError(t, err)
+	pool := NewOrphanPool(chain, 0, 0)
+
+	// The children arrive before their parents
+	blocks := newBranch(genesis, 3)
+	for i := len(blocks) - 1; i > 0; i-- {
+		reorgs, err := pool.ImportBlock(blocks[i])
+		require.Equal(t, ErrOrphanBlock, err)
+		require.Nil(t, reorgs)
+		require.True(t, pool.Has(blocks[i].Hash))
+	}
+	require.Equal(t, 2, pool.Len())
+	require.Equal(t, uint64(1), chain.Length())
+
+	// An orphan cannot be added twice
+	_, err = pool.ImportBlock(blocks[2])
+	require.Equal(t, ErrDuplicateBlock, err)
+
+	// Importing the missing parent connects the orphans
+	reorgs, err := pool.ImportBlock(blocks[0])
+	require.NoError(t, err)
+	require.Empty(t, reorgs)
+	require.Equal(t, 0, pool.Len())
+	require.Equal(t, uint64(4), chain.Length())
+	lastBlock, err := chain.GetLastBlock()
+	require.NoError(t, err)
+	require.Equal(t, blocks[2], lastBlock)
+
+	// Invalid orphans are rejected
+	orphan := newBranch(blocks[2], 2)[1]
+	orphan.Hash = "0000" + orphan.Hash[4:60] + "0000"
+	_, err = pool.ImportBlock(orphan)
+	require.True(t, errors.Is(err, ErrInvalidProofOfWork))
+	require.Equal(t, 0, pool.Len())
+}
+
+// TestOrphanPoolReorg checks that the reorganizations caused by the connected
+// orphans are reported.
+func TestOrphanPoolReorg(t *testing.T) {
+	chain, err := NewSliceChain(WithDifficulty(4))
+	require.NoError(t, err)
+	genesis, err := chain.GetLastBlock()
+	require.NoError(t, err)
+	a1, err := chain.AddBlock([]byte("a1"))
+	require.NoError(t, err)
+	pool := NewOrphanPool(chain, 0, 0)
+
+	// The competing branch becomes heavier once the orphan is connected
+	blocks := newBranch(genesis, 2)
+	_, err = pool.ImportBlock(blocks[1])
+	require.Equal(t, ErrOrphanBlock, err)
+	reorgs, err := pool.ImportBlock(blocks[0])
+	require.NoError(t, err)
+	require.Len(t, reorgs, 1)
+	require.Equal(t, []*Block{a1}, reorgs[0].Removed)
+	require.Equal(t, blocks, reorgs[0].Added)
+}
+
+// TestOrphanPoolBounds checks that the pool discards the oldest orphans when it
+// is full and the orphans older than the maximum age.
+func TestOrphanPoolBounds(t *testing.T) {
+	chain, err := NewSliceChain(WithDifficulty(4))
+	require.NoError(t, err)
+	genesis, err := chain.GetLastBlock()
+	require.NoError(t, err)
+
+	// Use a fake clock to control the age of the orphans
+	now := time.Unix(1641168000, 0)
+	pool := NewOrphanPool(chain, 2, time.Minute)
+	pool.now = func() time.Time { return now }
+
+	blocks := newBranch(genesis, 4)
+	for _, block := range blocks[1:] {
+		_, err = pool.ImportBlock(block)
+		require.Equal(t, ErrOrphanBlock, err)
+		now = now.Add(10 * time.Second)
+	}
+
+	// The oldest orphan was evicted to make room for the newest one
+	require.Equal(t, 2, pool.Len())
+	require.False(t, pool.Has(blocks[1].Hash))
+	require.True(t, pool.Has(blocks[2].Hash))
+	require.True(t, pool.Has(blocks[3].Hash))
+
+	// The orphans expire after the maximum age
+	now = now.Add(45 * time.Second)
+	require.Equal(t, 1, pool.Len())
+	require.False(t, pool.Has(blocks[2].Hash))
+	now = now.Add(10 * time.Second)
+	require.Equal(t, 0, pool.Len())
+
+	// Expired orphans are not connected
+	_, err = pool.ImportBlock(blocks[0])
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), chain.Length())
+}
+
+// TestOrphanPoolLimits checks that the pool rejects orphans cheaper to mine
+// than the Genesis block and too many orphans of the same parent.
+func TestOrphanPoolLimits(t *testing.T) {
+	chain, err := NewSliceChain(WithDifficulty(6))
+	require.NoError(t, err)
+	genesis, err := chain.GetLastBlock()
+	require.NoError(t, err)
+	pool := NewOrphanPool(chain, 0, 0)
+
+	// The orphans must be as hard to mine as the Genesis block
+	blocks := newBranch(genesis, 2)
+	_, err = pool.ImportBlock(blocks[1])
+	require.Equal(t, ErrOrphanDifficulty, err)
+	require.Equal(t, 0, pool.Len())
+
+	// The orphans of the same parent are limited
+	parent := NewBlock([][]byte{[]byte("this is a missing block")}, genesis, 6)
+	for i := 0; i < MaxOrphansPerParent; i++ {
+		orphan := NewBlock([][]byte{[]byte(fmt.Sprintf("orphan %d", i))},
+			parent, 6)
+		_, err = pool.ImportBlock(orphan)
+		require.Equal(t, ErrOrphanBlock, err)
+	}
+	orphan := NewBlock([][]byte{[]byte("one orphan too many")}, parent, 6)
+	_, err = pool.ImportBlock(orphan)
+	require.Equal(t, ErrTooManyOrphans, err)
+	require.Equal(t, MaxOrphansPerParent, pool.Len())
+}
+
+// TestOrphanPoolDiscarded checks that the orphans rejected by the chain are
+// reported and discarded along with their descendants.
+func TestOrphanPoolDiscarded(t *testing.T) {
+	chain, err := NewSliceChain(WithDifficulty(4))
+	require.NoError(t, err)
+	genesis, err := chain.GetLastBlock()
+	require.NoError(t, err)
+	pool := NewOrphanPool(chain, 0, 0)
+
+	// The children are mined with a difficulty the chain does not accept
+	parent := NewBlock([][]byte{[]byte("this is a parent block")}, genesis, 4)
+	child := NewBlock([][]byte{[]byte("this is a child block")}, parent, 5)
+	grandchild := NewBlock([][]byte{[]byte("this is a grandchild block")},
+		child, 5)
+	_, err = pool.ImportBlock(grandchild)
+	require.Equal(t, ErrOrphanBlock, err)
+	_, err = pool.ImportBlock(child)
+	require.Equal(t, ErrOrphanBlock, err)
+
+	reorgs, err := pool.ImportBlock(parent)
+	require.Empty(t, reorgs)
+	var connectErr *ConnectError
+	require.True(t, errors.As(err, &connectErr))
+	require.Len(t, connectErr.Errors, 2)
+	require.Equal(t, child, connectErr.Errors[0].Block)
+	require.True(t, errors.Is(connectErr.Errors[0], ErrInvalidDifficulty))
+	require.Equal(t, grandchild, connectErr.Errors[1].Block)
+	require.True(t, errors.Is(connectErr.Errors[1], ErrUnknownParent))
+
+	// The parent was imported and the orphans are gone
+	require.Equal(t, uint64(2), chain.Length())
+	require.Equal(t, 0, pool.Len())
+}
+
+// TestOrphanPoolRetarget checks that the orphans of a branch mined with a lower
+// difficulty than the chain's last block are kept when the chain retargets.
+func TestOrphanPoolRetarget(t *testing.T) {
+	retarget := WindowRetarget{Window: 4, BlockTime: time.Hour}
+	chain, err := NewSliceChain(WithDifficulty(4), WithRetarget(retarget))
+	require.NoError(t, err)
+	genesis, err := chain.GetLastBlock()
+	require.NoError(t, err)
+	for i := 0; i < 4; i++ {
+		_, err = chain.AddBlock([]byte("this is a testing block"))
+		require.NoError(t, err)
+	}
+	lastBlock, err := chain.GetLastBlock()
+	require.NoError(t, err)
+	require.Greater(t, lastBlock.Difficulty, genesis.Difficulty)
+
+	// The branch keeps the Genesis block's difficulty until its first window
+	blocks := newBranch(genesis, 2)
+	pool := NewOrphanPool(chain, 0, 0)
+	_, err = pool.ImportBlock(blocks[1])
+	require.Equal(t, ErrOrphanBlock, err)
+	reorgs, err := pool.ImportBlock(blocks[0])
+	require.NoError(t, err)
+	require.Empty(t, reorgs)
+	require.Equal(t, 0, pool.Len())
+	_, err = chain.GetBlock(blocks[1].Hash)
+	require.NoError(t, err)
+}
+
+// TestOrphanPoolConnect checks that the orphans whose parent is added to the
+// chain without the pool are connected later.
+func TestOrphanPoolConnect(t *testing.T) {
+	chain, err := NewSliceChain(WithDifficulty(4))
+	require.NoError(t, err)
+	genesis, err := chain.GetLastBlock()
+	require.NoError(t, err)
+	pool := NewOrphanPool(chain, 0, 0)
+
+	// The parent is imported directly into the chain
+	blocks := newBranch(genesis, 4)
+	_, err = pool.ImportBlock(blocks[1])
+	require.Equal(t, ErrOrphanBlock, err)
+	_, err = chain.ImportBlock(blocks[0])
+	require.NoError(t, err)
+	require.True(t, pool.Has(blocks[1].Hash))
+
+	reorgs, err := pool.Connect()
+	require.NoError(t, err)
+	require.Empty(t, reorgs)
+	require.Equal(t, 0, pool.Len())
+	require.Equal(t, uint64(3), chain.Length())
+
+	// The next import through the pool connects them too
+	_, err = pool.ImportBlock(blocks[3])
+	require.Equal(t, ErrOrphanBlock, err)
+	_, err = chain.ImportBlock(blocks[2])
+	require.NoError(t, err)
+	other := NewBlock([][]byte{[]byte("this is another block")}, genesis, 4)
+	_, err = pool.ImportBlock(other)
+	require.NoError(t, err)
+	require.Equal(t, 0, pool.Len())
+	lastBlock, err := chain.GetLastBlock()
+	require.NoError(t, err)
+	require.Equal(t, blocks[3], lastBlock)
+}
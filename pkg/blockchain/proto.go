@@ -0,0 +1,73 @@
+package blockchain
+
+import (
+	"github.com/samuelvl/blockchain-lab/pkg/blockchain/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+// ToProto converts the block in its Protocol Buffers message, defined in
+// pkg/blockchain/pb/block.proto.
+func (b *Block) ToProto() *pb.Block {
+	return &pb.Block{
+		Header: &pb.BlockHeader{
+			Version:    b.Version,
+			Height:     b.Height,
+			Timestamp:  b.Timestamp,
+			PrevHash:   b.PrevHash,
+			MerkleRoot: b.MerkleRoot,
+			Difficulty: uint32(b.Difficulty),
+			Nonce:      b.Nonce,
+		},
+		Hash:    b.Hash,
+		Records: b.Records,
+	}
+}
+
+// BlockFromProto converts a Protocol Buffers message in a block. If the message
+// has no header, ErrInvalidEncoding is returned.
+func BlockFromProto(message *pb.Block) (*Block, error) {
+	header := message.GetHeader()
+	if header == nil {
+		return nil, ErrInvalidEncoding
+	}
+
+	block := Block{
+		BlockHeader: BlockHeader{
+			Version:    header.Version,
+			Height:     header.Height,
+			Timestamp:  header.Timestamp,
+			PrevHash:   header.PrevHash,
+			MerkleRoot: header.MerkleRoot,
+			Difficulty: uint(header.Difficulty),
+			Nonce:      header.Nonce,
+		},
+		Hash:    message.Hash,
+		Records: message.Records,
+	}
+	return &block, nil
+}
+
+// ProtoCodec encodes blocks with Protocol Buffers, so they can be read from
+// any language with the generated code of pkg/blockchain/pb/block.proto.
+type ProtoCodec struct{}
+
+// Name returns the identifier of the codec.
+func (ProtoCodec) Name() string {
+	return "protobuf"
+}
+
+// Encode converts the block in its Protocol Buffers wire format. The encoding
+// is deterministic for the same version of the protobuf library.
+func (ProtoCodec) Encode(b *Block) ([]byte, error) {
+	return proto.MarshalOptions{Deterministic: true}.Marshal(b.ToProto())
+}
+
+// Decode converts the Protocol Buffers wire format in a block.
+func (ProtoCodec) Decode(data []byte) (*Block, error) {
+	message := pb.Block{}
+	err := proto.Unmarshal(data, &message)
+	if err != nil {
+		return nil, err
+	}
+	return BlockFromProto(&message)
+}
@@ -0,0 +1,56 @@
+package blockchain
+
+import (
+	"testing"
+
+	"github.com/samuelvl/blockchain-lab/pkg/blockchain/pb"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+// TestBlockProto tests the conversion of a block to and from its Protocol
+// Buffers message.
+func TestBlockProto(t *testing.T) {
+	block := NewBlock([][]byte{[]byte("this is a testing block"),
+		[]byte("this is another testing record")}, FirstBlock(4), 4)
+
+	message := block.ToProto()
+	require.Equal(t, block.Height, message.Header.Height)
+	require.Equal(t, block.PrevHash, message.Header.PrevHash)
+	require.Equal(t, uint32(block.Difficulty), message.Header.Difficulty)
+	require.Equal(t, block.Nonce, message.Header.Nonce)
+	require.Equal(t, block.Hash, message.Hash)
+	require.Equal(t, block.Records, message.Records)
+
+	convertedBlock, err := BlockFromProto(message)
+	require.NoError(t, err)
+	require.Equal(t, block, convertedBlock)
+	require.NoError(t, convertedBlock.Verify())
+
+	// The header is required
+	_, err = BlockFromProto(&pb.Block{Hash: block.Hash})
+	require.Equal(t, ErrInvalidEncoding, err)
+}
+
+// TestProtoCodec tests the serialization of a block with Protocol Buffers.
+func TestProtoCodec(t *testing.T) {
+	block := NewBlock([][]byte{[]byte("this is a testing block")},
+		FirstBlock(4), 4)
+
+	blockBytes, err := block.SerializeWith(ProtoCodec{})
+	require.NoError(t, err)
+
+	// The wire format can be read with the generated code only
+	message := pb.Block{}
+	require.NoError(t, proto.Unmarshal(blockBytes, &message))
+	require.Equal(t, block.Hash, message.Hash)
+	require.Equal(t, block.MerkleRoot, message.Header.MerkleRoot)
+
+	deserializedBlock := Block{}
+	require.NoError(t, deserializedBlock.DeserializeWith(ProtoCodec{}, blockBytes))
+	require.Equal(t, *block, deserializedBlock)
+
+	// Malformed messages are reported
+	err = deserializedBlock.DeserializeWith(ProtoCodec{}, []byte{0xff})
+	require.Error(t, err)
+}
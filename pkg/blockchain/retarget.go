@@ -0,0 +1,135 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/samuelvl/blockchain-lab/pkg/pow"
+)
+
+// ErrInvalidRetarget error when a retarget algorithm is not properly
+// configured.
+var ErrInvalidRetarget = errors.New("blockchain: invalid retarget")
+
+// BlockGetter finds a block of the chain from its hash. It is used by the
+// retarget algorithms to read the ancestors of a block.
+type BlockGetter func(hash string) (*Block, error)
+
+// Retarget is the interface to be implemented by a difficulty adjustment
+// algorithm. The difficulty must only depend on the parent block and its
+// ancestors, so every node verifying the chain computes the same value. The
+// name identifies the algorithm and its parameters, so a chain cannot be
+// reopened with another one.
+type Retarget interface {
+	NextDifficulty(parent *Block, getBlock BlockGetter) (uint, error)
+	Name() string
+}
+
+// WindowRetarget adjusts the difficulty every Window blocks, as Bitcoin does.
+// The time spent to mine the blocks of the window is compared with the
+// expected one from the target BlockTime. The adjustment is limited to a
+// factor of 4 in either direction.
+type WindowRetarget struct {
+	Window    uint64
+	BlockTime time.Duration
+}
+
+// NextDifficulty returns the difficulty of the block following the parent. It
+// only changes when the next block is the first block of a new window.
+func (retarget WindowRetarget) NextDifficulty(parent *Block, getBlock BlockGetter) (uint, error) {
+	if retarget.Window == 0 || retarget.BlockTime <= 0 {
+		return 0, ErrInvalidRetarget
+	}
+
+	// Keep the parent's difficulty until the end of the window
+	if (parent.Height+1)%retarget.Window != 0 {
+		return parent.Difficulty, nil
+	}
+
+	// Find the first block of the window. The first window starts at the
+	// Genesis block, so it has one block interval less than the others.
+	firstBlock := parent
+	for firstBlock.PrevHash != "" && parent.Height-firstBlock.Height < retarget.Window {
+		prevBlock, err := getBlock(firstBlock.PrevHash)
+		if err != nil {
+			return 0, err
+		}
+		firstBlock = prevBlock
+	}
+
+	// Compare the actual and the expected time spent on the window
+	intervals := int64(parent.Height - firstBlock.Height)
+	expected := intervals * int64(retarget.BlockTime)
+	actual := clampTimespan(parent.Timestamp-firstBlock.Timestamp, expected, 4)
+
+	return pow.RetargetDifficulty(parent.Difficulty, actual, expected), nil
+}
+
+// Name returns "window/<window>/<block time>", e.g. "window/2016/10m0s".
+func (retarget WindowRetarget) Name() string {
+	return fmt.Sprintf("window/%d/%s", retarget.Window, retarget.BlockTime)
+}
+
+// EMARetarget adjusts the difficulty on every block from the exponential moving
+// average of the last Window block intervals. The average is compared with the
+// target BlockTime, and the adjustment is limited to a factor of 2, this is,
+// one level of difficulty per block.
+type EMARetarget struct {
+	Window    uint64
+	BlockTime time.Duration
+}
+
+// Name returns "ema/<window>/<block time>", e.g. "ema/10/1m0s".
+func (retarget EMARetarget) Name() string {
+	return fmt.Sprintf("ema/%d/%s", retarget.Window, retarget.BlockTime)
+}
+
+// NextDifficulty returns the difficulty of the block following the parent.
+func (retarget EMARetarget) NextDifficulty(parent *Block, getBlock BlockGetter) (uint, error) {
+	if retarget.Window == 0 || retarget.BlockTime <= 0 {
+		return 0, ErrInvalidRetarget
+	}
+
+	// Collect the last block intervals, from the newest to the oldest
+	intervals := []int64{}
+	block := parent
+	for block.PrevHash != "" && uint64(len(intervals)) < retarget.Window {
+		prevBlock, err := getBlock(block.PrevHash)
+		if err != nil {
+			return 0, err
+		}
+		intervals = append(intervals, block.Timestamp-prevBlock.Timestamp)
+		block = prevBlock
+	}
+
+	// Keep the parent's difficulty if there are no intervals yet
+	if len(intervals) == 0 {
+		return parent.Difficulty, nil
+	}
+
+	// Compute the average from the oldest to the newest interval, using the
+	// smoothing factor 2/(Window+1). Integer arithmetic makes the result the
+	// same on every node.
+	average := intervals[len(intervals)-1]
+	for i := len(intervals) - 2; i >= 0; i-- {
+		average += (intervals[i] - average) * 2 / int64(retarget.Window+1)
+	}
+
+	expected := int64(retarget.BlockTime)
+	actual := clampTimespan(average, expected, 2)
+
+	return pow.RetargetDifficulty(parent.Difficulty, actual, expected), nil
+}
+
+// clampTimespan limits the actual timespan to the range [expected/factor,
+// expected*factor].
+func clampTimespan(actual, expected, factor int64) int64 {
+	if actual < expected/factor {
+		return expected / factor
+	}
+	if actual > expected*factor {
+		return expected * factor
+	}
+	return actual
+}
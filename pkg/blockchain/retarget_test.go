@@ -0,0 +1,194 @@
+package blockchain
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v3"
+	"github.com/stretchr/testify/require"
+)
+
+// newTimedChain returns the last block of a chain whose blocks were created
+// with the given intervals, along with a getter to find its ancestors.
+func newTimedChain(difficulty uint, intervals ...time.Duration) (*Block, BlockGetter) {
+	blocks := map[string]*Block{}
+	block := &Block{
+		BlockHeader: BlockHeader{
+			Difficulty: difficulty,
+		},
+		Hash: "0",
+	}
+	blocks[block.Hash] = block
+	for _, interval := range intervals {
+		block = &Block{
+			BlockHeader: BlockHeader{
+				Height:     block.Height + 1,
+				Timestamp:  block.Timestamp + int64(interval),
+				PrevHash:   block.Hash,
+				Difficulty: difficulty,
+			},
+			Hash: strconv.FormatUint(block.Height+1, 10),
+		}
+		blocks[block.Hash] = block
+	}
+
+	getBlock := func(hash string) (*Block, error) {
+		block, ok := blocks[hash]
+		if !ok {
+			return nil, ErrBlockNotFound
+		}
+		return block, nil
+	}
+	return block, getBlock
+}
+
+// repeat returns a slice with n copies of the interval.
+func repeat(interval time.Duration, n int) []time.Duration {
+	intervals := make([]time.Duration, n)
+	for i := range intervals {
+		intervals[i] = interval
+	}
+	return intervals
+}
+
+// TestWindowRetarget tests the difficulty adjustment at the end of each window.
+func TestWindowRetarget(t *testing.T) {
+	retarget := WindowRetarget{Window: 4, BlockTime: time.Minute}
+	var tests = []struct {
+		intervals  []time.Duration
+		difficulty uint
+	}{
+		// Middle of the window
+		{intervals: repeat(time.Second, 2), difficulty: 16},
+		// End of the first window
+		{intervals: repeat(time.Minute, 3), difficulty: 16},
+		{intervals: repeat(30*time.Second, 3), difficulty: 17},
+		{intervals: repeat(2*time.Minute, 3), difficulty: 15},
+		// The adjustment is limited to a factor of 4
+		{intervals: repeat(time.Second, 3), difficulty: 18},
+		{intervals: repeat(time.Hour, 3), difficulty: 14},
+		// End of the second window
+		{intervals: append(repeat(time.Hour, 3), repeat(15*time.Second, 4)...),
+			difficulty: 18},
+	}
+
+	for _, test := range tests {
+		parent, getBlock := newTimedChain(16, test.intervals...)
+		difficulty, err := retarget.NextDifficulty(parent, getBlock)
+		require.NoError(t, err)
+		require.Equal(t, test.difficulty, difficulty)
+	}
+
+	// The window must not be empty
+	parent, getBlock := newTimedChain(16, time.Minute)
+	_, err := WindowRetarget{}.NextDifficulty(parent, getBlock)
+	require.Equal(t, ErrInvalidRetarget, err)
+}
+
+// TestEMARetarget tests the difficulty adjustment on every block.
+func TestEMARetarget(t *testing.T) {
+	retarget := EMARetarget{Window: 4, BlockTime: time.Minute}
+	var tests = []struct {
+		intervals  []time.Duration
+		difficulty uint
+	}{
+		{intervals: nil, difficulty: 16},
+		{intervals: repeat(time.Minute, 6), difficulty: 16},
+		{intervals: repeat(70*time.Second, 6), difficulty: 16},
+		{intervals: repeat(30*time.Second, 6), difficulty: 17},
+		{intervals: repeat(2*time.Minute, 6), difficulty: 15},
+		// The adjustment is limited to one level of difficulty
+		{intervals: repeat(time.Second, 6), difficulty: 17},
+		{intervals: repeat(time.Hour, 6), difficulty: 15},
+		// Recent intervals weigh more than old ones
+		{intervals: append(repeat(20*time.Second, 2), repeat(time.Minute, 2)...),
+			difficulty: 16},
+		{intervals: append(repeat(time.Minute, 2), repeat(20*time.Second, 2)...),
+			difficulty: 17},
+	}
+
+	for _, test := range tests {
+		parent, getBlock := newTimedChain(16, test.intervals...)
+		difficulty, err := retarget.NextDifficulty(parent, getBlock)
+		require.NoError(t, err)
+		require.Equal(t, test.difficulty, difficulty)
+	}
+}
+
+// TestChainRetarget checks that the chain adjusts the difficulty of the new
+// blocks and that the adjusted chain passes the verification.
+func TestChainRetarget(t *testing.T) {
+	// Blocks are mined much faster than the target block time
+	retarget := WindowRetarget{Window: 2, BlockTime: time.Hour}
+	chain, err := NewSliceChain(WithDifficulty(4), WithRetarget(retarget))
+	require.NoError(t, err)
+
+	for i := 0; i < 4; i++ {
+		_, err = chain.AddBlock([]byte("this is a testing block"))
+		require.NoError(t, err)
+	}
+
+	// The difficulty is increased at the end of each window
+	difficulties := []uint{}
+	for _, block := range chain.Blocks {
+		difficulties = append(difficulties, block.Difficulty)
+	}
+	require.Equal(t, []uint{4, 4, 6, 6, 8}, difficulties)
+	require.NoError(t, chain.Verify())
+
+	// A block mined with a different difficulty is reported
+	lastBlock := chain.Blocks[len(chain.Blocks)-1]
+	lastBlock.Difficulty = 4
+	lastBlock.ComputeHash()
+	require.NoError(t, lastBlock.Mine())
+	err = chain.Verify()
+	require.True(t, errors.Is(err, ErrInvalidDifficulty))
+}
+
+// TestBadgerChainRetarget checks that a Badger database can only be opened with
+// the retarget algorithm used to create it.
+func TestBadgerChainRetarget(t *testing.T) {
+	dir := "../../test/blockchain/badger-retarget"
+	retarget := WindowRetarget{Window: 2, BlockTime: time.Hour}
+	chain, err := NewBadgerChain(dir, WithDifficulty(4), WithRetarget(retarget))
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, err = chain.AddBlock([]byte("this is a testing block"))
+		require.NoError(t, err)
+	}
+	require.NoError(t, chain.Close())
+
+	// Open the database with a different retarget
+	_, err = NewBadgerChain(dir, WithDifficulty(4))
+	require.Equal(t, ErrRetargetMismatch, err)
+	_, err = NewBadgerChain(dir, WithDifficulty(4),
+		WithRetarget(WindowRetarget{Window: 4, BlockTime: time.Hour}))
+	require.Equal(t, ErrRetargetMismatch, err)
+	_, err = NewBadgerChain(dir, WithDifficulty(4),
+		WithRetarget(EMARetarget{Window: 2, BlockTime: time.Hour}))
+	require.Equal(t, ErrRetargetMismatch, err)
+
+	// Open the database with the same retarget
+	chain, err = NewBadgerChain(dir, WithDifficulty(4), WithRetarget(retarget))
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), chain.Length())
+	require.NoError(t, chain.Verify())
+	require.NoError(t, chain.Destroy())
+
+	// Databases without retarget were mined with a fixed difficulty
+	chain, err = NewBadgerChain(dir, WithDifficulty(4))
+	require.NoError(t, err)
+	err = chain.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(chain.retargetKey)
+	})
+	require.NoError(t, err)
+	require.NoError(t, chain.Close())
+
+	_, err = NewBadgerChain(dir, WithDifficulty(4), WithRetarget(retarget))
+	require.Equal(t, ErrRetargetMismatch, err)
+	chain, err = NewBadgerChain(dir, WithDifficulty(4))
+	require.NoError(t, err)
+	require.NoError(t, chain.Destroy())
+}
@@ -0,0 +1,727 @@
+package blockchain
+
+import (
+	"context"
+	"database/sql"
+	"math/big"
+	"os"
+	"strconv"
+	"sync"
+
+	// Register the sqlite3 driver of database/sql
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/samuelvl/blockchain-lab/pkg/pow"
+)
+
+// sqliteSchema creates the tables of a SQLiteChain. The blocks are stored by
+// their hash along with their header fields, so they can be queried with SQL,
+// and the encoded block. Only the blocks of the canonical chain are flagged as
+// canonical, there is one per height at most. The records of every block are
+// rows of the records table too, keyed by the block's hash and their index.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS metadata (
+	key   TEXT PRIMARY KEY,
+	value TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS blocks (
+	hash        TEXT PRIMARY KEY,
+	height      INTEGER NOT NULL,
+	prev_hash   TEXT NOT NULL,
+	timestamp   INTEGER NOT NULL,
+	merkle_root TEXT NOT NULL,
+	difficulty  INTEGER NOT NULL,
+	nonce       INTEGER NOT NULL,
+	work        TEXT NOT NULL,
+	canonical   INTEGER NOT NULL DEFAULT 0,
+	data        BLOB NOT NULL
+);
+CREATE INDEX IF NOT EXISTS blocks_height ON blocks (height);
+CREATE INDEX IF NOT EXISTS blocks_prev_hash ON blocks (prev_hash);
+CREATE UNIQUE INDEX IF NOT EXISTS blocks_canonical_height
+	ON blocks (height) WHERE canonical = 1;
+CREATE TABLE IF NOT EXISTS records (
+	block_hash TEXT NOT NULL,
+	idx        INTEGER NOT NULL,
+	data       BLOB NOT NULL,
+	PRIMARY KEY (block_hash, idx)
+);
+`
+
+// sqliteQuerier runs queries in the database or in a transaction.
+type sqliteQuerier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// SQLiteChain stores the blocks in an embedded SQLite database, so they can be
+// queried with SQL. Every block is a row of the blocks table keyed by its hash,
+// with its header fields, its cumulative work and the block encoded with the
+// chain's codec in the data column. Every record is a row of the records table
+// keyed by the block's hash and its index in the block, written in the same
+// transaction as the block. The parameters of the chain are stored in the
+// metadata table.
+type SQLiteChain struct {
+	db     *sql.DB
+	path   string
+	config *chainConfig
+	closed bool
+	sync.Mutex
+}
+
+// NewSQLiteChain initializes a blockchain to store blocks in the SQLite
+// database of the given file. It will add the Genesis block as the first block
+// of the chain. If the database is already initialized, its parameters must
+// match the configured ones as in NewBadgerChain.
+func NewSQLiteChain(path string, opts ...ChainOption) (*SQLiteChain, error) {
+	// Apply the chain options
+	config, err := newChainConfig(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	// A single connection serializes the transactions
+	database, err := sql.Open("sqlite3", path+"?_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	database.SetMaxOpenConns(1)
+
+	chain := SQLiteChain{
+		db:     database,
+		path:   path,
+		config: config,
+	}
+
+	// Initialize the database and release it if it cannot be used
+	err = chain.init()
+	if err != nil {
+		database.Close()
+		return nil, err
+	}
+
+	return &chain, nil
+}
+
+// init creates the tables and the Genesis block of a new database, or checks
+// the parameters of an existing one.
+func (chain *SQLiteChain) init() error {
+	tx, err := chain.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Databases created before the records table have to be indexed
+	var tables int
+	err = tx.QueryRow(`SELECT count(*) FROM sqlite_master
+		WHERE type = 'table' AND name IN ('blocks', 'records')`).Scan(&tables)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(sqliteSchema)
+	if err != nil {
+		return err
+	}
+	if tables == 1 {
+		err = chain.indexRecords(tx)
+		if err != nil {
+			return err
+		}
+	}
+
+	// A parameter missing in an existing database must have its legacy value,
+	// if any, and it is stored for it
+	metadata := []struct {
+		key      string
+		value    string
+		legacy   string
+		mismatch error
+	}{
+		{
+			key:      "difficulty",
+			value:    strconv.FormatUint(uint64(chain.config.difficulty), 10),
+			mismatch: ErrInvalidDifficulty,
+		},
+		{
+			key:      "codec",
+			value:    chain.config.codec.Name(),
+			mismatch: ErrInvalidCodec,
+		},
+		{
+			key:      "hashAlgorithm",
+			value:    chain.config.algorithm.String(),
+			mismatch: ErrInvalidHashAlgorithm,
+		},
+		{
+			key:      "proofOfWork",
+			value:    chain.config.proof.Name(),
+			mismatch: ErrProofOfWorkMismatch,
+		},
+		{
+			key:      "retarget",
+			value:    chain.config.retargetName(),
+			legacy:   "none",
+			mismatch: ErrRetargetMismatch,
+		},
+	}
+	for _, m := range metadata {
+		var value string
+		err = tx.QueryRow("SELECT value FROM metadata WHERE key = ?",
+			m.key).Scan(&value)
+		if err == sql.ErrNoRows {
+			if tables > 0 && m.legacy != "" && m.value != m.legacy {
+				return m.mismatch
+			}
+			_, err = tx.Exec("INSERT INTO metadata (key, value) VALUES (?, ?)",
+				m.key, m.value)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if value != m.value {
+			return m.mismatch
+		}
+	}
+
+	// Add the Genesis block to new databases
+	genesis, err := chain.getBlockByHeight(tx, 0)
+	if err == ErrBlockNotFound {
+		genesis = chain.config.firstBlock()
+		err = chain.insertBlock(tx, genesis, blockWork(genesis.Difficulty), true)
+	}
+	if err != nil {
+		return err
+	}
+
+	// The Genesis block must be the given one, if any
+	if chain.config.genesis != nil && genesis.Hash != chain.config.genesis.Hash {
+		return ErrInvalidGenesis
+	}
+
+	// Commit the transaction and check for error
+	return tx.Commit()
+}
+
+// insertBlock stores the block along with its cumulative work.
+func (chain *SQLiteChain) insertBlock(q sqliteQuerier, block *Block, work *big.Int, canonical bool) error {
+	data, err := chain.config.codec.Encode(block)
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec(`INSERT INTO blocks (hash, height, prev_hash, timestamp,
+		merkle_root, difficulty, nonce, work, canonical, data)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		block.Hash, int64(block.Height), block.PrevHash, block.Timestamp,
+		block.MerkleRoot, int64(block.Difficulty), int64(block.Nonce),
+		work.String(), canonical, data)
+	if err != nil {
+		return err
+	}
+	return chain.insertRecords(q, block)
+}
+
+// insertRecords stores the records of the block in the records table.
+func (chain *SQLiteChain) insertRecords(q sqliteQuerier, block *Block) error {
+	for i, record := range block.Records {
+		_, err := q.Exec(
+			"INSERT INTO records (block_hash, idx, data) VALUES (?, ?, ?)",
+			block.Hash, i, record)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexRecords stores the records of every block in the records table, for
+// the databases created before it.
+func (chain *SQLiteChain) indexRecords(q sqliteQuerier) error {
+	blocks, err := chain.queryBlocks(q, "SELECT data FROM blocks")
+	if err != nil {
+		return err
+	}
+	for _, block := range blocks {
+		err = chain.insertRecords(q, block)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getBlock finds a block from its hash. The block may be part of the
+// canonical chain or of a competing branch.
+func (chain *SQLiteChain) getBlock(q sqliteQuerier, hash string) (*Block, error) {
+	return chain.queryBlock(q, "SELECT data FROM blocks WHERE hash = ?", hash)
+}
+
+// getBlockByHeight finds the block of the canonical chain at the given height.
+func (chain *SQLiteChain) getBlockByHeight(q sqliteQuerier, height uint64) (*Block, error) {
+	return chain.queryBlock(q,
+		"SELECT data FROM blocks WHERE height = ? AND canonical = 1",
+		int64(height))
+}
+
+// getLastBlock finds the highest block of the canonical chain.
+func (chain *SQLiteChain) getLastBlock(q sqliteQuerier) (*Block, error) {
+	return chain.queryBlock(q, `SELECT data FROM blocks WHERE canonical = 1
+		ORDER BY height DESC LIMIT 1`)
+}
+
+// queryBlock decodes the block returned by the query.
+func (chain *SQLiteChain) queryBlock(q sqliteQuerier, query string, args ...interface{}) (*Block, error) {
+	var data []byte
+	err := q.QueryRow(query, args...).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, ErrBlockNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return chain.config.codec.Decode(data)
+}
+
+// getWork returns the cumulative work of a block.
+func (chain *SQLiteChain) getWork(q sqliteQuerier, hash string) (*big.Int, error) {
+	var value string
+	err := q.QueryRow("SELECT work FROM blocks WHERE hash = ?",
+		hash).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, ErrBlockNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	work, ok := new(big.Int).SetString(value, 10)
+	if !ok {
+		return nil, ErrInvalidEncoding
+	}
+	return work, nil
+}
+
+// AddBlock adds a new block to the chain from the input records.
+func (chain *SQLiteChain) AddBlock(records ...[]byte) (*Block, error) {
+	return chain.AddBlockContext(context.Background(), records...)
+}
+
+// AddBlockContext adds a new block to the chain from the input records. If the
+// context is done before the block is mined, pow.ErrMiningCanceled is returned
+// and the chain is left unchanged.
+func (chain *SQLiteChain) AddBlockContext(ctx context.Context, records ...[]byte) (*Block, error) {
+	// Avoid race conditions while adding new blocks
+	chain.Lock()
+	defer chain.Unlock()
+	if chain.closed {
+		return nil, ErrChainClosed
+	}
+
+	tx, err := chain.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Compute the difficulty of the new block from its ancestors
+	prevBlock, err := chain.getLastBlock(tx)
+	if err != nil {
+		return nil, err
+	}
+	difficulty, err := chain.config.nextDifficulty(prevBlock,
+		func(hash string) (*Block, error) {
+			return chain.getBlock(tx, hash)
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	newBlock, err := NewBlockWithProof(ctx, chain.config.algorithm,
+		chain.config.proof, records, prevBlock, difficulty)
+	if err != nil {
+		return nil, err
+	}
+	work, err := chain.getWork(tx, prevBlock.Hash)
+	if err != nil {
+		return nil, err
+	}
+	work.Add(work, blockWork(newBlock.Difficulty))
+	err = chain.insertBlock(tx, newBlock, work, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// Commit the transaction and check for error
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return newBlock, nil
+}
+
+// GetBlock finds and returns a block from its hash. If block is not found,
+// ErrBlockNotFound is returned.
+func (chain *SQLiteChain) GetBlock(hash string) (*Block, error) {
+	// Avoid reading while the database is closed
+	chain.Lock()
+	defer chain.Unlock()
+	if chain.closed {
+		return nil, ErrChainClosed
+	}
+
+	return chain.getBlock(chain.db, hash)
+}
+
+// GetBlockByHeight finds and returns a block from its height. If block is not
+// found, ErrBlockNotFound is returned.
+func (chain *SQLiteChain) GetBlockByHeight(height uint64) (*Block, error) {
+	// Avoid reading while the database is closed
+	chain.Lock()
+	defer chain.Unlock()
+	if chain.closed {
+		return nil, ErrChainClosed
+	}
+
+	return chain.getBlockByHeight(chain.db, height)
+}
+
+// GetLastBlock returns the last block of the chain.
+func (chain *SQLiteChain) GetLastBlock() (*Block, error) {
+	// Avoid reading while the database is closed
+	chain.Lock()
+	defer chain.Unlock()
+	if chain.closed {
+		return nil, ErrChainClosed
+	}
+
+	return chain.getLastBlock(chain.db)
+}
+
+// GetWork returns the cumulative work of the chain ending in the block with
+// the given hash. If block is not found, ErrBlockNotFound is returned.
+func (chain *SQLiteChain) GetWork(hash string) (*big.Int, error) {
+	// Avoid reading while the database is closed
+	chain.Lock()
+	defer chain.Unlock()
+	if chain.closed {
+		return nil, ErrChainClosed
+	}
+
+	return chain.getWork(chain.db, hash)
+}
+
+// ImportBlock adds a block mined outside the chain on top of any known block.
+// If the branch of the new block has more cumulative work than the canonical
+// chain, it becomes the canonical chain and the reorganization is returned.
+//
+// The block is validated before storing it. ErrDuplicateBlock is returned if
+// the block is already in the chain, ErrUnknownParent if its parent is not,
+// and ErrInvalidProofOfWork if its hash or nonce are not valid.
+func (chain *SQLiteChain) ImportBlock(block *Block) (*Reorg, error) {
+	// Avoid race conditions while adding new blocks
+	chain.Lock()
+	defer chain.Unlock()
+	if chain.closed {
+		return nil, ErrChainClosed
+	}
+
+	tx, err := chain.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = chain.getBlock(tx, block.Hash)
+	if err == nil {
+		return nil, ErrDuplicateBlock
+	}
+	if err != ErrBlockNotFound {
+		return nil, err
+	}
+
+	// The block must be a valid child of a known block
+	parent, err := chain.getBlock(tx, block.PrevHash)
+	if err == ErrBlockNotFound {
+		return nil, ErrUnknownParent
+	}
+	if err != nil {
+		return nil, err
+	}
+	getBlock := func(hash string) (*Block, error) {
+		return chain.getBlock(tx, hash)
+	}
+	err = checkImport(block, parent, chain.config, getBlock)
+	if err != nil {
+		return nil, err
+	}
+
+	// Store the new block along with its cumulative work
+	work, err := chain.getWork(tx, parent.Hash)
+	if err != nil {
+		return nil, err
+	}
+	work.Add(work, blockWork(block.Difficulty))
+	err = chain.insertBlock(tx, block, work, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep the canonical chain unless the new branch is heavier
+	oldTip, err := chain.getLastBlock(tx)
+	if err != nil {
+		return nil, err
+	}
+	tipWork, err := chain.getWork(tx, oldTip.Hash)
+	if err != nil {
+		return nil, err
+	}
+	if work.Cmp(tipWork) <= 0 {
+		return nil, tx.Commit()
+	}
+
+	reorg, err := chain.reorganize(tx, block, oldTip)
+	if err != nil {
+		return nil, err
+	}
+
+	// Commit the transaction and check for error
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	// Extending the canonical chain is not a reorganization
+	if len(reorg.Removed) == 0 {
+		return nil, nil
+	}
+	return reorg, nil
+}
+
+// reorganize makes the branch ending in the new tip the canonical chain,
+// flagging its blocks as canonical instead of the ones above the fork.
+func (chain *SQLiteChain) reorganize(tx *sql.Tx, newTip, oldTip *Block) (*Reorg, error) {
+	// Walk back the new branch until the canonical chain is reached
+	added := []*Block{}
+	fork := newTip
+	for {
+		canonical, err := chain.getBlockByHeight(tx, fork.Height)
+		if err != nil && err != ErrBlockNotFound {
+			return nil, err
+		}
+		if err == nil && canonical.Hash == fork.Hash {
+			break
+		}
+		added = append([]*Block{fork}, added...)
+		fork, err = chain.getBlock(tx, fork.PrevHash)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Collect the canonical blocks above the fork
+	removed, err := chain.canonicalAbove(tx, fork.Height)
+	if err != nil {
+		return nil, err
+	}
+
+	// Replace the canonical blocks above the fork with the new branch
+	_, err = tx.Exec(
+		"UPDATE blocks SET canonical = 0 WHERE canonical = 1 AND height > ?",
+		int64(fork.Height))
+	if err != nil {
+		return nil, err
+	}
+	for _, block := range added {
+		_, err = tx.Exec("UPDATE blocks SET canonical = 1 WHERE hash = ?",
+			block.Hash)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	reorg := Reorg{
+		Fork:    fork,
+		OldTip:  oldTip,
+		NewTip:  newTip,
+		Removed: removed,
+		Added:   added,
+	}
+	return &reorg, nil
+}
+
+// canonicalAbove returns the blocks of the canonical chain above the given
+// height sorted by height.
+func (chain *SQLiteChain) canonicalAbove(q sqliteQuerier, height uint64) ([]*Block, error) {
+	return chain.queryBlocks(q, `SELECT data FROM blocks
+		WHERE canonical = 1 AND height > ? ORDER BY height`, int64(height))
+}
+
+// queryBlocks runs a query selecting the data column of blocks and returns the
+// decoded blocks.
+func (chain *SQLiteChain) queryBlocks(q sqliteQuerier, query string, args ...interface{}) ([]*Block, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	blocks := []*Block{}
+	for rows.Next() {
+		var data []byte
+		err = rows.Scan(&data)
+		if err != nil {
+			return nil, err
+		}
+		block, err := chain.config.codec.Decode(data)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, block)
+	}
+
+	return blocks, rows.Err()
+}
+
+// RollbackTo removes the blocks above the given height in a single
+// transaction, so the block at that height becomes the last block. The removed
+// blocks of the canonical chain are returned sorted by height. The blocks of
+// the competing branches above the height are discarded too.
+func (chain *SQLiteChain) RollbackTo(height uint64) ([]*Block, error) {
+	return chain.rollbackTo(height, "")
+}
+
+// rollbackTo removes the blocks above the height as RollbackTo. If the hash is
+// not empty, it must be the hash of the canonical block at that height when
+// the chain is locked, otherwise ErrBlockNotFound is returned.
+func (chain *SQLiteChain) rollbackTo(height uint64, hash string) ([]*Block, error) {
+	// Avoid race conditions while removing blocks
+	chain.Lock()
+	defer chain.Unlock()
+	if chain.closed {
+		return nil, ErrChainClosed
+	}
+
+	tx, err := chain.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// The block must be the canonical one at the height
+	if hash != "" {
+		block, err := chain.getBlockByHeight(tx, height)
+		if err != nil {
+			return nil, err
+		}
+		if block.Hash != hash {
+			return nil, ErrBlockNotFound
+		}
+	}
+
+	removed, err := chain.canonicalAbove(tx, height)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(`DELETE FROM records WHERE block_hash IN
+		(SELECT hash FROM blocks WHERE height > ?)`, int64(height))
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec("DELETE FROM blocks WHERE height > ?", int64(height))
+	if err != nil {
+		return nil, err
+	}
+
+	// Commit the transaction and check for error
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return removed, nil
+}
+
+// Close closes the database. The blocks are kept, so the chain can be opened
+// again with NewSQLiteChain. Blocks being added finish before the database is closed, and
+// the methods called after Close return ErrChainClosed.
+func (chain *SQLiteChain) Close() error {
+	// Wait for the blocks being added
+	chain.Lock()
+	defer chain.Unlock()
+
+	if chain.closed {
+		return nil
+	}
+	chain.closed = true
+
+	return chain.db.Close()
+}
+
+// Destroy removes all the blocks from the chain, deleting the database file.
+func (chain *SQLiteChain) Destroy() error {
+	err := chain.Close()
+	if err != nil {
+		return err
+	}
+	for _, suffix := range []string{"", "-journal", "-wal", "-shm"} {
+		err = os.Remove(chain.path + suffix)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// HashAlgorithm returns the hash algorithm used to mine the blocks of the
+// chain.
+func (chain *SQLiteChain) HashAlgorithm() pow.Algorithm {
+	return chain.config.algorithm
+}
+
+// ProofOfWork returns the Proof of Work used to mine the blocks of the chain.
+func (chain *SQLiteChain) ProofOfWork() pow.ProofOfWork {
+	return chain.config.proof
+}
+
+// Length returns the total size of the blockchain, this is, the number of
+// blocks of the canonical chain. It is 0 once the chain is closed.
+func (chain *SQLiteChain) Length() uint64 {
+	// Avoid reading while the database is closed
+	chain.Lock()
+	defer chain.Unlock()
+	if chain.closed {
+		return 0
+	}
+
+	var length int64
+	err := chain.db.QueryRow(
+		"SELECT COUNT(*) FROM blocks WHERE canonical = 1").Scan(&length)
+	if err != nil {
+		return 0
+	}
+	return uint64(length)
+}
+
+// NewIterator initializes the blockchain iterator from the last block.
+func (chain *SQLiteChain) NewIterator() (*ChainIterator, error) {
+	lastBlock, err := chain.GetLastBlock()
+	if err != nil {
+		return nil, err
+	}
+	iterator := ChainIterator{
+		currentHash: lastBlock.Hash,
+		chain:       chain,
+	}
+	return &iterator, nil
+}
+
+// Verify checks the integrity of the whole chain, from the last block to the
+// Genesis block. It returns a VerificationError with every invalid block found.
+func (chain *SQLiteChain) Verify() error {
+	return verifyChain(chain, chain.config)
+}
@@ -0,0 +1,124 @@
+package blockchain
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestSQLiteChainQuery checks that the blocks can be queried with SQL.
+func TestSQLiteChainQuery(t *testing.T) {
+	path := "../../test/blockchain/sqlite-query.db"
+	chain, err := NewSQLiteChain(path, WithDifficulty(4))
+	require.NoError(t, err)
+	defer func() { chain.Destroy() }()
+	newBlock, err := chain.AddBlock([]byte("this is a testing block"),
+		[]byte("this is a payment"))
+	require.NoError(t, err)
+	genesis, err := chain.GetBlockByHeight(0)
+	require.NoError(t, err)
+	branch := newBranch(genesis, 1)[0]
+	_, err = chain.ImportBlock(branch)
+	require.NoError(t, err)
+
+	// Find the children of the Genesis block
+	rows, err := chain.db.Query(`SELECT hash, height, canonical FROM blocks
+		WHERE prev_hash = ? ORDER BY canonical DESC`, genesis.Hash)
+	require.NoError(t, err)
+	defer rows.Close()
+	children := []string{}
+	for rows.Next() {
+		var hash string
+		var height uint64
+		var canonical bool
+		require.NoError(t, rows.Scan(&hash, &height, &canonical))
+		require.Equal(t, uint64(1), height)
+		require.Equal(t, hash == newBlock.Hash, canonical)
+		children = append(children, hash)
+	}
+	require.NoError(t, rows.Err())
+	require.Equal(t, []string{newBlock.Hash, branch.Hash}, children)
+
+	// The header fields are stored in their own columns
+	var merkleRoot string
+	var difficulty uint
+	err = chain.db.QueryRow(
+		"SELECT merkle_root, difficulty FROM blocks WHERE hash = ?",
+		newBlock.Hash).Scan(&merkleRoot, &difficulty)
+	require.NoError(t, err)
+	require.Equal(t, newBlock.MerkleRoot, merkleRoot)
+	require.Equal(t, newBlock.Difficulty, difficulty)
+
+	// findRecord finds the block and the index of a record from its contents
+	findRecord := func(record string) (string, int, error) {
+		var hash string
+		var idx int
+		err := chain.db.QueryRow(`SELECT blocks.hash, records.idx
+			FROM records JOIN blocks ON blocks.hash = records.block_hash
+			WHERE records.data = ? AND blocks.canonical = 1`,
+			[]byte(record)).Scan(&hash, &idx)
+		return hash, idx, err
+	}
+
+	// The records are stored in their own table
+	hash, idx, err := findRecord("this is a payment")
+	require.NoError(t, err)
+	require.Equal(t, newBlock.Hash, hash)
+	require.Equal(t, 1, idx)
+
+	// Databases created before the records table are indexed when opened
+	_, err = chain.db.Exec("DROP TABLE records")
+	require.NoError(t, err)
+	require.NoError(t, chain.Close())
+	chain, err = NewSQLiteChain(path, WithDifficulty(4))
+	require.NoError(t, err)
+	hash, idx, err = findRecord("this is a payment")
+	require.NoError(t, err)
+	require.Equal(t, newBlock.Hash, hash)
+	require.Equal(t, 1, idx)
+
+	// The records are removed along with their block
+	_, err = chain.RollbackTo(0)
+	require.NoError(t, err)
+	_, _, err = findRecord("this is a payment")
+	require.Equal(t, sql.ErrNoRows, err)
+	var records int
+	err = chain.db.QueryRow("SELECT count(*) FROM records").Scan(&records)
+	require.NoError(t, err)
+	require.Equal(t, 1, records)
+}
+
+// TestSQLiteChainReopen checks that a database can only be opened with the
+// parameters used to create it.
+func TestSQLiteChainReopen(t *testing.T) {
+	path := "../../test/blockchain/sqlite-reopen.db"
+	chain, err := NewSQLiteChain(path, WithDifficulty(4))
+	require.NoError(t, err)
+	lastBlock, err := chain.AddBlock([]byte("this is a testing block"))
+	require.NoError(t, err)
+	require.NoError(t, chain.Close())
+
+	// Open the database with different parameters
+	_, err = NewSQLiteChain(path, WithDifficulty(5))
+	require.Equal(t, ErrInvalidDifficulty, err)
+	_, err = NewSQLiteChain(path, WithDifficulty(4), WithCodec(JSONCodec{}))
+	require.Equal(t, ErrInvalidCodec, err)
+	_, err = NewSQLiteChain(path, WithDifficulty(4),
+		WithRetarget(EMARetarget{Window: 4, BlockTime: time.Minute}))
+	require.Equal(t, ErrRetargetMismatch, err)
+	_, err = NewSQLiteChain(path, WithDifficulty(4),
+		WithGenesis(FirstBlock(4)))
+	require.Equal(t, ErrInvalidGenesis, err)
+
+	// Open the database with the same parameters
+	chain, err = NewSQLiteChain(path, WithDifficulty(4))
+	require.NoError(t, err)
+	defer chain.Destroy()
+	require.Equal(t, uint64(2), chain.Length())
+	reopenedBlock, err := chain.GetLastBlock()
+	require.NoError(t, err)
+	require.Equal(t, lastBlock, reopenedBlock)
+	require.NoError(t, chain.Verify())
+}
@@ -0,0 +1,146 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrBrokenLink error when the previous block of a block is not found in the
+// chain.
+var ErrBrokenLink = errors.New("blockchain: broken link to previous block")
+
+// BlockError reports an inconsistency found in a single block of the chain.
+type BlockError struct {
+	Block *Block
+	Err   error
+}
+
+// Error prints the inconsistency along with the offending block's hash.
+func (e *BlockError) Error() string {
+	return fmt.Sprintf("%v (block %s)", e.Err, e.Block.Hash)
+}
+
+// Unwrap returns the underlying error, so it can be checked with errors.Is.
+func (e *BlockError) Unwrap() error {
+	return e.Err
+}
+
+// VerificationError reports every inconsistency found while verifying a
+// chain.
+type VerificationError struct {
+	Errors []*BlockError
+}
+
+// Error prints all the inconsistencies found in the chain.
+func (e *VerificationError) Error() string {
+	messages := make([]string, len(e.Errors))
+	for i, blockErr := range e.Errors {
+		messages[i] = blockErr.Error()
+	}
+	return fmt.Sprintf("blockchain: %d invalid blocks: %s",
+		len(e.Errors), strings.Join(messages, "; "))
+}
+
+// Is reports whether any of the inconsistencies matches the target error.
+func (e *VerificationError) Is(target error) bool {
+	for _, blockErr := range e.Errors {
+		if errors.Is(blockErr, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkTimestamp returns ErrInvalidTimestamp if the block is not later than its
+// parent or it is more than MaxTimeDrift ahead of the current time. The parent
+// is nil for the Genesis block.
+func checkTimestamp(block, parent *Block) error {
+	if parent != nil && block.Timestamp <= parent.Timestamp {
+		return ErrInvalidTimestamp
+	}
+	if block.Timestamp > time.Now().Add(MaxTimeDrift).UnixNano() {
+		return ErrInvalidTimestamp
+	}
+	return nil
+}
+
+// verifyChain walks the chain from the last block to the Genesis block checking
+// the hash, nonce, height, timestamp and difficulty of every block and the link with its
+// previous block. It returns a VerificationError with all the inconsistencies
+// found.
+func verifyChain(chain Chain, config *chainConfig) error {
+	block, err := chain.GetLastBlock()
+	if err != nil {
+		return err
+	}
+
+	// Keep track of the visited blocks to avoid looping forever if a tampered
+	// block points to one of its descendants
+	visited := map[string]bool{}
+	verificationErr := VerificationError{}
+	for {
+		visited[block.Hash] = true
+		err = block.VerifyWithProof(config.algorithm, config.proof)
+		if err != nil {
+			verificationErr.Errors = append(verificationErr.Errors,
+				&BlockError{Block: block, Err: err})
+		}
+
+		// The Genesis block has no previous block
+		if block.PrevHash == "" {
+			if block.Height != 0 {
+				verificationErr.Errors = append(verificationErr.Errors,
+					&BlockError{Block: block, Err: ErrInvalidHeight})
+			}
+			if block.Difficulty != config.difficulty {
+				verificationErr.Errors = append(verificationErr.Errors,
+					&BlockError{Block: block, Err: ErrInvalidDifficulty})
+			}
+			if checkTimestamp(block, nil) != nil {
+				verificationErr.Errors = append(verificationErr.Errors,
+					&BlockError{Block: block, Err: ErrInvalidTimestamp})
+			}
+			break
+		}
+
+		// Follow the link to the previous block
+		prevBlock, err := chain.GetBlock(block.PrevHash)
+		if err == ErrBlockNotFound || (err == nil && visited[prevBlock.Hash]) {
+			verificationErr.Errors = append(verificationErr.Errors,
+				&BlockError{Block: block, Err: ErrBrokenLink})
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		// The block must follow its previous block
+		if block.Height != prevBlock.Height+1 {
+			verificationErr.Errors = append(verificationErr.Errors,
+				&BlockError{Block: block, Err: ErrInvalidHeight})
+		}
+		if checkTimestamp(block, prevBlock) != nil {
+			verificationErr.Errors = append(verificationErr.Errors,
+				&BlockError{Block: block, Err: ErrInvalidTimestamp})
+		}
+
+		// The difficulty must be the one expected from the ancestors
+		difficulty, err := config.nextDifficulty(prevBlock, chain.GetBlock)
+		if err != nil {
+			return err
+		}
+		if block.Difficulty != difficulty {
+			verificationErr.Errors = append(verificationErr.Errors,
+				&BlockError{Block: block, Err: ErrInvalidDifficulty})
+		}
+
+		block = prevBlock
+	}
+
+	if len(verificationErr.Errors) > 0 {
+		return &verificationErr
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package blockchain
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v3"
+	"github.com/stretchr/testify/require"
+)
+
+// remine mines again the i-th block of the chain after tampering its header,
+// so it is valid by itself.
+func remine(chain *SliceChain, i int) {
+	chain.Blocks[i].ComputeHash()
+	chain.Blocks[i].Mine()
+}
+
+// TestVerifySliceChain tests the errors reported when the blocks of a chain are
+// tampered.
+func TestVerifySliceChain(t *testing.T) {
+	var tests = []struct {
+		name   string
+		tamper func(chain *SliceChain)
+		err    error
+		block  int
+	}{
+		{
+			name: "valid chain",
+			tamper: func(chain *SliceChain) {
+			},
+			err: nil,
+		},
+		{
+			name: "tampered data",
+			tamper: func(chain *SliceChain) {
+				chain.Blocks[1].Records[0] = []byte("this is a tampered block")
+			},
+			err:   ErrInvalidMerkleRoot,
+			block: 1,
+		},
+		{
+			name: "tampered header",
+			tamper: func(chain *SliceChain) {
+				chain.Blocks[1].Timestamp++
+			},
+			err:   ErrInvalidNonce,
+			block: 1,
+		},
+		{
+			name: "tampered hash",
+			tamper: func(chain *SliceChain) {
+				chain.Blocks[2].Hash = "0000" + chain.Blocks[2].Hash[4:60] + "0000"
+			},
+			err:   ErrInvalidHash,
+			block: 2,
+		},
+		{
+			name: "timestamp before parent",
+			tamper: func(chain *SliceChain) {
+				chain.Blocks[2].Timestamp = chain.Blocks[1].Timestamp
+				remine(chain, 2)
+			},
+			err:   ErrInvalidTimestamp,
+			block: 2,
+		},
+		{
+			name: "timestamp in the future",
+			tamper: func(chain *SliceChain) {
+				chain.Blocks[2].Timestamp = time.Now().Add(2 * MaxTimeDrift).UnixNano()
+				remine(chain, 2)
+			},
+			err:   ErrInvalidTimestamp,
+			block: 2,
+		},
+		{
+			name: "missing block",
+			tamper: func(chain *SliceChain) {
+				chain.Blocks = append(chain.Blocks[:1], chain.Blocks[2:]...)
+			},
+			err:   ErrBrokenLink,
+			block: 1,
+		},
+	}
+
+	for _, test := range tests {
+		// Initialize a chain with some blocks and tamper it
+		chain, err := NewSliceChain()
+		require.NoError(t, err)
+		for i := 0; i < 2; i++ {
+			_, err = chain.AddBlock([]byte("this is a testing block"))
+			require.NoError(t, err)
+		}
+		test.tamper(chain)
+
+		// Check the reported error and the offending block
+		err = chain.Verify()
+		if test.err == nil {
+			require.NoError(t, err, test.name)
+			continue
+		}
+		require.True(t, errors.Is(err, test.err), test.name)
+
+		var verificationErr *VerificationError
+		require.True(t, errors.As(err, &verificationErr), test.name)
+		require.Len(t, verificationErr.Errors, 1, test.name)
+		require.Equal(t, chain.Blocks[test.block], verificationErr.Errors[0].Block,
+			test.name)
+	}
+}
+
+// TestVerifyBadgerChain tests the errors reported when a block stored in a
+// Badger database is tampered.
+func TestVerifyBadgerChain(t *testing.T) {
+	chain, err := NewBadgerChain("../../test/blockchain/badger-verify")
+	require.NoError(t, err)
+	defer chain.Destroy()
+
+	block, err := chain.AddBlock([]byte("this is a testing block"))
+	require.NoError(t, err)
+	_, err = chain.AddBlock([]byte("this is a testing block"))
+	require.NoError(t, err)
+	require.NoError(t, chain.Verify())
+
+	// Overwrite the stored block with a tampered copy
+	block.Records[0] = []byte("this is a tampered block")
+	blockBytes, err := block.Serialize()
+	require.NoError(t, err)
+	err = chain.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(block.Hash), blockBytes)
+	})
+	require.NoError(t, err)
+
+	err = chain.Verify()
+	require.True(t, errors.Is(err, ErrInvalidMerkleRoot))
+}
@@ -0,0 +1,97 @@
+package pow
+
+import (
+	"crypto/sha256"
+	"errors"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/sha3"
+)
+
+// ErrUnknownAlgorithm error when a hash algorithm is not supported.
+var ErrUnknownAlgorithm = errors.New("pow: unknown hash algorithm")
+
+// Algorithm is a hash function with a 256-bit digest, used to hash the blocks
+// and to find their nonce.
+type Algorithm uint8
+
+// Supported hash algorithms. SHA256 is the default one.
+const (
+	// SHA256 is the sha256 algorithm: https://datatracker.ietf.org/doc/html/rfc6234
+	SHA256 Algorithm = iota
+	// DoubleSHA256 is the sha256 of the sha256, as used by Bitcoin.
+	DoubleSHA256
+	// SHA3_256 is the sha3-256 algorithm: https://doi.org/10.6028/NIST.FIPS.202
+	SHA3_256
+	// BLAKE2b_256 is the blake2b algorithm with a 256-bit digest:
+	// https://datatracker.ietf.org/doc/html/rfc7693
+	BLAKE2b_256
+)
+
+// algorithmNames stores the name of every supported algorithm.
+var algorithmNames = map[Algorithm]string{
+	SHA256:       "sha256",
+	DoubleSHA256: "double-sha256",
+	SHA3_256:     "sha3-256",
+	BLAKE2b_256:  "blake2b-256",
+}
+
+// ParseAlgorithm returns the algorithm with the given name. If there is no
+// such algorithm, ErrUnknownAlgorithm is returned.
+func ParseAlgorithm(name string) (Algorithm, error) {
+	for algorithm, algorithmName := range algorithmNames {
+		if name == algorithmName {
+			return algorithm, nil
+		}
+	}
+	return 0, ErrUnknownAlgorithm
+}
+
+// Valid checks if the algorithm is supported.
+func (a Algorithm) Valid() bool {
+	_, ok := algorithmNames[a]
+	return ok
+}
+
+// String returns the name of the algorithm.
+func (a Algorithm) String() string {
+	name, ok := algorithmNames[a]
+	if !ok {
+		return "unknown"
+	}
+	return name
+}
+
+// MarshalText encodes the algorithm as its name.
+func (a Algorithm) MarshalText() ([]byte, error) {
+	if !a.Valid() {
+		return nil, ErrUnknownAlgorithm
+	}
+	return []byte(a.String()), nil
+}
+
+// UnmarshalText decodes the algorithm from its name.
+func (a *Algorithm) UnmarshalText(text []byte) error {
+	algorithm, err := ParseAlgorithm(string(text))
+	if err != nil {
+		return err
+	}
+	*a = algorithm
+	return nil
+}
+
+// Sum returns the 256-bit digest of the data. Unknown algorithms fall back to
+// sha256, check them with Valid.
+func (a Algorithm) Sum(data []byte) [32]byte {
+	switch a {
+	case DoubleSHA256:
+		hash := sha256.Sum256(data)
+		return sha256.Sum256(hash[:])
+	case SHA3_256:
+		return sha3.Sum256(data)
+	case BLAKE2b_256:
+		return blake2b.Sum256(data)
+	default:
+		return sha256.Sum256(data)
+	}
+}
@@ -0,0 +1,79 @@
+package pow
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestAlgorithmSum tests the digest of every hash algorithm.
+func TestAlgorithmSum(t *testing.T) {
+	var tests = []struct {
+		algorithm Algorithm
+		digest    string
+	}{
+		{
+			algorithm: SHA256,
+			digest:    "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+		},
+		{
+			algorithm: DoubleSHA256,
+			digest:    "4f8b42c22dd3729b519ba6f68d2da7cc5b2d606d05daed5ad5128cc03e6c6358",
+		},
+		{
+			algorithm: SHA3_256,
+			digest:    "3a985da74fe225b2045c172d6bd390bd855f086e3e9d525b46bfe24511431532",
+		},
+		{
+			algorithm: BLAKE2b_256,
+			digest:    "bddd813c634239723171ef3fee98579b94964e3bb1cb3e427262c8c068d52319",
+		},
+	}
+
+	for _, test := range tests {
+		digest := test.algorithm.Sum([]byte("abc"))
+		require.Equal(t, test.digest, hex.EncodeToString(digest[:]),
+			test.algorithm.String())
+	}
+}
+
+// TestParseAlgorithm tests the conversion of the algorithms from and to their
+// names.
+func TestParseAlgorithm(t *testing.T) {
+	for _, algorithm := range []Algorithm{SHA256, DoubleSHA256, SHA3_256, BLAKE2b_256} {
+		require.True(t, algorithm.Valid())
+
+		parsed, err := ParseAlgorithm(algorithm.String())
+		require.NoError(t, err)
+		require.Equal(t, algorithm, parsed)
+
+		text, err := algorithm.MarshalText()
+		require.NoError(t, err)
+		var unmarshaled Algorithm
+		require.NoError(t, unmarshaled.UnmarshalText(text))
+		require.Equal(t, algorithm, unmarshaled)
+	}
+
+	_, err := ParseAlgorithm("md5")
+	require.Equal(t, ErrUnknownAlgorithm, err)
+
+	unknown := Algorithm(42)
+	require.False(t, unknown.Valid())
+	require.Equal(t, "unknown", unknown.String())
+	_, err = unknown.MarshalText()
+	require.Equal(t, ErrUnknownAlgorithm, err)
+}
+
+// TestVerifyNonceWith checks that a nonce found with an algorithm is only valid
+// for that algorithm.
+func TestVerifyNonceWith(t *testing.T) {
+	data := []byte("this is a testing block")
+	miner := NewMiner(2, true).WithAlgorithm(SHA3_256)
+	require.Equal(t, SHA3_256, miner.Algorithm())
+
+	nonce, err := miner.FindNonce(data, 8)
+	require.NoError(t, err)
+	require.NoError(t, VerifyNonceWith(SHA3_256, data, nonce, 8))
+	require.Error(t, VerifyNonceWith(SHA256, data, nonce, 8))
+}
@@ -0,0 +1,144 @@
+package pow
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/big"
+)
+
+// DefaultMemoryCells is the number of 32-byte cells used by the memory-hard
+// Proof of Work when none is given, this is 512 KiB per nonce.
+const DefaultMemoryCells = 1 << 14
+
+// MemoryHard is a memory-hard Proof of Work in the style of the ROMix function
+// of scrypt: https://datatracker.ietf.org/doc/html/rfc7914#section-5
+//
+// The payload of a nonce is computed in two steps. First, a table of cells is
+// filled by hashing the data and the nonce value over and over:
+//
+// V[0] = H(data | nonce), V[i] = H(V[i-1])
+//
+// Then, the table is read in an order that depends on the values read so far,
+// so every cell must be kept in memory or recomputed:
+//
+// X = H(V[n-1]), X = H(X xor V[X mod n]) n times
+//
+// The payload is the final X and it must be smaller than the target of the
+// hashcash algorithm. Unlike hashcash, verifying a nonce costs as much memory
+// and time as trying one while solving.
+type MemoryHard struct {
+	cells     int
+	algorithm Algorithm
+}
+
+// NewMemoryHard returns a memory-hard Proof of Work using the given number of
+// cells and hash algorithm. If cells is not positive, DefaultMemoryCells is
+// used.
+func NewMemoryHard(cells int, algorithm Algorithm) *MemoryHard {
+	if cells <= 0 {
+		cells = DefaultMemoryCells
+	}
+	memoryHard := MemoryHard{
+		cells:     cells,
+		algorithm: algorithm,
+	}
+	return &memoryHard
+}
+
+// Name returns the identifier of the memory-hard algorithm with its hash
+// algorithm and number of cells.
+func (m *MemoryHard) Name() string {
+	return fmt.Sprintf("memory-hard/%s/%d", m.algorithm, m.cells)
+}
+
+// Solve finds the lowest nonce whose payload is smaller than the target of the
+// difficulty. The search is aborted with ErrMiningCanceled when the context is
+// canceled or its deadline is exceeded.
+func (m *MemoryHard) Solve(ctx context.Context, data []byte, difficulty uint) (*Nonce, error) {
+	// Initialize the target
+	target, err := initTarget(difficulty)
+	if err != nil {
+		return nil, err
+	}
+
+	// The table is reused for every nonce value
+	table := make([][32]byte, m.cells)
+	for alpha := int32(0); alpha < math.MaxInt32; alpha++ {
+		// Stop searching if the context is done
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w: %v", ErrMiningCanceled, ctx.Err())
+		default:
+		}
+
+		// Is the nonce payload smaller than the target number?
+		payload := m.payload(table, data, alpha)
+		if target.Cmp(new(big.Int).SetBytes(payload)) > 0 {
+			nonce := Nonce{
+				Value:   alpha,
+				Payload: payload,
+			}
+			return &nonce, nil
+		}
+	}
+
+	return nil, ErrNonceNotFound
+}
+
+// Verify checks that the nonce payload is the one computed from its value and
+// that it is smaller than the target of the difficulty. A nil nonce returns
+// ErrMissingNonce.
+func (m *MemoryHard) Verify(data []byte, nonce *Nonce, difficulty uint) error {
+	if nonce == nil {
+		return ErrMissingNonce
+	}
+
+	// Initialize the target
+	target, err := initTarget(difficulty)
+	if err != nil {
+		return err
+	}
+
+	// Recompute the payload from the nonce value
+	payload := m.payload(make([][32]byte, m.cells), data, nonce.Value)
+
+	// Is the nonce payload smaller than the target number?
+	if target.Cmp(new(big.Int).SetBytes(payload)) <= 0 {
+		return ErrInvalidNonce
+	}
+
+	// Does the nonce payload match the recomputed one?
+	if !bytes.Equal(payload, nonce.Payload) {
+		return ErrPayloadMismatch
+	}
+
+	return nil
+}
+
+// payload computes the payload of the nonce value for the data, using the
+// table to store the cells.
+func (m *MemoryHard) payload(table [][32]byte, data []byte, value int32) []byte {
+	// Fill the table from the data and the nonce value
+	seed := make([]byte, len(data)+4)
+	copy(seed, data)
+	binary.BigEndian.PutUint32(seed[len(data):], uint32(value))
+	table[0] = m.algorithm.Sum(seed)
+	for i := 1; i < len(table); i++ {
+		table[i] = m.algorithm.Sum(table[i-1][:])
+	}
+
+	// Read the table in a data-dependent order
+	mix := m.algorithm.Sum(table[len(table)-1][:])
+	for i := 0; i < len(table); i++ {
+		cell := table[binary.BigEndian.Uint64(mix[:8])%uint64(len(table))]
+		for j := range mix {
+			mix[j] ^= cell[j]
+		}
+		mix = m.algorithm.Sum(mix[:])
+	}
+
+	return mix[:]
+}
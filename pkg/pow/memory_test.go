@@ -0,0 +1,70 @@
+package pow
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestMemoryHard tests that the nonces found by the memory-hard Proof of Work
+// are only valid for the same data and parameters.
+func TestMemoryHard(t *testing.T) {
+	data := b64ToBytes("gd3I0kiy3M3T/dXoTwytYrCPLRC1f5qDHBNFHlxcgKU=")
+	proofs := []ProofOfWork{
+		NewMemoryHard(1024, SHA256),
+		NewMemoryHard(1024, BLAKE2b_256),
+		NewMemoryHard(2048, SHA256),
+	}
+
+	names := map[string]bool{}
+	for _, proof := range proofs {
+		nonce, err := proof.Solve(context.Background(), data, 8)
+		require.NoError(t, err, proof.Name())
+		require.NoError(t, proof.Verify(data, nonce, 8), proof.Name())
+
+		// The payload depends on the data
+		require.Error(t, proof.Verify([]byte("tampered"), nonce, 8),
+			proof.Name())
+
+		// A missing nonce is an error, not a panic
+		require.Equal(t, ErrMissingNonce, proof.Verify(data, nil, 8),
+			proof.Name())
+
+		// The payload must be the one computed from the nonce value
+		tampered := Nonce{Value: nonce.Value, Payload: make([]byte, 32)}
+		require.Equal(t, ErrPayloadMismatch, proof.Verify(data, &tampered, 8),
+			proof.Name())
+
+		// The names identify the parameters
+		require.False(t, names[proof.Name()], proof.Name())
+		names[proof.Name()] = true
+	}
+
+	// The number of cells defaults to DefaultMemoryCells
+	require.Equal(t, "memory-hard/sha256/16384", NewMemoryHard(0, SHA256).Name())
+}
+
+// TestMemoryHardSolveContext tests that the search is aborted when the context
+// is done.
+func TestMemoryHardSolveContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	proof := NewMemoryHard(1024, SHA256)
+	_, err := proof.Solve(ctx, []byte("this is a testing block"), 8)
+	require.True(t, errors.Is(err, ErrMiningCanceled))
+}
+
+// TestMinerProofOfWork tests the miner as a ProofOfWork.
+func TestMinerProofOfWork(t *testing.T) {
+	data := b64ToBytes("gd3I0kiy3M3T/dXoTwytYrCPLRC1f5qDHBNFHlxcgKU=")
+	var proof ProofOfWork = NewMiner(2, true).WithAlgorithm(SHA3_256)
+	require.Equal(t, "hashcash/sha3-256", proof.Name())
+
+	nonce, err := proof.Solve(context.Background(), data, 8)
+	require.NoError(t, err)
+	require.NoError(t, proof.Verify(data, nonce, 8))
+	require.NoError(t, VerifyNonceWith(SHA3_256, data, nonce, 8))
+}
@@ -0,0 +1,158 @@
+package pow
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/big"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// Miner searches the nonce of the hashcash algorithm using several workers in
+// parallel. The nonce space is interleaved between the workers, so the worker
+// i tries the numbers i, i+n, i+2n... where n is the number of workers.
+type Miner struct {
+	workers   int
+	lowest    bool
+	algorithm Algorithm
+}
+
+// NewMiner returns a miner with the given number of workers. If workers is not
+// positive, one worker per CPU is used. If lowest is true, the miner always
+// returns the lowest nonce, this is the same nonce returned by FindNonce.
+// Otherwise, the first nonce found by any worker is returned.
+func NewMiner(workers int, lowest bool) *Miner {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	miner := Miner{
+		workers:   workers,
+		lowest:    lowest,
+		algorithm: SHA256,
+	}
+	return &miner
+}
+
+// WithAlgorithm returns a copy of the miner that computes the nonce payloads
+// with the given hash algorithm instead of sha256.
+func (m *Miner) WithAlgorithm(algorithm Algorithm) *Miner {
+	miner := *m
+	miner.algorithm = algorithm
+	return &miner
+}
+
+// Algorithm returns the hash algorithm used by the miner.
+func (m *Miner) Algorithm() Algorithm {
+	return m.algorithm
+}
+
+// Name returns the identifier of the hashcash algorithm with the miner's hash
+// algorithm, so the miner can be used as a ProofOfWork.
+func (m *Miner) Name() string {
+	return "hashcash/" + m.algorithm.String()
+}
+
+// Solve finds the nonce that satisfies the hashcash algorithm, as
+// FindNonceContext does.
+func (m *Miner) Solve(ctx context.Context, data []byte, difficulty uint) (*Nonce, error) {
+	return m.FindNonceContext(ctx, data, difficulty)
+}
+
+// Verify checks that the nonce satisfies the hashcash algorithm for the given
+// data with the miner's hash algorithm.
+func (m *Miner) Verify(data []byte, nonce *Nonce, difficulty uint) error {
+	return VerifyNonceWith(m.algorithm, data, nonce, difficulty)
+}
+
+// FindNonce will find the nonce as the number that satisfies the hashcash
+// algorithm using all the miner workers.
+func (m *Miner) FindNonce(data []byte, difficulty uint) (*Nonce, error) {
+	return m.FindNonceContext(context.Background(), data, difficulty)
+}
+
+// FindNonceContext will find the nonce as the number that satisfies the
+// hashcash algorithm using all the miner workers. The search is aborted with
+// ErrMiningCanceled when the context is canceled or its deadline is exceeded.
+func (m *Miner) FindNonceContext(ctx context.Context, data []byte, difficulty uint) (*Nonce, error) {
+	// Initialize the target
+	target, err := initTarget(difficulty)
+	if err != nil {
+		return nil, err
+	}
+
+	// The search context is used to stop the remaining workers as soon as the
+	// nonce is found
+	searchCtx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	// Lowest nonce value found so far, shared between all the workers
+	best := int64(math.MaxInt32)
+
+	// Each worker stores the nonce it has found in its own position
+	nonces := make([]*Nonce, m.workers)
+	var wg sync.WaitGroup
+	for worker := 0; worker < m.workers; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+
+			// Loop until the potencial nonce number (alpha) matches the
+			// hashcash condition or a lower nonce has been found by another
+			// worker
+			step := int64(m.workers)
+			for alpha := int64(worker); alpha < atomic.LoadInt64(&best); alpha += step {
+				// Stop searching if the search is done
+				select {
+				case <-searchCtx.Done():
+					return
+				default:
+				}
+
+				// create a new test number
+				nonce := newNonce(m.algorithm, data, int32(alpha))
+
+				// Is the nonce payload smaller than the target number?
+				if target.Cmp(new(big.Int).SetBytes(nonce.Payload)) > 0 {
+					nonces[worker] = nonce
+					lowerBest(&best, alpha)
+					if !m.lowest {
+						stop()
+					}
+					return
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	// Choose the lowest nonce among the ones found by the workers
+	var found *Nonce
+	for _, nonce := range nonces {
+		if nonce != nil && (found == nil || nonce.Value < found.Value) {
+			found = nonce
+		}
+	}
+
+	// The lowest nonce is not guaranteed if the search has been canceled
+	if ctx.Err() != nil && (found == nil || m.lowest) {
+		return nil, fmt.Errorf("%w: %v", ErrMiningCanceled, ctx.Err())
+	}
+	if found == nil {
+		return nil, ErrNonceNotFound
+	}
+
+	return found, nil
+}
+
+// lowerBest sets the best nonce value to alpha if it is lower than the current
+// one.
+func lowerBest(best *int64, alpha int64) {
+	for {
+		current := atomic.LoadInt64(best)
+		if alpha >= current || atomic.CompareAndSwapInt64(best, current, alpha) {
+			return
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package pow
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestMinerFindNonce tests that the miner returns the lowest nonce regardless
+// of the number of workers.
+func TestMinerFindNonce(t *testing.T) {
+	var tests = []struct {
+		data       []byte
+		nonce      Nonce
+		difficulty uint
+	}{
+		{
+			data: b64ToBytes("gd3I0kiy3M3T/dXoTwytYrCPLRC1f5qDHBNFHlxcgKU="),
+			nonce: Nonce{
+				Value:   668,
+				Payload: b64ToBytes("AAAbYKPkOFcxWkh0z4iGQ20gkmRzC+9HuDRPynEPwhM="),
+			},
+			difficulty: 16,
+		},
+		{
+			data: b64ToBytes("xL2OQM8Z7a5QloweIkbbBv45sxtX/j4/84h5HmqQxUE="),
+			nonce: Nonce{
+				Value:   56666,
+				Payload: b64ToBytes("AACan9a7F7IwjPDPMmMy1sFaXag0hLflf/uquU9HrSo="),
+			},
+			difficulty: 16,
+		},
+	}
+
+	for _, workers := range []int{0, 1, 2, 3, 8, 16} {
+		miner := NewMiner(workers, true)
+		for _, test := range tests {
+			nonce, err := miner.FindNonce(test.data, test.difficulty)
+			require.NoError(t, err)
+			require.Equal(t, test.nonce, *nonce)
+		}
+	}
+}
+
+// TestMinerFindAnyNonce tests that the nonce returned by a non-deterministic
+// miner satisfies the hashcash algorithm.
+func TestMinerFindAnyNonce(t *testing.T) {
+	data := b64ToBytes("xL2OQM8Z7a5QloweIkbbBv45sxtX/j4/84h5HmqQxUE=")
+	miner := NewMiner(8, false)
+	nonce, err := miner.FindNonce(data, 16)
+	require.NoError(t, err)
+	require.NoError(t, VerifyNonce(data, nonce, 16))
+}
+
+// TestMinerFindNonceContext tests that all the workers stop when the context is
+// done.
+func TestMinerFindNonceContext(t *testing.T) {
+	data := b64ToBytes("gd3I0kiy3M3T/dXoTwytYrCPLRC1f5qDHBNFHlxcgKU=")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for _, lowest := range []bool{true, false} {
+		miner := NewMiner(4, lowest)
+		nonce, err := miner.FindNonceContext(ctx, data, 16)
+		require.Nil(t, nonce)
+		require.True(t, errors.Is(err, ErrMiningCanceled))
+	}
+}
+
+// BenchmarkFindNonce measures the single-threaded nonce search.
+func BenchmarkFindNonce(b *testing.B) {
+	data := b64ToBytes("xL2OQM8Z7a5QloweIkbbBv45sxtX/j4/84h5HmqQxUE=")
+	for i := 0; i < b.N; i++ {
+		FindNonce(data, 16)
+	}
+}
+
+// BenchmarkMinerFindNonce measures the parallel nonce search using one worker
+// per CPU.
+func BenchmarkMinerFindNonce(b *testing.B) {
+	data := b64ToBytes("xL2OQM8Z7a5QloweIkbbBv45sxtX/j4/84h5HmqQxUE=")
+	miner := NewMiner(0, true)
+	for i := 0; i < b.N; i++ {
+		miner.FindNonce(data, 16)
+	}
+}
@@ -1,9 +1,11 @@
 package pow
 
 import (
-	"crypto/sha256"
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"math"
 	"math/big"
 )
@@ -11,6 +13,28 @@ import (
 // ErrNonceNotFound error when a nonce is not found.
 var ErrNonceNotFound = errors.New("pow: nonce not found")
 
+// ErrMiningCanceled error when the nonce search is canceled before finding a
+// nonce.
+var ErrMiningCanceled = errors.New("pow: mining canceled")
+
+// ErrInvalidNonce error when a nonce does not satisfy the hashcash algorithm.
+var ErrInvalidNonce = errors.New("pow: invalid nonce")
+
+// MaxDifficulty is the highest difficulty returned by RetargetDifficulty. The
+// difficulty 256 is valid, but only a zero payload satisfies it.
+const MaxDifficulty uint = 255
+
+// ErrInvalidDifficulty error when a difficulty is outside the range of the
+// hashcash algorithm, from 1 to 256 bits.
+var ErrInvalidDifficulty = errors.New("pow: difficulty out of range")
+
+// ErrMissingNonce error when a nil nonce is verified.
+var ErrMissingNonce = errors.New("pow: missing nonce")
+
+// ErrPayloadMismatch error when the payload of a nonce does not match the one
+// computed from its value.
+var ErrPayloadMismatch = errors.New("pow: nonce payload mismatch")
+
 // Nonce is the first number that satisfies the hashcat algorithm:
 //
 // data + nonce < target
@@ -20,18 +44,18 @@ type Nonce struct {
 }
 
 // newNonce returns a nonce with its corresponding payload.
-func newNonce(data []byte, value int32) *Nonce {
+func newNonce(algorithm Algorithm, data []byte, value int32) *Nonce {
 	nonce := Nonce{
 		Value:   value,
 		Payload: []byte{},
 	}
-	nonce.computePayload(data)
+	nonce.computePayload(algorithm, data)
 	return &nonce
 }
 
 // computePayload generates the nonce payload by the sum of the nonce value and
 // the original data.
-func (n *Nonce) computePayload(data []byte) {
+func (n *Nonce) computePayload(algorithm Algorithm, data []byte) {
 	// Convert the data and the nonce to big integer
 	dataBigInt := new(big.Int).SetBytes(data)
 	nonceBigInt := big.NewInt(int64(n.Value))
@@ -39,28 +63,109 @@ func (n *Nonce) computePayload(data []byte) {
 	// Create the payload by adding the nonce to the original data
 	payloadBigInt := new(big.Int).Add(dataBigInt, nonceBigInt)
 
-	// Apply the sha256 algorithm to the payload
-	hash := sha256.Sum256(payloadBigInt.Bytes())
+	// Apply the hash algorithm to the payload
+	hash := algorithm.Sum(payloadBigInt.Bytes())
 	n.Payload = hash[:]
 }
 
 // initTarget will generate the hashcat target based on the difficulty
-// parameter.
-func initTarget(difficulty uint) *big.Int {
+// parameter. ErrInvalidDifficulty is returned if the difficulty is 0, which
+// accepts every nonce, or greater than 256, which accepts none.
+func initTarget(difficulty uint) (*big.Int, error) {
+	if difficulty < 1 || difficulty > 256 {
+		return nil, ErrInvalidDifficulty
+	}
+	return targetOf(difficulty), nil
+}
+
+// targetOf returns the hashcash target of the difficulty without checking its
+// range, this is, 2^(256-difficulty).
+func targetOf(difficulty uint) *big.Int {
 	return new(big.Int).Lsh(big.NewInt(1), uint(256-difficulty))
 }
 
+// RetargetDifficulty scales the target of the given difficulty by the ratio
+// between the actual and the expected timespans, and returns the difficulty
+// whose target is the closest one. If blocks are found faster than expected,
+// the target gets smaller and the difficulty higher. As targets are powers of
+// two, the difficulty only changes when the ratio is below 1/√2 or above √2.
+// Both the given and the returned difficulties are limited to the range from
+// 1 to MaxDifficulty, as a difficulty of 0 would accept every nonce.
+func RetargetDifficulty(difficulty uint, actual, expected int64) uint {
+	difficulty = clampDifficulty(difficulty)
+
+	// Timespans must be positive
+	if actual < 1 {
+		actual = 1
+	}
+	if expected < 1 {
+		expected = 1
+	}
+
+	// Scale the target: target * actual / expected
+	target := targetOf(difficulty)
+	target.Mul(target, big.NewInt(actual))
+	target.Div(target, big.NewInt(expected))
+	if target.Sign() == 0 {
+		return MaxDifficulty
+	}
+
+	// Find the closest power of two in the logarithmic scale. The target is
+	// between 2^n and 2^(n+1), and it is closer to 2^(n+1) if target^2 is
+	// greater than or equal to 2^(2n+1).
+	exponent := target.BitLen() - 1
+	square := new(big.Int).Mul(target, target)
+	midpoint := new(big.Int).Lsh(big.NewInt(1), uint(2*exponent+1))
+	if square.Cmp(midpoint) >= 0 {
+		exponent++
+	}
+
+	// The target of a difficulty d is 2^(256-d)
+	if exponent >= 256 {
+		return 1
+	}
+	return clampDifficulty(uint(256 - exponent))
+}
+
+// clampDifficulty limits the difficulty to the range from 1 to MaxDifficulty.
+func clampDifficulty(difficulty uint) uint {
+	if difficulty < 1 {
+		return 1
+	}
+	if difficulty > MaxDifficulty {
+		return MaxDifficulty
+	}
+	return difficulty
+}
+
 // FindNonce will find the nonce as the number that satisfies the hashcash
 // algorithm.
 func FindNonce(data []byte, difficulty uint) (*Nonce, error) {
+	return FindNonceContext(context.Background(), data, difficulty)
+}
+
+// FindNonceContext will find the nonce as the number that satisfies the
+// hashcash algorithm. The search is aborted with ErrMiningCanceled when the
+// context is canceled or its deadline is exceeded.
+func FindNonceContext(ctx context.Context, data []byte, difficulty uint) (*Nonce, error) {
 	// Initialize the target
-	target := initTarget(difficulty)
+	target, err := initTarget(difficulty)
+	if err != nil {
+		return nil, err
+	}
 
 	// Loop until the potencial nonce number (alpha) matches the hashcash
 	// condition
 	for alpha := int32(0); alpha < math.MaxInt32; alpha++ {
+		// Stop searching if the context is done
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w: %v", ErrMiningCanceled, ctx.Err())
+		default:
+		}
+
 		// create a new test number
-		nonce := newNonce(data, alpha)
+		nonce := newNonce(SHA256, data, alpha)
 
 		// Is the nonce payload smaller than the target number?
 		if target.Cmp(new(big.Int).SetBytes(nonce.Payload)) > 0 {
@@ -71,6 +176,43 @@ func FindNonce(data []byte, difficulty uint) (*Nonce, error) {
 	return nil, ErrNonceNotFound
 }
 
+// VerifyNonce checks that the nonce satisfies the hashcash algorithm for the
+// given data without searching it again. The payload is recomputed from the
+// nonce value and compared with the nonce payload.
+func VerifyNonce(data []byte, nonce *Nonce, difficulty uint) error {
+	return VerifyNonceWith(SHA256, data, nonce, difficulty)
+}
+
+// VerifyNonceWith checks that the nonce satisfies the hashcash algorithm for
+// the given data, computing the payload with the given hash algorithm. A nil
+// nonce returns ErrMissingNonce.
+func VerifyNonceWith(algorithm Algorithm, data []byte, nonce *Nonce, difficulty uint) error {
+	if nonce == nil {
+		return ErrMissingNonce
+	}
+
+	// Initialize the target
+	target, err := initTarget(difficulty)
+	if err != nil {
+		return err
+	}
+
+	// Recompute the payload from the nonce value
+	expected := newNonce(algorithm, data, nonce.Value)
+
+	// Is the nonce payload smaller than the target number?
+	if target.Cmp(new(big.Int).SetBytes(expected.Payload)) <= 0 {
+		return ErrInvalidNonce
+	}
+
+	// Does the nonce payload match the recomputed one?
+	if !bytes.Equal(expected.Payload, nonce.Payload) {
+		return ErrPayloadMismatch
+	}
+
+	return nil
+}
+
 // String prints the nonce in json format.
 func (n Nonce) String() string {
 	jsonNonce, _ := json.MarshalIndent(n, "", "  ")
@@ -1,9 +1,12 @@
 package pow
 
 import (
+	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -39,12 +42,70 @@ func TestInitTarget(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		target := initTarget(test.difficulty)
+		target, err := initTarget(test.difficulty)
+		require.NoError(t, err)
 		targetHex := fmt.Sprintf("0x%x", target)
 		require.Equal(t, test.target, targetHex)
 	}
 }
 
+// TestDifficultyRange checks that difficulties outside the range of the
+// hashcash algorithm are rejected.
+func TestDifficultyRange(t *testing.T) {
+	data := []byte("this is a testing block")
+	nonce := newNonce(SHA256, data, 0)
+
+	for _, difficulty := range []uint{0, 257, 1 << 20} {
+		_, err := initTarget(difficulty)
+		require.Equal(t, ErrInvalidDifficulty, err)
+		_, err = FindNonce(data, difficulty)
+		require.Equal(t, ErrInvalidDifficulty, err)
+		_, err = NewMiner(2, true).FindNonce(data, difficulty)
+		require.Equal(t, ErrInvalidDifficulty, err)
+		_, err = NewMemoryHard(16, SHA256).Solve(context.Background(), data, difficulty)
+		require.Equal(t, ErrInvalidDifficulty, err)
+		require.Equal(t, ErrInvalidDifficulty, VerifyNonce(data, nonce, difficulty))
+	}
+
+	// The highest difficulty only accepts a zero payload
+	target, err := initTarget(256)
+	require.NoError(t, err)
+	require.Equal(t, "0x1", fmt.Sprintf("0x%x", target))
+}
+
+// TestRetargetDifficulty tests the difficulty adjustment from the ratio between
+// the actual and expected timespans.
+func TestRetargetDifficulty(t *testing.T) {
+	var tests = []struct {
+		difficulty uint
+		actual     int64
+		expected   int64
+		result     uint
+	}{
+		{difficulty: 16, actual: 100, expected: 100, result: 16},
+		{difficulty: 16, actual: 50, expected: 100, result: 17},
+		{difficulty: 16, actual: 25, expected: 100, result: 18},
+		{difficulty: 16, actual: 200, expected: 100, result: 15},
+		{difficulty: 16, actual: 400, expected: 100, result: 14},
+		{difficulty: 16, actual: 80, expected: 100, result: 16},
+		{difficulty: 16, actual: 140, expected: 100, result: 16},
+		{difficulty: 16, actual: 142, expected: 100, result: 15},
+		{difficulty: 16, actual: 70, expected: 100, result: 17},
+		{difficulty: 16, actual: 0, expected: 100, result: 23},
+		{difficulty: 1, actual: 400, expected: 100, result: 1},
+		{difficulty: 2, actual: 400, expected: 100, result: 1},
+		{difficulty: 250, actual: 1, expected: 1 << 10, result: 255},
+		{difficulty: 255, actual: 50, expected: 100, result: 255},
+		{difficulty: 0, actual: 100, expected: 100, result: 1},
+		{difficulty: 300, actual: 100, expected: 100, result: 255},
+	}
+
+	for _, test := range tests {
+		result := RetargetDifficulty(test.difficulty, test.actual, test.expected)
+		require.Equal(t, test.result, result)
+	}
+}
+
 // TestFindNonce tests the match of a nonce.
 func TestFindNonce(t *testing.T) {
 	var tests = []struct {
@@ -76,3 +137,78 @@ func TestFindNonce(t *testing.T) {
 		require.NoError(t, err)
 	}
 }
+
+// TestFindNonceContext tests that the nonce search stops when the context is
+// done.
+func TestFindNonceContext(t *testing.T) {
+	data := b64ToBytes("gd3I0kiy3M3T/dXoTwytYrCPLRC1f5qDHBNFHlxcgKU=")
+
+	// A canceled context aborts the search before trying any nonce
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	nonce, err := FindNonceContext(ctx, data, 16)
+	require.Nil(t, nonce)
+	require.True(t, errors.Is(err, ErrMiningCanceled))
+
+	// An exceeded deadline aborts a search that would take too long
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	nonce, err = FindNonceContext(ctx, data, 250)
+	require.Nil(t, nonce)
+	require.True(t, errors.Is(err, ErrMiningCanceled))
+}
+
+// TestVerifyNonce tests the verification of a nonce.
+func TestVerifyNonce(t *testing.T) {
+	var tests = []struct {
+		data       []byte
+		nonce      Nonce
+		difficulty uint
+		err        error
+	}{
+		{
+			data: b64ToBytes("gd3I0kiy3M3T/dXoTwytYrCPLRC1f5qDHBNFHlxcgKU="),
+			nonce: Nonce{
+				Value:   668,
+				Payload: b64ToBytes("AAAbYKPkOFcxWkh0z4iGQ20gkmRzC+9HuDRPynEPwhM="),
+			},
+			difficulty: 16,
+			err:        nil,
+		},
+		{
+			data: b64ToBytes("gd3I0kiy3M3T/dXoTwytYrCPLRC1f5qDHBNFHlxcgKU="),
+			nonce: Nonce{
+				Value:   667,
+				Payload: b64ToBytes("AAAbYKPkOFcxWkh0z4iGQ20gkmRzC+9HuDRPynEPwhM="),
+			},
+			difficulty: 16,
+			err:        ErrInvalidNonce,
+		},
+		{
+			data: b64ToBytes("gd3I0kiy3M3T/dXoTwytYrCPLRC1f5qDHBNFHlxcgKU="),
+			nonce: Nonce{
+				Value:   668,
+				Payload: b64ToBytes("AACan9a7F7IwjPDPMmMy1sFaXag0hLflf/uquU9HrSo="),
+			},
+			difficulty: 16,
+			err:        ErrPayloadMismatch,
+		},
+		{
+			data: b64ToBytes("xL2OQM8Z7a5QloweIkbbBv45sxtX/j4/84h5HmqQxUE="),
+			nonce: Nonce{
+				Value:   56666,
+				Payload: b64ToBytes("AACan9a7F7IwjPDPMmMy1sFaXag0hLflf/uquU9HrSo="),
+			},
+			difficulty: 24,
+			err:        ErrInvalidNonce,
+		},
+	}
+
+	for _, test := range tests {
+		err := VerifyNonce(test.data, &test.nonce, test.difficulty)
+		require.Equal(t, test.err, err)
+	}
+
+	// A missing nonce is an error, not a panic
+	require.Equal(t, ErrMissingNonce, VerifyNonce(tests[0].data, nil, 16))
+}
@@ -0,0 +1,13 @@
+package pow
+
+import "context"
+
+// ProofOfWork is an algorithm to find a nonce for some data that is costly to
+// find and cheaper, or at least possible, to verify. The name identifies the
+// algorithm along with its parameters, so two proofs of work with the same
+// name accept the same nonces.
+type ProofOfWork interface {
+	Name() string
+	Solve(ctx context.Context, data []byte, difficulty uint) (*Nonce, error)
+	Verify(data []byte, nonce *Nonce, difficulty uint) error
+}